@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"strings"
+)
+
+// CertificateNames returns the names of the certificate, the URI SANs(e.g. `spiffe://example.com/orders`),
+// the DNS SANs, the email SANs and the subject common name, in order.
+func CertificateNames(cert *x509.Certificate) []string {
+	var names []string
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	if len(cert.Subject.CommonName) > 0 {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return names
+}
+
+// CertificateManager authenticates the subjects by the verified client certificates of the mutual tls,
+// e.g. the service-to-service calls.
+type CertificateManager struct {
+	// PeerCertificates returns the verified certificate chain of the request, e.g. `sha.PeerCertificates`.
+	PeerCertificates func(ctx context.Context) []*x509.Certificate
+	// Subjects maps the names of the leaf certificate to the subjects, the first matched name is used.
+	// The names of the DNS SANs are case-insensitive, their keys should be lower case,
+	// the other names are matched exactly.
+	// It is read only after the manager is used.
+	Subjects map[string]Subject
+	// Lookup is called if no name is matched, e.g. loads the subject from the database.
+	Lookup func(ctx context.Context, cert *x509.Certificate) (Subject, error)
+}
+
+var _ Manager = (*CertificateManager)(nil)
+
+func (m *CertificateManager) Auth(ctx context.Context) (Subject, error) {
+	certs := m.PeerCertificates(ctx)
+	if len(certs) < 1 {
+		return nil, ErrUnauthenticatedOperation
+	}
+	leaf := certs[0]
+	for _, uri := range leaf.URIs {
+		if subject, ok := m.Subjects[uri.String()]; ok {
+			return subject, nil
+		}
+	}
+	// only the DNS names are case-insensitive, the paths of URIs and the local parts of emails are not
+	for _, name := range leaf.DNSNames {
+		if subject, ok := m.Subjects[name]; ok {
+			return subject, nil
+		}
+		if subject, ok := m.Subjects[strings.ToLower(name)]; ok {
+			return subject, nil
+		}
+	}
+	for _, name := range leaf.EmailAddresses {
+		if subject, ok := m.Subjects[name]; ok {
+			return subject, nil
+		}
+	}
+	if name := leaf.Subject.CommonName; len(name) > 0 {
+		if subject, ok := m.Subjects[name]; ok {
+			return subject, nil
+		}
+	}
+	if m.Lookup != nil {
+		return m.Lookup(ctx, leaf)
+	}
+	return nil, ErrUnauthenticatedOperation
+}
@@ -0,0 +1,354 @@
+package sha
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/zzztttkkk/sha/utils"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type _ClientConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+
+	line      []byte // a header line that is larger than the read buffer
+	idleAt    time.Time
+	reused    bool
+	keepAlive bool
+}
+
+// errClientStaleConn means a reused connection was closed by the server before any response byte was read.
+var errClientStaleConn = errors.New("sha.client: stale connection")
+
+// _HostPool holds the connections to one scheme://host:port.
+// conns counts all connections of the host, including the ones in use; a waiter receives an idle connection,
+// or nil meaning that a released slot is handed to it.
+type _HostPool struct {
+	sync.Mutex
+	idle    []*_ClientConn
+	conns   int
+	waiters []chan *_ClientConn
+}
+
+func (pool *_HostPool) get(ctx context.Context, c *Client, scheme, addr, serverName string) (*_ClientConn, error) {
+	pool.Lock()
+	for len(pool.idle) > 0 {
+		cc := pool.idle[len(pool.idle)-1]
+		pool.idle = pool.idle[:len(pool.idle)-1]
+		if c.option.IdleTimeout.Duration > 0 && time.Since(cc.idleAt) > c.option.IdleTimeout.Duration {
+			pool.conns--
+			_ = cc.Conn.Close()
+			continue
+		}
+		pool.Unlock()
+		cc.reused = true
+		return cc, nil
+	}
+
+	if c.option.MaxConnsPerHost < 1 || pool.conns < c.option.MaxConnsPerHost {
+		pool.conns++
+		pool.Unlock()
+		return pool.dial(ctx, c, scheme, addr, serverName)
+	}
+
+	ch := make(chan *_ClientConn, 1)
+	pool.waiters = append(pool.waiters, ch)
+	pool.Unlock()
+
+	select {
+	case cc := <-ch:
+		if cc != nil {
+			cc.reused = true
+			return cc, nil
+		}
+		return pool.dial(ctx, c, scheme, addr, serverName)
+	case <-ctx.Done():
+		pool.Lock()
+		waiting := false
+		for i, w := range pool.waiters {
+			if w == ch {
+				pool.waiters = append(pool.waiters[:i], pool.waiters[i+1:]...)
+				waiting = true
+				break
+			}
+		}
+		pool.Unlock()
+		if !waiting {
+			// a connection or a slot was handed to us at the same time
+			if cc := <-ch; cc != nil {
+				pool.put(cc, &c.option)
+			} else {
+				pool.release()
+			}
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (pool *_HostPool) dial(ctx context.Context, c *Client, scheme, addr, serverName string) (*_ClientConn, error) {
+	conn, err := c.dial(ctx, scheme, addr, serverName)
+	if err != nil {
+		pool.release()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (pool *_HostPool) put(cc *_ClientConn, option *ClientOption) {
+	cc.idleAt = time.Now()
+	pool.Lock()
+	if len(pool.waiters) > 0 {
+		w := pool.waiters[0]
+		pool.waiters = pool.waiters[1:]
+		pool.Unlock()
+		w <- cc
+		return
+	}
+	if len(pool.idle) >= option.MaxIdleConnsPerHost {
+		pool.Unlock()
+		pool.close(cc)
+		return
+	}
+	pool.idle = append(pool.idle, cc)
+	pool.Unlock()
+}
+
+func (pool *_HostPool) close(cc *_ClientConn) {
+	_ = cc.Conn.Close()
+	pool.release()
+}
+
+// release gives the slot of a closed connection to a waiter, or frees it.
+func (pool *_HostPool) release() {
+	pool.Lock()
+	if len(pool.waiters) > 0 {
+		w := pool.waiters[0]
+		pool.waiters = pool.waiters[1:]
+		pool.Unlock()
+		w <- nil
+		return
+	}
+	pool.conns--
+	pool.Unlock()
+}
+
+func (pool *_HostPool) closeIdle() {
+	pool.Lock()
+	idle := pool.idle
+	pool.idle = nil
+	pool.conns -= len(idle)
+	pool.Unlock()
+
+	for _, cc := range idle {
+		_ = cc.Conn.Close()
+	}
+}
+
+func (c *Client) dial(ctx context.Context, scheme, addr, serverName string) (*_ClientConn, error) {
+	dialer := net.Dialer{Timeout: c.option.DialTimeout.Duration}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if scheme == "https" {
+		var cfg *tls.Config
+		if c.option.TLSConfig != nil {
+			cfg = c.option.TLSConfig.Clone()
+		} else {
+			cfg = &tls.Config{}
+		}
+		if len(cfg.ServerName) < 1 {
+			cfg.ServerName = serverName
+		}
+		// the client only speaks http/1.1
+		cfg.NextProtos = []string{"http/1.1"}
+
+		tlsConn := tls.Client(conn, cfg)
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = tlsConn.SetDeadline(deadline)
+		} else if c.option.DialTimeout.Duration > 0 {
+			_ = tlsConn.SetDeadline(time.Now().Add(c.option.DialTimeout.Duration))
+		}
+		if err = tlsConn.Handshake(); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		_ = tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+
+	return &_ClientConn{
+		Conn: conn,
+		r:    bufio.NewReaderSize(conn, c.option.ReadBufferSize),
+		w:    bufio.NewWriterSize(conn, c.option.WriteBufferSize),
+	}, nil
+}
+
+func (cc *_ClientConn) roundTrip(ctx context.Context, c *Client, ex *_ClientExchange, res *Response) error {
+	defer cc.SetDeadline(time.Time{})
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = cc.SetDeadline(deadline)
+	}
+	if done := ctx.Done(); done != nil {
+		stop := make(chan struct{})
+		exited := make(chan struct{})
+		go func() {
+			defer close(exited)
+			select {
+			case <-done:
+				_ = cc.SetDeadline(aLongTimeAgo)
+			case <-stop:
+			}
+		}()
+		defer func() {
+			close(stop)
+			<-exited
+		}()
+	}
+
+	cc.keepAlive = true
+	if err := cc.writeRequest(c, ex); err != nil {
+		if cc.reused {
+			return errClientStaleConn
+		}
+		return err
+	}
+	return cc.readResponse(c, ex, res)
+}
+
+const acceptEncodingAll = "gzip, deflate, br"
+
+func (cc *_ClientConn) writeRequest(c *Client, ex *_ClientExchange) error {
+	buf := c.bodyBufferPool.Get()
+	defer c.bodyBufferPool.Put(buf)
+
+	b := buf.Data
+	b = append(b, ex.method...)
+	b = append(b, ' ')
+	if len(ex.requestURI) > 0 {
+		b = append(b, ex.requestURI...)
+	} else {
+		b = append(b, ex.url.RequestURI()...)
+	}
+	b = append(b, " HTTP/1.1"...)
+	b = append(b, EndLine...)
+
+	req := ex.req
+	if _, ok := req.Header.Get(HeaderHost); !ok || ex.crossHost {
+		b = appendHeaderLine(b, HeaderHost, utils.B(ex.url.Host))
+	}
+
+	ex.acceptEncoding = false
+	hasAcceptEncoding := false
+	req.Header.EachItem(
+		func(item *utils.KvItem) bool {
+			key := utils.S(item.Key)
+			switch {
+			case headerKeyIs(key, HeaderContentLength), headerKeyIs(key, HeaderTransferEncoding):
+				return true
+			case ex.crossHost && (headerKeyIs(key, HeaderHost) || headerKeyIs(key, HeaderAuthorization) ||
+				headerKeyIs(key, HeaderProxyAuthorization) || headerKeyIs(key, HeaderCookie)):
+				return true
+			case ex.bodyless && headerKeyIs(key, HeaderContentType):
+				return true
+			case headerKeyIs(key, HeaderAcceptEncoding):
+				hasAcceptEncoding = true
+			case headerKeyIs(key, HeaderConnection):
+				if hasToken(item.Val, closeStr) {
+					cc.keepAlive = false
+				}
+			}
+			b = appendHeaderLine(b, key, item.Val)
+			return true
+		},
+	)
+
+	if !hasAcceptEncoding && !c.option.DisableCompression && ex.method != MethodHead {
+		b = appendHeaderLine(b, HeaderAcceptEncoding, utils.B(acceptEncodingAll))
+		ex.acceptEncoding = true
+	}
+
+	switch {
+	case ex.bodyStream != nil && ex.bodyStreamSize < 0:
+		b = appendHeaderLine(b, HeaderTransferEncoding, chunkedStr)
+	case ex.bodyStream != nil:
+		b = appendHeaderLine(b, HeaderContentLength, strconv.AppendInt(nil, ex.bodyStreamSize, 10))
+	case len(ex.body) > 0, ex.method == MethodPost, ex.method == MethodPut, ex.method == MethodPatch:
+		b = appendHeaderLine(b, HeaderContentLength, strconv.AppendInt(nil, int64(len(ex.body)), 10))
+	}
+	b = append(b, EndLine...)
+	buf.Data = b
+
+	if _, err := cc.w.Write(b); err != nil {
+		return err
+	}
+	if ex.bodyStream != nil {
+		return cc.writeBodyStream(ex)
+	}
+	if _, err := cc.w.Write(ex.body); err != nil {
+		return err
+	}
+	return cc.w.Flush()
+}
+
+// writeBodyStream sends the data every time it is read from the stream, so the body is not buffered.
+func (cc *_ClientConn) writeBodyStream(ex *_ClientExchange) error {
+	ex.bodyStreamRead = true
+	chunked := ex.bodyStreamSize < 0
+	r := ex.bodyStream
+	if !chunked {
+		r = io.LimitReader(r, ex.bodyStreamSize)
+	}
+
+	var sent int64
+	buf := make([]byte, bodyFileReadSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if chunked {
+				_, _ = cc.w.Write(strconv.AppendInt(nil, int64(n), 16))
+				_, _ = cc.w.WriteString(EndLine)
+			}
+			_, _ = cc.w.Write(buf[:n])
+			if chunked {
+				_, _ = cc.w.WriteString(EndLine)
+			}
+			if e := cc.w.Flush(); e != nil {
+				return e
+			}
+			sent += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if !chunked {
+		if sent < ex.bodyStreamSize {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	}
+	if _, err := cc.w.Write(lastChunk); err != nil {
+		return err
+	}
+	return cc.w.Flush()
+}
+
+func appendHeaderLine(b []byte, key string, val []byte) []byte {
+	b = append(b, key...)
+	b = append(b, headerKVSep...)
+	b = append(b, val...)
+	return append(b, EndLine...)
+}
@@ -0,0 +1,350 @@
+package sha
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/imdario/mergo"
+	"github.com/zzztttkkk/sha/utils"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ClientOption struct {
+	MaxConnsPerHost       int                `json:"max_conns_per_host" toml:"max-conns-per-host"` // zero means no limit
+	MaxIdleConnsPerHost   int                `json:"max_idle_conns_per_host" toml:"max-idle-conns-per-host"`
+	MaxRedirects          int                `json:"max_redirects" toml:"max-redirects"`
+	MaxResponseHeaderSize int                `json:"max_response_header_size" toml:"max-response-header-size"`
+	MaxResponseBodySize   int                `json:"max_response_body_size" toml:"max-response-body-size"`
+	ReadBufferSize        int                `json:"read_buffer_size" toml:"read-buffer-size"`
+	WriteBufferSize       int                `json:"write_buffer_size" toml:"write-buffer-size"`
+	MaxBodyBufferSize     int                `json:"max_body_buffer_size" toml:"max-body-buffer-size"` // pooled body buffers larger than this are dropped
+	DialTimeout           utils.TomlDuration `json:"dial_timeout" toml:"dial-timeout"`
+	IdleTimeout           utils.TomlDuration `json:"idle_timeout" toml:"idle-timeout"`
+	Timeout               utils.TomlDuration `json:"timeout" toml:"timeout"` // the whole exchange, including redirects
+	DisableRedirects      bool               `json:"disable_redirects" toml:"disable-redirects"`
+	DisableCompression    bool               `json:"disable_compression" toml:"disable-compression"`
+	TLSConfig             *tls.Config        `json:"-" toml:"-"`
+}
+
+var defaultClientOption = ClientOption{
+	MaxIdleConnsPerHost:   4,
+	MaxRedirects:          10,
+	MaxResponseHeaderSize: 8192,
+	MaxResponseBodySize:   1024 * 1024 * 10,
+	ReadBufferSize:        4096,
+	WriteBufferSize:       4096,
+	MaxBodyBufferSize:     1024 * 64,
+	DialTimeout:           utils.TomlDuration{Duration: time.Second * 30},
+	IdleTimeout:           utils.TomlDuration{Duration: time.Second * 90},
+}
+
+// Client is a http/1.1 client with per-host connection pooling.
+// A Client is safe for concurrent use.
+type Client struct {
+	option ClientOption
+
+	poolsMutex sync.Mutex
+	pools      map[string]*_HostPool
+
+	bodyBufferPool *utils.BufferPool
+	responsePool   sync.Pool
+}
+
+var (
+	ErrClientUnsupportedScheme      = errors.New("sha.client: unsupported url scheme")
+	ErrClientTooManyRedirects       = errors.New("sha.client: too many redirects")
+	ErrClientBadRequestHeader       = errors.New("sha.client: invalid request header value")
+	ErrClientBadRequestMethod       = errors.New("sha.client: invalid request method")
+	ErrClientBadResponse            = errors.New("sha.client: malformed response")
+	ErrClientResponseHeaderTooLarge = errors.New("sha.client: response header too large")
+	ErrClientResponseBodyTooLarge   = errors.New("sha.client: response body too large")
+)
+
+func NewClient(option *ClientOption) *Client {
+	c := &Client{}
+	if option != nil {
+		c.option = *option
+	}
+	if err := mergo.Merge(&c.option, &defaultClientOption); err != nil {
+		panic(err)
+	}
+	c.pools = map[string]*_HostPool{}
+	c.bodyBufferPool = utils.NewBufferPoll(c.option.MaxBodyBufferSize)
+	c.responsePool.New = func() interface{} { return &Response{} }
+	return c
+}
+
+// AcquireResponse returns an empty response, call `ReleaseResponse` after the body is consumed.
+func (c *Client) AcquireResponse() *Response {
+	return c.responsePool.Get().(*Response)
+}
+
+func (c *Client) ReleaseResponse(res *Response) {
+	res.reset()
+	if res.bodyBuf != nil {
+		c.bodyBufferPool.Put(res.bodyBuf)
+		res.bodyBuf = nil
+	}
+	c.responsePool.Put(res)
+}
+
+func (res *Response) StatusCode() int { return res.statusCode }
+
+// Body returns the response body read by a Client, the content is decoded if the client asked for compression.
+func (res *Response) Body() []byte {
+	if res.bodyBuf == nil {
+		return nil
+	}
+	return res.bodyBuf.Data
+}
+
+// SetBody sets the body a Client sends with the request.
+func (req *Request) SetBody(p []byte) { req.bodyBufferPtr = &p }
+
+func (c *Client) Get(ctx context.Context, rawURL string) (*Response, error) {
+	req := &Request{}
+	req.Method = append(req.Method, MethodGet...)
+	return c.send(ctx, rawURL, req)
+}
+
+func (c *Client) PostForm(ctx context.Context, rawURL string, form *Form) (*Response, error) {
+	req := &Request{}
+	req.Method = append(req.Method, MethodPost...)
+	req.Header.SetContentType(MIMEForm)
+	var body []byte
+	form.EncodeToBuf(&body)
+	req.SetBody(body)
+	return c.send(ctx, rawURL, req)
+}
+
+func (c *Client) send(ctx context.Context, rawURL string, req *Request) (*Response, error) {
+	res := c.AcquireResponse()
+	if err := c.Do(ctx, rawURL, req, res); err != nil {
+		c.ReleaseResponse(res)
+		return nil, err
+	}
+	return res, nil
+}
+
+// Do sends the request to rawURL and reads the response into res, following the redirects.
+// An empty `req.Method` means GET. The request is not modified.
+func (c *Client) Do(ctx context.Context, rawURL string, req *Request, res *Response) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if c.option.Timeout.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.option.Timeout.Duration)
+		defer cancel()
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if !isValidClientHeader(&req.Header) {
+		return ErrClientBadRequestHeader
+	}
+
+	ex := _ClientExchange{req: req, method: string(req.Method), body: req.BodyRaw()}
+	if len(ex.method) < 1 {
+		ex.method = MethodGet
+	}
+
+	for redirects := 0; ; redirects++ {
+		ex.url = u
+		if err = c.exchange(ctx, &ex, res); err != nil {
+			return err
+		}
+		if c.option.DisableRedirects || !isRedirectStatus(res.statusCode) {
+			return nil
+		}
+		location, ok := res.Header.Get(HeaderLocation)
+		if !ok {
+			return nil
+		}
+		if redirects >= c.option.MaxRedirects {
+			return ErrClientTooManyRedirects
+		}
+
+		next, err := u.Parse(string(location))
+		if err != nil {
+			return err
+		}
+		switch res.statusCode {
+		case StatusSeeOther:
+			if ex.method != MethodHead {
+				ex.method = MethodGet
+			}
+			ex.body = nil
+			ex.bodyless = true
+		case StatusMovedPermanently, StatusFound:
+			if ex.method == MethodPost {
+				ex.method = MethodGet
+				ex.body = nil
+				ex.bodyless = true
+			}
+		}
+		// the credentials and the explicit host are not sent to another host
+		if !strings.EqualFold(next.Host, u.Host) {
+			ex.crossHost = true
+		}
+		u = next
+		res.reset()
+	}
+}
+
+// isValidClientHeader rejects the values that would break the request header, e.g. a CRLF injection.
+func isValidClientHeader(header *Header) bool {
+	valid := true
+	header.EachItem(
+		func(item *utils.KvItem) bool {
+			if !isToken(item.Key) {
+				valid = false
+				return false
+			}
+			for _, b := range item.Val {
+				if b == '\r' || !isFieldValueChar(b) {
+					valid = false
+					return false
+				}
+			}
+			return true
+		},
+	)
+	return valid
+}
+
+func isRedirectStatus(code int) bool {
+	switch code {
+	case StatusMovedPermanently, StatusFound, StatusSeeOther, StatusTemporaryRedirect, StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case MethodGet, MethodHead, MethodOptions, MethodTrace, MethodPut, MethodDelete:
+		return true
+	}
+	return false
+}
+
+// _ClientExchange is the state of a request across redirects.
+type _ClientExchange struct {
+	req        *Request
+	url        *url.URL
+	requestURI []byte // sent as is instead of the uri of url if not empty
+	method     string
+	body       []byte
+	// bodyStream is sent instead of body if it is not nil, with the chunked coding if bodyStreamSize is -1.
+	// it can not be sent again, so the request is not retried after it is read.
+	bodyStream     io.Reader
+	bodyStreamSize int64
+	bodyStreamRead bool
+	crossHost      bool // redirected to another host
+	bodyless       bool // redirected as a request without body
+	acceptEncoding bool
+
+	// stream reads the response body instead of buffering it, body is nil if the response has no body
+	stream func(cc *_ClientConn, res *Response, body io.Reader) error
+}
+
+func (c *Client) exchange(ctx context.Context, ex *_ClientExchange, res *Response) error {
+	// the method is written to the request line as it is
+	if !isToken(utils.B(ex.method)) {
+		return ErrClientBadRequestMethod
+	}
+
+	var addr string
+	switch ex.url.Scheme {
+	case "http":
+		addr = hostWithPort(ex.url, "80")
+	case "https":
+		addr = hostWithPort(ex.url, "443")
+	default:
+		return ErrClientUnsupportedScheme
+	}
+	pool := c.getPool(ex.url.Scheme + "://" + addr)
+
+	for {
+		cc, err := pool.get(ctx, c, ex.url.Scheme, addr, ex.url.Hostname())
+		if err != nil {
+			return contextError(ctx, err)
+		}
+
+		err = cc.roundTrip(ctx, c, ex, res)
+		if err == nil {
+			if cc.keepAlive {
+				pool.put(cc, &c.option)
+			} else {
+				pool.close(cc)
+			}
+			return nil
+		}
+		pool.close(cc)
+
+		// the server may close an idle connection at any time, retry the idempotent request on a new connection.
+		if err == errClientStaleConn {
+			if isIdempotentMethod(ex.method) && ctx.Err() == nil && !ex.bodyStreamRead {
+				res.reset()
+				continue
+			}
+			err = ErrClientBadResponse
+		}
+		return contextError(ctx, err)
+	}
+}
+
+// contextError returns the error of the context if it is done, the connection deadline is the one of the context,
+// which may be reached before the context is canceled by its timer.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+	}
+	return err
+}
+
+func hostWithPort(u *url.URL, defaultPort string) string {
+	if port := u.Port(); len(port) > 0 {
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
+
+func (c *Client) getPool(key string) *_HostPool {
+	c.poolsMutex.Lock()
+	defer c.poolsMutex.Unlock()
+	pool := c.pools[key]
+	if pool == nil {
+		pool = &_HostPool{}
+		c.pools[key] = pool
+	}
+	return pool
+}
+
+// CloseIdleConnections closes the pooled connections that are not in use.
+func (c *Client) CloseIdleConnections() {
+	c.poolsMutex.Lock()
+	pools := make([]*_HostPool, 0, len(c.pools))
+	for _, pool := range c.pools {
+		pools = append(pools, pool)
+	}
+	c.poolsMutex.Unlock()
+
+	for _, pool := range pools {
+		pool.closeIdle()
+	}
+}
@@ -0,0 +1,347 @@
+package sha
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+	"github.com/zzztttkkk/sha/utils"
+	"io"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+func headerKeyIs(key, name string) bool { return strings.EqualFold(key, name) }
+
+// hasToken reports whether the comma-separated header value contains the token, case-insensitively.
+func hasToken(v []byte, token string) bool {
+	for _, item := range bytes.Split(v, []byte(",")) {
+		if strings.EqualFold(utils.S(bytes.TrimSpace(item)), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// readLine reads a line without the line ending, limit is the remaining size of the header part.
+func (cc *_ClientConn) readLine(limit *int) ([]byte, error) {
+	cc.line = cc.line[:0]
+	for {
+		line, err := cc.r.ReadSlice('\n')
+		*limit -= len(line)
+		if *limit < 0 {
+			return nil, ErrClientResponseHeaderTooLarge
+		}
+		if err == bufio.ErrBufferFull {
+			cc.line = append(cc.line, line...)
+			continue
+		}
+		if err != nil {
+			if len(cc.line) == 0 && len(line) == 0 {
+				return nil, err
+			}
+			return nil, io.ErrUnexpectedEOF
+		}
+		if len(cc.line) > 0 {
+			line = append(cc.line, line...)
+			cc.line = line
+		}
+		line = line[:len(line)-1]
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+		return line, nil
+	}
+}
+
+// canonicalResponseHeaderKey converts the key to the form of the header constants, e.g. `content-length` to `Content-Length`.
+func canonicalResponseHeaderKey(key []byte) []byte {
+	upper := true
+	for i, v := range key {
+		if upper {
+			key[i] = toUpperTable[v]
+		} else {
+			key[i] = toLowerTable[v]
+		}
+		upper = v == '-'
+	}
+	return key
+}
+
+func (cc *_ClientConn) readResponse(c *Client, ex *_ClientExchange, res *Response) error {
+	limit := c.option.MaxResponseHeaderSize
+	http10 := false
+
+	for {
+		line, err := cc.readLine(&limit)
+		if err != nil {
+			if cc.reused && (err == io.EOF || errors.Is(err, syscall.ECONNRESET)) {
+				return errClientStaleConn
+			}
+			return err
+		}
+
+		// HTTP/1.1 200 OK
+		if len(line) < 12 || !bytes.HasPrefix(line, []byte("HTTP/1.")) || line[8] != ' ' {
+			return ErrClientBadResponse
+		}
+		http10 = line[7] == '0'
+		code, err := strconv.ParseInt(utils.S(line[9:12]), 10, 32)
+		if err != nil || code < 100 || (len(line) > 12 && line[12] != ' ') {
+			return ErrClientBadResponse
+		}
+		res.statusCode = int(code)
+
+		res.Header.Reset()
+		for {
+			line, err = cc.readLine(&limit)
+			if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return err
+			}
+			if len(line) == 0 {
+				break
+			}
+			ind := bytes.IndexByte(line, ':')
+			// the obsolete line folding is not supported
+			if ind < 1 || line[0] == ' ' || line[0] == '\t' {
+				return ErrClientBadResponse
+			}
+			res.Header.AppendBytes(
+				canonicalResponseHeaderKey(bytes.TrimSpace(line[:ind])),
+				bytes.TrimSpace(line[ind+1:]),
+			)
+		}
+
+		// skip the interim responses, e.g. `100 Continue`
+		if code >= 200 || code == StatusSwitchingProtocols {
+			break
+		}
+	}
+
+	if connection, ok := res.Header.Get(HeaderConnection); ok {
+		if hasToken(connection, closeStr) || (http10 && !hasToken(connection, utils.S(keepAliveStr))) {
+			cc.keepAlive = false
+		}
+	} else if http10 {
+		cc.keepAlive = false
+	}
+
+	body, err := cc.bodyReader(c, ex, res)
+	if err != nil {
+		return err
+	}
+	if ex.stream != nil {
+		return ex.stream(cc, res, body)
+	}
+
+	if res.bodyBuf == nil {
+		res.bodyBuf = c.bodyBufferPool.Get()
+	}
+	if body != nil {
+		if err = readAllLimited(res.bodyBuf, body, c.option.MaxResponseBodySize); err != nil {
+			return err
+		}
+	}
+	if ex.acceptEncoding {
+		return c.decodeBody(res)
+	}
+	return nil
+}
+
+// bodyReader returns the reader of the response body, nil means the response has no body.
+func (cc *_ClientConn) bodyReader(c *Client, ex *_ClientExchange, res *Response) (io.Reader, error) {
+	switch {
+	case ex.method == MethodHead, res.statusCode < 200, res.statusCode == StatusNoContent, res.statusCode == StatusNotModified:
+		if res.statusCode == StatusSwitchingProtocols {
+			cc.keepAlive = false
+		}
+		return nil, nil
+	}
+
+	if te, ok := res.Header.Get(HeaderTransferEncoding); ok {
+		if bytes.HasSuffix(inPlaceLowercase(te), []byte("chunked")) {
+			return &_ChunkedBodyReader{cc: cc, lineLimit: c.option.MaxResponseHeaderSize}, nil
+		}
+		cc.keepAlive = false
+		return cc.r, nil
+	}
+
+	if cl, ok := res.Header.Get(HeaderContentLength); ok {
+		size, err := strconv.ParseInt(utils.S(cl), 10, 64)
+		if err != nil || size < 0 {
+			return nil, ErrClientBadResponse
+		}
+		if ex.stream == nil && size > int64(c.option.MaxResponseBodySize) {
+			return nil, ErrClientResponseBodyTooLarge
+		}
+		return &io.LimitedReader{R: cc.r, N: size}, nil
+	}
+
+	cc.keepAlive = false
+	return cc.r, nil
+}
+
+// bodyDone reports whether all the data of a body reader is read without another Read call.
+func bodyDone(r io.Reader) bool {
+	lr, ok := r.(*io.LimitedReader)
+	return ok && lr.N < 1
+}
+
+func readAllLimited(buf *utils.Buf, r io.Reader, max int) error {
+	if lr, ok := r.(*io.LimitedReader); ok && int64(cap(buf.Data)-len(buf.Data)) < lr.N {
+		data := make([]byte, len(buf.Data), int64(len(buf.Data))+lr.N)
+		copy(data, buf.Data)
+		buf.Data = data
+	}
+	for {
+		if len(buf.Data) == cap(buf.Data) {
+			buf.Data = append(buf.Data, 0)[:len(buf.Data)]
+		}
+		n, err := r.Read(buf.Data[len(buf.Data):cap(buf.Data)])
+		buf.Data = buf.Data[:len(buf.Data)+n]
+		if len(buf.Data) > max {
+			return ErrClientResponseBodyTooLarge
+		}
+		if err != nil {
+			if err == io.EOF {
+				if lr, ok := r.(*io.LimitedReader); ok && lr.N > 0 {
+					return io.ErrUnexpectedEOF
+				}
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// _ChunkedBodyReader decodes a chunked response body, the trailers are discarded.
+type _ChunkedBodyReader struct {
+	cc        *_ClientConn
+	lineLimit int
+	remain    uint64
+	err       error
+}
+
+func (r *_ChunkedBodyReader) readLine() ([]byte, error) {
+	limit := r.lineLimit
+	line, err := r.cc.readLine(&limit)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return line, err
+}
+
+func (r *_ChunkedBodyReader) nextChunk() error {
+	line, err := r.readLine()
+	if err != nil {
+		return err
+	}
+	if ind := bytes.IndexByte(line, ';'); ind > -1 {
+		line = line[:ind]
+	}
+	r.remain, err = strconv.ParseUint(utils.S(bytes.TrimSpace(line)), 16, 63)
+	if err != nil {
+		return ErrClientBadResponse
+	}
+	if r.remain > 0 {
+		return nil
+	}
+	for {
+		line, err = r.readLine()
+		if err != nil {
+			return err
+		}
+		if len(line) == 0 {
+			return io.EOF
+		}
+	}
+}
+
+func (r *_ChunkedBodyReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.remain == 0 {
+		if r.err = r.nextChunk(); r.err != nil {
+			return 0, r.err
+		}
+	}
+
+	if uint64(len(p)) > r.remain {
+		p = p[:r.remain]
+	}
+	n, err := r.cc.r.Read(p)
+	r.remain -= uint64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && r.remain == 0 {
+		var line []byte
+		if line, err = r.readLine(); err == nil && len(line) != 0 {
+			err = ErrClientBadResponse
+		}
+	}
+	r.err = err
+	return n, err
+}
+
+// decodeBody decompresses the body of the response, the `Content-Encoding` and `Content-Length` headers are removed.
+func (c *Client) decodeBody(res *Response) error {
+	encoding, ok := res.Header.Get(HeaderContentEncoding)
+	if !ok || len(res.bodyBuf.Data) < 1 {
+		return nil
+	}
+
+	var reader io.Reader
+	var err error
+	src := bytes.NewReader(res.bodyBuf.Data)
+	switch strings.ToLower(utils.S(encoding)) {
+	case "gzip":
+		reader, err = gzip.NewReader(src)
+	case "deflate":
+		// RFC 7230 says zlib, but some servers(including sha) send the raw deflate data
+		if isZlibHeader(res.bodyBuf.Data) {
+			reader, err = zlib.NewReader(src)
+		} else {
+			reader = flate.NewReader(src)
+		}
+	case "br":
+		reader = brotli.NewReader(src)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	max := c.option.MaxResponseBodySize
+	buf := c.bodyBufferPool.Get()
+	n, err := io.Copy(buf, io.LimitReader(reader, int64(max)+1))
+	if closer, ok := reader.(io.Closer); ok {
+		_ = closer.Close()
+	}
+	if err == nil && n > int64(max) {
+		err = ErrClientResponseBodyTooLarge
+	}
+	if err != nil {
+		c.bodyBufferPool.Put(buf)
+		return err
+	}
+
+	c.bodyBufferPool.Put(res.bodyBuf)
+	res.bodyBuf = buf
+	res.Header.Del(HeaderContentEncoding)
+	res.Header.Del(HeaderContentLength)
+	return nil
+}
+
+func isZlibHeader(p []byte) bool {
+	return len(p) > 1 && p[0]&0x0f == 8 && (uint16(p[0])<<8|uint16(p[1]))%31 == 0
+}
@@ -0,0 +1,295 @@
+package sha
+
+import (
+	"context"
+	"errors"
+	"github.com/zzztttkkk/sha/utils"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func startTestClientServer(t *testing.T) (*Server, string, *int32) {
+	var accepted int32
+	s := New(nil, &ServerOption{Addr: "127.0.0.1:0"}, nil, nil)
+	s.OnConnectionAccepted = func(conn net.Conn) bool {
+		atomic.AddInt32(&accepted, 1)
+		return true
+	}
+	s.Handler = RequestHandlerFunc(func(ctx *RequestCtx) {
+		switch string(ctx.Request.Path) {
+		case "/chunked":
+			_, _ = ctx.WriteString("hello ")
+			_ = ctx.Flush()
+			_, _ = ctx.WriteString("world")
+		case "/gzip":
+			ctx.CompressGzip()
+			_, _ = ctx.WriteString(strings.Repeat("gzip", 100))
+		case "/br":
+			ctx.CompressBrotli()
+			_, _ = ctx.WriteString(strings.Repeat("br", 100))
+		case "/deflate":
+			ctx.CompressDeflate()
+			_, _ = ctx.WriteString(strings.Repeat("deflate", 100))
+		case "/see-other":
+			ctx.Response.Header.Set(HeaderLocation, []byte("/echo"))
+			ctx.SetStatus(StatusSeeOther)
+		case "/temporary":
+			ctx.Response.Header.Set(HeaderLocation, []byte("echo"))
+			ctx.SetStatus(StatusTemporaryRedirect)
+		case "/loop":
+			ctx.Response.Header.Set(HeaderLocation, []byte("/loop"))
+			ctx.SetStatus(StatusFound)
+		case "/slow":
+			time.Sleep(time.Millisecond * 300)
+		case "/form":
+			v, _ := ctx.Request.BodyFormValue("name")
+			_, _ = ctx.Write(v)
+		default:
+			_, _ = ctx.Write(ctx.Request.Method)
+			_, _ = ctx.WriteString(" ")
+			_, _ = ctx.Write(ctx.Request.BodyRaw())
+		}
+	})
+	return s, serveTestServer(t, s), &accepted
+}
+
+func TestClient_KeepAlive(t *testing.T) {
+	s, addr, accepted := startTestClientServer(t)
+	defer s.Shutdown(context.Background())
+
+	c := NewClient(nil)
+	for i := 0; i < 3; i++ {
+		res, err := c.Get(context.Background(), "http://"+addr+"/echo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode() != 200 || string(res.Body()) != "GET " {
+			t.Fatalf("bad response: %d %q", res.StatusCode(), res.Body())
+		}
+		c.ReleaseResponse(res)
+	}
+	if n := atomic.LoadInt32(accepted); n != 1 {
+		t.Fatalf("expected 1 connection, got %d", n)
+	}
+
+	// the server closed the idle connection, the request is retried on a new one
+	c.getPool("http://" + addr).idle[0].Conn.Close()
+	res, err := c.Get(context.Background(), "http://"+addr+"/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ReleaseResponse(res)
+}
+
+func TestClient_Body(t *testing.T) {
+	s, addr, _ := startTestClientServer(t)
+	defer s.Shutdown(context.Background())
+
+	c := NewClient(nil)
+	for path, expected := range map[string]string{
+		"/chunked": "hello world",
+		"/gzip":    strings.Repeat("gzip", 100),
+		"/br":      strings.Repeat("br", 100),
+		"/deflate": strings.Repeat("deflate", 100),
+	} {
+		res, err := c.Get(context.Background(), "http://"+addr+path)
+		if err != nil {
+			t.Fatal(path, err)
+		}
+		if string(res.Body()) != expected {
+			t.Fatalf("%s: bad body %q", path, res.Body())
+		}
+		if _, ok := res.Header.Get(HeaderContentEncoding); ok {
+			t.Fatalf("%s: content encoding should be removed", path)
+		}
+		c.ReleaseResponse(res)
+	}
+
+	form := Form{}
+	form.Append("name", []byte("a b&c"))
+	res, err := c.PostForm(context.Background(), "http://"+addr+"/form", &form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res.Body()) != "a b&c" {
+		t.Fatalf("bad form body %q", res.Body())
+	}
+	c.ReleaseResponse(res)
+
+	small := NewClient(&ClientOption{MaxResponseBodySize: 10})
+	if _, err = small.Get(context.Background(), "http://"+addr+"/gzip"); err != ErrClientResponseBodyTooLarge {
+		t.Fatalf("expected body too large, got %v", err)
+	}
+}
+
+func TestClient_Redirect(t *testing.T) {
+	s, addr, _ := startTestClientServer(t)
+	defer s.Shutdown(context.Background())
+
+	c := NewClient(nil)
+	res := c.AcquireResponse()
+	defer c.ReleaseResponse(res)
+
+	req := &Request{}
+	req.Method = append(req.Method, MethodPost...)
+	req.SetBody([]byte("data"))
+
+	if err := c.Do(context.Background(), "http://"+addr+"/see-other", req, res); err != nil {
+		t.Fatal(err)
+	}
+	if string(res.Body()) != "GET " {
+		t.Fatalf("303 should change the method to GET, got %q", res.Body())
+	}
+
+	res.reset()
+	if err := c.Do(context.Background(), "http://"+addr+"/temporary", req, res); err != nil {
+		t.Fatal(err)
+	}
+	if string(res.Body()) != "POST data" {
+		t.Fatalf("307 should keep the method and body, got %q", res.Body())
+	}
+
+	res.reset()
+	if err := c.Do(context.Background(), "http://"+addr+"/loop", req, res); err != ErrClientTooManyRedirects {
+		t.Fatalf("expected too many redirects, got %v", err)
+	}
+
+	noRedirect := NewClient(&ClientOption{DisableRedirects: true})
+	res.reset()
+	if err := noRedirect.Do(context.Background(), "http://"+addr+"/loop", req, res); err != nil || res.StatusCode() != StatusFound {
+		t.Fatalf("unexpected result: %d %v", res.StatusCode(), err)
+	}
+}
+
+func TestClient_RedirectHeaders(t *testing.T) {
+	echoHeaders := RequestHandlerFunc(func(ctx *RequestCtx) {
+		for _, key := range []string{HeaderHost, HeaderAuthorization, HeaderProxyAuthorization, HeaderCookie, HeaderContentType} {
+			v, _ := ctx.Request.Header.Get(key)
+			_, _ = ctx.WriteString(key + "=" + string(v) + ";")
+		}
+	})
+	other, otherAddr := startTestServer(t, echoHeaders)
+	defer other.Shutdown(context.Background())
+	s, addr := startTestServer(t, RequestHandlerFunc(func(ctx *RequestCtx) {
+		switch string(ctx.Request.Path) {
+		case "/cross":
+			ctx.Response.Header.Set(HeaderLocation, []byte("http://"+otherAddr+"/"))
+			ctx.SetStatus(StatusTemporaryRedirect)
+		case "/found":
+			ctx.Response.Header.Set(HeaderLocation, []byte("/echo"))
+			ctx.SetStatus(StatusFound)
+		default:
+			echoHeaders(ctx)
+		}
+	}))
+	defer s.Shutdown(context.Background())
+
+	c := NewClient(nil)
+	res := c.AcquireResponse()
+	defer c.ReleaseResponse(res)
+	newRequest := func() *Request {
+		req := &Request{}
+		req.Method = append(req.Method, MethodPost...)
+		req.Header.Set(HeaderHost, []byte("virtual.example"))
+		req.Header.Set(HeaderAuthorization, []byte("Basic a"))
+		req.Header.Set(HeaderProxyAuthorization, []byte("Basic b"))
+		req.Header.Set(HeaderCookie, []byte("c=d"))
+		req.Header.Set(HeaderContentType, []byte(MIMEText))
+		req.SetBody([]byte("data"))
+		return req
+	}
+
+	if err := c.Do(context.Background(), "http://"+addr+"/cross", newRequest(), res); err != nil {
+		t.Fatal(err)
+	}
+	expected := "Host=" + otherAddr + ";Authorization=;Proxy-Authorization=;Cookie=;Content-Type=" + MIMEText + ";"
+	if string(res.Body()) != expected {
+		t.Fatalf("unexpected headers of the cross host redirect: %q", res.Body())
+	}
+
+	res.reset()
+	if err := c.Do(context.Background(), "http://"+addr+"/found", newRequest(), res); err != nil {
+		t.Fatal(err)
+	}
+	expected = "Host=virtual.example;Authorization=Basic a;Proxy-Authorization=Basic b;Cookie=c=d;Content-Type=;"
+	if string(res.Body()) != expected {
+		t.Fatalf("unexpected headers of the bodyless redirect: %q", res.Body())
+	}
+}
+
+func TestClient_Timeout(t *testing.T) {
+	s, addr, _ := startTestClientServer(t)
+	defer s.Shutdown(context.Background())
+
+	c := NewClient(&ClientOption{Timeout: utils.TomlDuration{Duration: time.Millisecond * 50}})
+	if _, err := c.Get(context.Background(), "http://"+addr+"/slow"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*50, cancel)
+	if _, err := NewClient(nil).Get(ctx, "http://"+addr+"/slow"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+}
+
+func TestClient_MaxConnsPerHost(t *testing.T) {
+	s, addr, accepted := startTestClientServer(t)
+	defer s.Shutdown(context.Background())
+
+	c := NewClient(&ClientOption{MaxConnsPerHost: 2})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := c.Get(context.Background(), "http://"+addr+"/echo")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			c.ReleaseResponse(res)
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(accepted); n > 2 {
+		t.Fatalf("expected at most 2 connections, got %d", n)
+	}
+}
+
+func TestClient_InvalidRequest(t *testing.T) {
+	s, addr, accepted := startTestClientServer(t)
+	defer s.Shutdown(context.Background())
+
+	c := NewClient(nil)
+	res := c.AcquireResponse()
+	defer c.ReleaseResponse(res)
+	do := func(method string, header ...string) error {
+		req := &Request{}
+		req.Method = append(req.Method, method...)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Append(header[i], []byte(header[i+1]))
+		}
+		return c.Do(context.Background(), "http://"+addr+"/echo", req, res)
+	}
+
+	for _, method := range []string{"GET / HTTP/1.1\r\nHost: a\r\n\r\nGET", "GE T", "GET\n", "GET\x00"} {
+		if err := do(method); err != ErrClientBadRequestMethod {
+			t.Fatalf("%q: expected bad method, got %v", method, err)
+		}
+	}
+	if err := do(MethodGet, "X-Foo", "a\r\nX-Injected: 1"); err != ErrClientBadRequestHeader {
+		t.Fatalf("expected bad header, got %v", err)
+	}
+	if n := atomic.LoadInt32(accepted); n != 0 {
+		t.Fatalf("the invalid requests are sent: %d", n)
+	}
+
+	if err := do("PURGE"); err != nil || string(res.Body()) != "PURGE " {
+		t.Fatalf("bad response: %v %q", err, res.Body())
+	}
+}
@@ -3,132 +3,320 @@ package sha
 import (
 	"bytes"
 	"github.com/andybalholm/brotli"
+	"github.com/imdario/mergo"
 	"github.com/klauspost/compress/flate"
 	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
 	"github.com/zzztttkkk/sha/utils"
 	"io"
+	"strconv"
+	"strings"
 	"sync"
 )
 
 var (
-	headerCompressValueSep = []byte(", ")
-	gzipStr                = []byte("gzip")
-	deflateStr             = []byte("deflate")
-	brotliStr              = []byte("br")
-
 	CompressLevelGzip    = gzip.DefaultCompression
 	CompressLevelDeflate = flate.DefaultCompression
 	CompressLevelBrotli  = brotli.DefaultCompression
+	CompressLevelZstd    = zstd.SpeedDefault
 )
 
 type _CompressionWriter interface {
-	io.Writer
+	io.WriteCloser
 	Flush() error
 	Reset(writer io.Writer)
 }
 
-var brWriterPool = sync.Pool{New: func() interface{} { return nil }}
+type _Encoder struct {
+	name      string
+	pool      sync.Pool
+	newWriter func(w io.Writer) _CompressionWriter
+}
 
-func (ctx *RequestCtx) CompressBrotli() {
-	ctx.Response.Header.Set(HeaderContentEncoding, brotliStr)
-	ctx.Response.compressWriterPool = &brWriterPool
+var encoders = map[string]*_Encoder{
+	"br": {
+		name:      "br",
+		newWriter: func(w io.Writer) _CompressionWriter { return brotli.NewWriterLevel(w, CompressLevelBrotli) },
+	},
+	"gzip": {
+		name: "gzip",
+		newWriter: func(w io.Writer) _CompressionWriter {
+			cwr, err := gzip.NewWriterLevel(w, CompressLevelGzip)
+			if err != nil {
+				panic(err)
+			}
+			return cwr
+		},
+	},
+	"deflate": {
+		name: "deflate",
+		newWriter: func(w io.Writer) _CompressionWriter {
+			cwr, err := flate.NewWriter(w, CompressLevelDeflate)
+			if err != nil {
+				panic(err)
+			}
+			return cwr
+		},
+	},
+	"zstd": {
+		name: "zstd",
+		newWriter: func(w io.Writer) _CompressionWriter {
+			// the browsers reject the windows larger than 8MB(RFC 9659), 1MB keeps the memory of the pooled encoders small
+			cwr, err := zstd.NewWriter(
+				w,
+				zstd.WithEncoderLevel(CompressLevelZstd), zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(1<<20),
+			)
+			if err != nil {
+				panic(err)
+			}
+			return cwr
+		},
+	},
+}
+
+var compressRawBufferPool = utils.NewBufferPoll(4096)
+
+// compress compresses the buffered body and the later writes, it does nothing if the response is already compressed.
+func (ctx *RequestCtx) compress(encoder *_Encoder) {
+	res := &ctx.Response
+	if res.compressWriter != nil {
+		return
+	}
+	res.Header.Set(HeaderContentEncoding, utils.B(encoder.name))
+	res.compressWriterPool = &encoder.pool
 
-	var cwr *brotli.Writer
-	brI := brWriterPool.Get()
-	if brI != nil {
-		cwr = brI.(*brotli.Writer)
-		cwr.Reset(ctx.Response.bodyBuf)
+	var cwr _CompressionWriter
+	if v := encoder.pool.Get(); v != nil {
+		cwr = v.(_CompressionWriter)
+		cwr.Reset(res.bodyBuf)
 	} else {
-		cwr = brotli.NewWriterLevel(ctx.Response.bodyBuf, CompressLevelBrotli)
+		cwr = encoder.newWriter(res.bodyBuf)
+	}
+	res.compressWriter = cwr
+
+	if len(res.bodyBuf.Data) > 0 {
+		raw := compressRawBufferPool.Get()
+		raw.Data = append(raw.Data, res.bodyBuf.Data...)
+		res.bodyBuf.Data = res.bodyBuf.Data[:0]
+		_, _ = cwr.Write(raw.Data)
+		compressRawBufferPool.Put(raw)
 	}
-	ctx.Response.compressWriter = cwr
 }
 
-var gzipWriterPool = sync.Pool{New: func() interface{} { return nil }}
+func (ctx *RequestCtx) CompressBrotli() { ctx.compress(encoders["br"]) }
 
-func (ctx *RequestCtx) CompressGzip() {
-	ctx.Response.Header.Set(HeaderContentEncoding, gzipStr)
-	ctx.Response.compressWriterPool = &gzipWriterPool
+func (ctx *RequestCtx) CompressGzip() { ctx.compress(encoders["gzip"]) }
 
-	var cwr *gzip.Writer
-	var err error
-	brI := gzipWriterPool.Get()
-	if brI != nil {
-		cwr = brI.(*gzip.Writer)
-		cwr.Reset(ctx.Response.bodyBuf)
-	} else {
-		cwr, err = gzip.NewWriterLevel(ctx.Response.bodyBuf, CompressLevelGzip)
-		if err != nil {
-			panic(err)
+func (ctx *RequestCtx) CompressDeflate() { ctx.compress(encoders["deflate"]) }
+
+func (ctx *RequestCtx) CompressZstd() { ctx.compress(encoders["zstd"]) }
+
+var disableCompress = false
+
+// DisableCompress keep raw response body when debugging
+func DisableCompress() {
+	disableCompress = true
+}
+
+type CompressionOption struct {
+	// Encodings is the preference order of the server, it is used if the client accepts some of them with the same q-value.
+	Encodings []string `json:"encodings" toml:"encodings"`
+	// MinSize is the min size of the body to compress, nil means 1024, the streaming bodies are always compressed.
+	MinSize *int `json:"min_size" toml:"min-size"`
+	// ContentTypes are the compressible media types, e.g. `application/json`,
+	// `text/*` matches all the subtypes and `+json` matches the structured syntax suffix.
+	ContentTypes []string `json:"content_types" toml:"content-types"`
+}
+
+var defaultCompressionOption = CompressionOption{
+	Encodings: []string{"zstd", "br", "gzip", "deflate"},
+	ContentTypes: []string{
+		"text/*", "application/json", "application/javascript", "application/xml", "application/wasm",
+		"image/svg+xml", "+json", "+xml",
+	},
+}
+
+type _Compression struct {
+	encoders     []*_Encoder
+	minSize      int
+	contentTypes map[string]bool
+}
+
+func newCompression(option *CompressionOption) *_Compression {
+	var opt CompressionOption
+	if option != nil {
+		opt = *option
+	}
+	if err := mergo.Merge(&opt, &defaultCompressionOption); err != nil {
+		panic(err)
+	}
+
+	c := &_Compression{minSize: 1024, contentTypes: map[string]bool{}}
+	if opt.MinSize != nil {
+		c.minSize = *opt.MinSize
+	}
+	for _, name := range opt.Encodings {
+		encoder, ok := encoders[strings.ToLower(name)]
+		if !ok {
+			panic("sha: unknown content encoding `" + name + "`")
 		}
+		c.encoders = append(c.encoders, encoder)
+	}
+	for _, v := range opt.ContentTypes {
+		c.contentTypes[strings.ToLower(v)] = true
 	}
-	ctx.Response.compressWriter = cwr
+	return c
 }
 
-var deflateWriterPool = sync.Pool{New: func() interface{} { return nil }}
+var defaultCompression = newCompression(nil)
+
+func (c *_Compression) compressible(contentType []byte) bool {
+	if ind := bytes.IndexByte(contentType, ';'); ind > -1 {
+		contentType = contentType[:ind]
+	}
+	v := strings.ToLower(strings.TrimSpace(string(contentType)))
+	if len(v) < 1 {
+		return false
+	}
+	if c.contentTypes[v] {
+		return true
+	}
+	if ind := strings.IndexByte(v, '/'); ind > 0 && c.contentTypes[v[:ind]+"/*"] {
+		return true
+	}
+	if ind := strings.LastIndexByte(v, '+'); ind > 0 && c.contentTypes[v[ind:]] {
+		return true
+	}
+	return false
+}
 
-func (ctx *RequestCtx) CompressDeflate() {
-	ctx.Response.Header.Set(HeaderContentEncoding, deflateStr)
-	ctx.Response.compressWriterPool = &deflateWriterPool
+type _AcceptedEncoding struct {
+	name string
+	q    float64
+}
 
-	var cwr *flate.Writer
-	var err error
-	brI := deflateWriterPool.Get()
-	if brI != nil {
-		cwr = brI.(*flate.Writer)
-		cwr.Reset(ctx.Response.bodyBuf)
-	} else {
-		cwr, err = flate.NewWriter(ctx.Response.bodyBuf, CompressLevelDeflate)
-		if err != nil {
-			panic(err)
+// parseAcceptEncoding parses the codings and their q-values, RFC 7231 5.3.4.
+func parseAcceptEncoding(values [][]byte) []_AcceptedEncoding {
+	var rv []_AcceptedEncoding
+	for _, value := range values {
+		for _, element := range bytes.Split(value, []byte(",")) {
+			params := bytes.Split(element, []byte(";"))
+			name := strings.ToLower(string(bytes.TrimSpace(params[0])))
+			if len(name) < 1 {
+				continue
+			}
+			q := 1.0
+			for _, param := range params[1:] {
+				param = bytes.TrimSpace(param)
+				if len(param) < 2 || (param[0] != 'q' && param[0] != 'Q') || param[1] != '=' {
+					continue
+				}
+				v, err := strconv.ParseFloat(string(param[2:]), 64)
+				if err != nil || v < 0 || v > 1 {
+					v = 0
+				}
+				q = v
+			}
+			rv = append(rv, _AcceptedEncoding{name: name, q: q})
 		}
 	}
-	ctx.Response.compressWriter = cwr
+	return rv
 }
 
-var disableCompress = false
-
-// DisableCompress keep raw response body when debugging
-func DisableCompress() {
-	disableCompress = true
+// acceptedQ returns the q-value of the encoding, `*` matches the encodings that are not listed.
+func acceptedQ(accepted []_AcceptedEncoding, name string) float64 {
+	q, explicit, wildcard := 0.0, false, -1.0
+	for _, v := range accepted {
+		switch v.name {
+		case name:
+			q, explicit = v.q, true
+		case "*":
+			wildcard = v.q
+		}
+	}
+	if !explicit && wildcard > 0 {
+		q = wildcard
+	}
+	return q
 }
 
-// br > deflate > gzip
-func (ctx *RequestCtx) AutoCompress() {
-	if disableCompress {
-		return
+// negotiate returns the encoder with the highest q-value, the preference order of the server breaks the ties.
+func (c *_Compression) negotiate(accepted []_AcceptedEncoding) *_Encoder {
+	var best *_Encoder
+	bestQ := 0.0
+	for _, encoder := range c.encoders {
+		if q := acceptedQ(accepted, encoder.name); q > bestQ {
+			best, bestQ = encoder, q
+		}
 	}
+	return best
+}
+
+// AutoCompress compresses the response by the `Accept-Encoding` of the request,
+// the encoding is decided when the header is sent, by the status, content type and size of the response.
+func (ctx *RequestCtx) AutoCompress() { ctx.Response.autoCompress = true }
 
-	acceptGzip := false
-	acceptDeflate := false
+var acceptEncodingStr = []byte(HeaderAcceptEncoding)
 
-	for _, headerVal := range ctx.Request.Header.GetAll(HeaderAcceptEncoding) {
-		for _, v := range bytes.Split(headerVal, headerCompressValueSep) {
-			switch utils.S(v) {
-			case "gzip":
-				acceptGzip = true
-			case "deflate":
-				acceptDeflate = true
-			case "br":
-				ctx.CompressBrotli()
-				return
+func varyContains(header *Header, name []byte) bool {
+	for _, v := range header.GetAll(HeaderVary) {
+		for _, item := range bytes.Split(v, []byte(",")) {
+			item = bytes.TrimSpace(item)
+			if bytes.EqualFold(item, name) || string(item) == "*" {
+				return true
 			}
 		}
 	}
+	return false
+}
 
-	if acceptDeflate {
-		ctx.CompressDeflate()
+// prepareCompression applies AutoCompress before the header is sent, the size of a streaming body is unknown.
+func (ctx *RequestCtx) prepareCompression(streaming bool) {
+	res := &ctx.Response
+	if !res.autoCompress || disableCompress || res.compressWriter != nil {
+		return
+	}
+	res.autoCompress = false
+	if _, ok := res.Header.Get(HeaderContentEncoding); ok {
+		return
+	}
+	switch status := res.statusCode; {
+	case status < 200 && status > 0, status == StatusNoContent, status == StatusNotModified, status == StatusPartialContent:
 		return
 	}
 
-	if acceptGzip {
-		ctx.CompressGzip()
+	c := ctx.compression
+	if c == nil {
+		c = defaultCompression
+	}
+	contentType, _ := res.Header.Get(HeaderContentType)
+	if !c.compressible(contentType) {
+		return
+	}
+	if !streaming {
+		size := int64(len(res.bodyBuf.Data))
+		if res.bodyFile != nil {
+			size += res.bodyFileSize
+		}
+		if size < int64(c.minSize) {
+			return
+		}
+	}
+
+	if !varyContains(&res.Header, acceptEncodingStr) {
+		res.Header.Append(HeaderVary, acceptEncodingStr)
+	}
+	if encoder := c.negotiate(parseAcceptEncoding(ctx.Request.Header.GetAll(HeaderAcceptEncoding))); encoder != nil {
+		ctx.compress(encoder)
 	}
 }
 
 func (res *Response) freeWriter() {
 	res.sendBuf = nil
+	res.freeCompressWriter()
+}
 
+func (res *Response) freeCompressWriter() {
 	if res.compressWriter == nil {
 		return
 	}
@@ -0,0 +1,129 @@
+package sha
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompression_Negotiate(t *testing.T) {
+	c := newCompression(nil)
+	for header, expected := range map[string]string{
+		"":                         "",
+		"identity":                 "",
+		"gzip, deflate, br":        "br",
+		"br;q=0, gzip":             "gzip",
+		"gzip;q=0.5, zstd;q=0.8":   "zstd",
+		"GZIP;Q=0.5,deflate;q=0.4": "gzip",
+		"*;q=0.1, gzip;q=0":        "zstd",
+		"*, zstd;q=0, br;q=0":      "gzip",
+		"gzip;q=bad, deflate":      "deflate",
+		"zstd;q=0.000, gzip;q=1.0": "gzip",
+	} {
+		encoder := c.negotiate(parseAcceptEncoding([][]byte{[]byte(header)}))
+		name := ""
+		if encoder != nil {
+			name = encoder.name
+		}
+		if name != expected {
+			t.Fatalf("%q: expected %q, got %q", header, expected, name)
+		}
+	}
+
+	c = newCompression(&CompressionOption{Encodings: []string{"gzip", "br"}})
+	if encoder := c.negotiate(parseAcceptEncoding([][]byte{[]byte("br, gzip, zstd")})); encoder.name != "gzip" {
+		t.Fatalf("the preference order is not used: %s", encoder.name)
+	}
+
+	zero := 0
+	if newCompression(&CompressionOption{MinSize: &zero}).minSize != 0 || defaultCompression.minSize != 1024 {
+		t.Fatal("the min size is not configured")
+	}
+
+	for contentType, expected := range map[string]bool{
+		"text/html; charset=utf-8": true,
+		"application/json":         true,
+		"application/ld+json":      true,
+		"image/svg+xml":            true,
+		"image/png":                false,
+		"":                         false,
+	} {
+		if defaultCompression.compressible([]byte(contentType)) != expected {
+			t.Fatalf("%q: expected %v", contentType, expected)
+		}
+	}
+}
+
+func TestRequestCtx_AutoCompress(t *testing.T) {
+	opt := ServerOption{Addr: "127.0.0.1:0"}
+	s := New(nil, &opt, NewHTTP11Protocol(&HTTPOption{AutoCompression: true}), nil)
+	s.Handler = RequestHandlerFunc(func(ctx *RequestCtx) {
+		switch string(ctx.Request.Path) {
+		case "/small":
+			ctx.Response.Header.SetContentType(MIMEText)
+			_, _ = ctx.WriteString("small")
+		case "/png":
+			ctx.Response.Header.SetContentType(MIMEPng)
+			_, _ = ctx.WriteString(strings.Repeat("a", 2048))
+		case "/stream":
+			ctx.Response.Header.SetContentType(MIMEText)
+			_ = ctx.Stream(func(w *bufio.Writer) error {
+				_, _ = w.WriteString("streamed")
+				return w.Flush()
+			})
+		default:
+			ctx.Response.Header.SetContentType(MIMEText)
+			_, _ = ctx.WriteString(strings.Repeat("a", 2048))
+		}
+	})
+	addr := serveTestServer(t, s)
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	for _, c := range []struct {
+		path, acceptEncoding, encoding, vary, body string
+	}{
+		{"/", "gzip;q=0.5, zstd", "zstd", HeaderAcceptEncoding, strings.Repeat("a", 2048)},
+		{"/", "br;q=0", "", HeaderAcceptEncoding, strings.Repeat("a", 2048)},
+		{"/small", "zstd", "", "", "small"},
+		{"/png", "zstd", "", "", strings.Repeat("a", 2048)},
+		{"/stream", "zstd", "zstd", HeaderAcceptEncoding, "streamed"},
+	} {
+		_, _ = conn.Write([]byte("GET " + c.path + " HTTP/1.1\r\nHost: a\r\nAccept-Encoding: " + c.acceptEncoding + "\r\n\r\n"))
+		res, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := res.Header.Get(HeaderContentEncoding); v != c.encoding {
+			t.Fatalf("%s %q: expected encoding %q, got %q", c.path, c.acceptEncoding, c.encoding, v)
+		}
+		if v := res.Header.Get(HeaderVary); v != c.vary {
+			t.Fatalf("%s %q: expected vary %q, got %q", c.path, c.acceptEncoding, c.vary, v)
+		}
+		var body io.Reader = res.Body
+		if c.encoding == "zstd" {
+			decoder, err := zstd.NewReader(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = decoder
+		}
+		data, err := io.ReadAll(body)
+		if err != nil || string(data) != c.body {
+			t.Fatalf("%s: unexpected body: %q %v", c.path, data, err)
+		}
+		_, _ = io.Copy(io.Discard, res.Body)
+	}
+}
@@ -0,0 +1,207 @@
+package sha
+
+import (
+	"bytes"
+	"net"
+	"strings"
+)
+
+// the client information forwarded by the trusted proxies, `ServerOption.TrustedProxies`.
+
+type _ForwardedHop struct {
+	ip    string // empty if the node is unknown or obfuscated
+	proto string
+	host  string
+}
+
+func parseCIDRs(cidrs []string) []*net.IPNet {
+	var rv []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		rv = append(rv, ipNet)
+	}
+	return rv
+}
+
+func ipInNets(ip string, nets []*net.IPNet) bool {
+	v := net.ParseIP(ip)
+	if v == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func unquote(v []byte) []byte {
+	if len(v) > 1 && v[0] == '"' && v[len(v)-1] == '"' {
+		return bytes.ReplaceAll(v[1:len(v)-1], []byte(`\`), nil)
+	}
+	return v
+}
+
+// forwardedNodeIP returns the ip of a `for` node, e.g. `192.0.2.60`, `"192.0.2.60:47011"`, `"[2001:db8:cafe::17]:4711"`.
+func forwardedNodeIP(node string) string {
+	if strings.HasPrefix(node, "[") {
+		if ind := strings.IndexByte(node, ']'); ind > 0 {
+			node = node[1:ind]
+		}
+	} else if strings.Count(node, ":") == 1 {
+		node = node[:strings.IndexByte(node, ':')]
+	}
+	if net.ParseIP(node) == nil {
+		return ""
+	}
+	return node
+}
+
+// parseForwarded parses the `Forwarded` headers, RFC 7239.
+func parseForwarded(values [][]byte) []_ForwardedHop {
+	var hops []_ForwardedHop
+	for _, value := range values {
+		for _, element := range bytes.Split(value, []byte(",")) {
+			var hop _ForwardedHop
+			for _, pair := range bytes.Split(element, []byte(";")) {
+				ind := bytes.IndexByte(pair, '=')
+				if ind < 0 {
+					continue
+				}
+				v := string(unquote(bytes.TrimSpace(pair[ind+1:])))
+				switch strings.ToLower(string(bytes.TrimSpace(pair[:ind]))) {
+				case "for":
+					hop.ip = forwardedNodeIP(v)
+				case "proto":
+					hop.proto = v
+				case "host":
+					hop.host = v
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+func parseXForwardedFor(values [][]byte) []_ForwardedHop {
+	var hops []_ForwardedHop
+	for _, value := range values {
+		for _, node := range bytes.Split(value, []byte(",")) {
+			hops = append(hops, _ForwardedHop{ip: forwardedNodeIP(string(bytes.TrimSpace(node)))})
+		}
+	}
+	return hops
+}
+
+// headerTokens returns the items of a comma separated header, e.g. `X-Forwarded-Proto: https, http`.
+func headerTokens(header *Header, name string) []string {
+	var rv []string
+	for _, value := range getAllHeaderFold(header, name) {
+		for _, v := range bytes.Split(value, []byte(",")) {
+			rv = append(rv, string(bytes.TrimSpace(v)))
+		}
+	}
+	return rv
+}
+
+// forwardedToken returns the item appended by the same proxy as the client hop if the items are one per hop,
+// otherwise the rightmost one, which is appended by the nearest trusted proxy. the leftmost ones are sent by the client.
+func forwardedToken(tokens []string, index, hops int) string {
+	if len(tokens) < 1 {
+		return ""
+	}
+	if index > -1 && len(tokens) == hops {
+		return tokens[index]
+	}
+	return tokens[len(tokens)-1]
+}
+
+func isValidForwardedHost(host string) bool {
+	if len(host) < 1 {
+		return false
+	}
+	for i := 0; i < len(host); i++ {
+		c := host[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`/\?#@"`, c) > -1 {
+			return false
+		}
+	}
+	return true
+}
+
+// forwarded walks the hops from the nearest one, the first hop that is unknown or not a trusted proxy is the client.
+// ok is false if the peer is not a trusted proxy.
+func (ctx *RequestCtx) forwarded() (hop _ForwardedHop, ok bool) {
+	peer := remoteIP(ctx)
+	hop.ip = peer
+	serv, _ := ctx.Value(CtxKeyServer).(*Server)
+	if serv == nil || !ipInNets(peer, serv.trustedProxies) {
+		return hop, false
+	}
+
+	header := &ctx.Request.Header
+	hops := parseForwarded(getAllHeaderFold(header, HeaderForwarded))
+	if len(hops) < 1 {
+		hops = parseXForwardedFor(getAllHeaderFold(header, HeaderXForwardedFor))
+	}
+	index := -1
+	if len(hops) > 0 {
+		index = 0
+		for i := len(hops) - 1; i >= 0; i-- {
+			if len(hops[i].ip) < 1 || !ipInNets(hops[i].ip, serv.trustedProxies) {
+				index = i
+				break
+			}
+		}
+		hop = hops[index]
+	} else if tokens := headerTokens(header, HeaderXRealIP); len(tokens) > 0 {
+		if ip := forwardedNodeIP(tokens[len(tokens)-1]); len(ip) > 0 {
+			hop.ip = ip
+		}
+	}
+
+	if len(hop.proto) < 1 {
+		hop.proto = forwardedToken(headerTokens(header, HeaderXForwardedProto), index, len(hops))
+	}
+	if len(hop.host) < 1 {
+		hop.host = forwardedToken(headerTokens(header, HeaderXForwardedHost), index, len(hops))
+	}
+	return hop, true
+}
+
+// ClientIP returns the ip of the client, resolved by `Forwarded`, `X-Forwarded-For` or `X-Real-IP`
+// if the peer is a trusted proxy, otherwise the ip of the peer. it is empty if the proxies report the client as unknown.
+func (ctx *RequestCtx) ClientIP() string {
+	hop, _ := ctx.forwarded()
+	return hop.ip
+}
+
+// Scheme returns `https` or `http` that the client used, the forwarded one is used if the peer is a trusted proxy.
+func (ctx *RequestCtx) Scheme() string {
+	if hop, ok := ctx.forwarded(); ok {
+		switch strings.ToLower(hop.proto) {
+		case "https", "wss":
+			return "https"
+		case "http", "ws":
+			return "http"
+		}
+	}
+	if ctx.IsTLS() {
+		return "https"
+	}
+	return "http"
+}
+
+// Host returns the host that the client requested, the forwarded one is used if the peer is a trusted proxy.
+func (ctx *RequestCtx) Host() string {
+	if hop, ok := ctx.forwarded(); ok && isValidForwardedHost(hop.host) {
+		return hop.host
+	}
+	host, _ := ctx.Request.Header.Get(HeaderHost)
+	return string(host)
+}
@@ -0,0 +1,122 @@
+package sha
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func startTestForwardedServer(t *testing.T, trusted ...string) (*Server, string) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := NewMux(nil)
+	mux.HTTP(MethodGet, "/who", RequestHandlerFunc(func(ctx *RequestCtx) {
+		_, _ = ctx.WriteString(ctx.ClientIP() + " " + ctx.Scheme() + " " + ctx.Host())
+	}))
+	mux.FileSystem(nil, MethodGet, "/static/{filepath:*}", http.Dir(dir), true)
+
+	s := New(nil, &ServerOption{Addr: "127.0.0.1:0", TrustedProxies: trusted}, nil, nil)
+	s.Handler = mux
+	return s, serveTestServer(t, s)
+}
+
+func forwardedGet(t *testing.T, url string, header map[string]string) (string, *http.Response) {
+	req, _ := http.NewRequest(MethodGet, url, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	c := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	return string(body), res
+}
+
+func TestRequestCtx_Forwarded(t *testing.T) {
+	s, addr := startTestForwardedServer(t, "127.0.0.0/8", "10.0.0.0/8")
+	defer s.Shutdown(context.Background())
+
+	for _, c := range []struct {
+		header   map[string]string
+		expected string
+	}{
+		{nil, "127.0.0.1 http " + addr},
+		{map[string]string{HeaderXRealIP: "203.0.113.9"}, "203.0.113.9 http " + addr},
+		{
+			map[string]string{
+				HeaderXForwardedFor:   "198.51.100.1, 203.0.113.9, 10.0.0.2",
+				HeaderXForwardedProto: "https",
+				HeaderXForwardedHost:  "example.com",
+			},
+			"203.0.113.9 https example.com",
+		},
+		{map[string]string{HeaderXForwardedFor: "10.0.0.3, 10.0.0.2"}, "10.0.0.3 http " + addr},
+		{map[string]string{HeaderXForwardedFor: "203.0.113.9, unknown, 10.0.0.2"}, " http " + addr},
+		{map[string]string{HeaderXForwardedFor: "10.0.0.3, 203.0.113.9, unknown"}, " http " + addr},
+		{map[string]string{HeaderXRealIP: "198.51.100.1, 203.0.113.9"}, "203.0.113.9 http " + addr},
+		// the leftmost items are sent by the client
+		{
+			map[string]string{
+				HeaderXForwardedFor:   "203.0.113.9",
+				HeaderXForwardedProto: "https, http",
+				HeaderXForwardedHost:  "evil.com, example.com",
+			},
+			"203.0.113.9 http example.com",
+		},
+		{
+			map[string]string{
+				HeaderXForwardedFor:   "203.0.113.9, 10.0.0.2",
+				HeaderXForwardedProto: "https, http",
+			},
+			"203.0.113.9 https " + addr,
+		},
+		{
+			map[string]string{
+				HeaderForwarded:     `for=198.51.100.1;proto=http, for="[2001:db8::17]:4711";proto=https;host=example.com, for=10.0.0.2`,
+				HeaderXForwardedFor: "192.0.2.1",
+			},
+			"2001:db8::17 https example.com",
+		},
+		{map[string]string{HeaderXForwardedHost: "evil.com/path"}, "127.0.0.1 http " + addr},
+	} {
+		if body, _ := forwardedGet(t, "http://"+addr+"/who", c.header); body != c.expected {
+			t.Fatalf("%v: expected %q, got %q", c.header, c.expected, body)
+		}
+	}
+
+	_, res := forwardedGet(
+		t, "http://"+addr+"/static/docs?v=1",
+		map[string]string{HeaderXForwardedProto: "https", HeaderXForwardedHost: "example.com"},
+	)
+	if location := res.Header.Get(HeaderLocation); res.StatusCode != StatusMovedPermanently || location != "docs/?v=1" {
+		t.Fatalf("unexpected redirect: %d %q", res.StatusCode, location)
+	}
+}
+
+func TestRequestCtx_ForwardedUntrusted(t *testing.T) {
+	s, addr := startTestForwardedServer(t)
+	defer s.Shutdown(context.Background())
+
+	header := map[string]string{
+		HeaderXForwardedFor:   "203.0.113.9",
+		HeaderXForwardedProto: "https",
+		HeaderXForwardedHost:  "example.com",
+		HeaderXRealIP:         "203.0.113.9",
+	}
+	if body, _ := forwardedGet(t, "http://"+addr+"/who", header); body != "127.0.0.1 http "+addr {
+		t.Fatalf("unexpected body: %q", body)
+	}
+	_, res := forwardedGet(t, "http://"+addr+"/static/docs", header)
+	if location := res.Header.Get(HeaderLocation); location != "docs/" {
+		t.Fatalf("unexpected redirect: %q", location)
+	}
+}
@@ -1,7 +1,10 @@
 package sha
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"github.com/zzztttkkk/sha/utils"
@@ -10,6 +13,7 @@ import (
 	"mime"
 	"net"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 )
@@ -28,6 +32,10 @@ type RequestCtx struct {
 	isTLS    bool
 	conn     net.Conn
 	hijacked bool
+	streamer _ResponseStreamer
+	watcher  *_ConnWatcher
+	// the compression option of the protocol, see `AutoCompress`
+	compression *_Compression
 
 	// parser
 	status           int
@@ -38,8 +46,18 @@ type RequestCtx struct {
 	currentHeaderKey []byte // current header key
 	cHKeyDoUpper     bool   // prev byte is '-' or first byte
 	headerKVSepRead  bool   // `:`
+	crRead           bool   // prev byte is '\r', strict mode only
 	bodyRemain       int
 	bodySize         int
+	chunkStatus      int
+	chunkRemain      int
+	chunkSizeLength  int
+	chunkLine        []byte // current trailer line
+	// the body is read by the handler from bodyStream, which is nil if the body is empty, see `_RequestBodyStreamer`
+	bodyStreamed bool
+	bodyStream   io.Reader
+	// the `HTTPOption.MaxRequestBodySize` of the protocol, the streamed body is limited by the handler
+	maxBodySize int
 
 	// hook
 	onReset []func(ctx *RequestCtx)
@@ -93,16 +111,65 @@ func (ctx *RequestCtx) Close() { ctx.Response.Header.Set(HeaderConnection, []byt
 
 func (ctx *RequestCtx) IsTLS() bool { return ctx.isTLS }
 
+// TLSConnectionState returns nil if the connection is not a tls one.
+func (ctx *RequestCtx) TLSConnectionState() *tls.ConnectionState {
+	switch c := ctx.conn.(type) {
+	case *tls.Conn:
+		state := c.ConnectionState()
+		return &state
+	case *_HTTPConn:
+		return c.tls
+	}
+	return nil
+}
+
+// PeerCertificates returns the verified certificate chain of the client, the first one is the leaf.
+// It is nil if the client sent no certificate or the certificate is not verified, see `ServerOption.Tls.ClientAuth`.
+func (ctx *RequestCtx) PeerCertificates() []*x509.Certificate {
+	state := ctx.TLSConnectionState()
+	if state == nil || len(state.VerifiedChains) < 1 {
+		return nil
+	}
+	return state.VerifiedChains[0]
+}
+
+// PeerCertificates returns the verified certificate chain of the request, it can be used by `auth.CertificateManager`.
+func PeerCertificates(ctx context.Context) []*x509.Certificate {
+	rctx := Unwrap(ctx)
+	if rctx == nil {
+		return nil
+	}
+	return rctx.PeerCertificates()
+}
+
 func (ctx *RequestCtx) RemoteAddr() net.Addr { return ctx.conn.RemoteAddr() }
 
 var ErrRequestHijacked = errors.New("sha: request is already hijacked")
 
+var ErrHijackUnsupported = errors.New("sha: the connection of a http2 stream can not be hijacked")
+
 func (ctx *RequestCtx) Hijack() net.Conn {
 	if ctx.hijacked {
 		panic(ErrRequestHijacked)
 	}
+	if _, ok := ctx.streamer.(*_Http2Stream); ok {
+		panic(ErrHijackUnsupported)
+	}
+	return ctx.hijackConn()
+}
+
+func (ctx *RequestCtx) hijackConn() net.Conn {
 	ctx.hijacked = true
-	return ctx.conn
+	if serv, ok := ctx.Value(CtxKeyServer).(*Server); ok {
+		serv.setConnState(ctx.conn, ConnStateHijacked)
+	}
+	conn := ctx.conn
+	if ctx.watcher != nil {
+		conn = ctx.watcher.hijack(conn)
+	}
+	// the deadlines of the server, e.g. the idle timeout, do not apply to the hijacked connection
+	_ = conn.SetDeadline(zeroTime)
+	return conn
 }
 
 const lowerUpgradeHeader = "upgrade"
@@ -131,7 +198,11 @@ func (ctx *RequestCtx) Reset() {
 	if ctx.ctx == nil {
 		return
 	}
+	ctx.reset()
+}
 
+// reset clears the state even if the request is not handled, e.g. the connection is closed while parsing.
+func (ctx *RequestCtx) reset() {
 	if len(ctx.onReset) > 0 {
 		for _, fn := range ctx.onReset {
 			fn(ctx)
@@ -152,8 +223,16 @@ func (ctx *RequestCtx) Reset() {
 	ctx.currentHeaderKey = ctx.currentHeaderKey[:0]
 	ctx.cHKeyDoUpper = false
 	ctx.headerKVSepRead = false
+	ctx.crRead = false
 	ctx.bodySize = -1
 	ctx.bodyRemain = -1
+	ctx.chunkStatus = 0
+	ctx.chunkRemain = 0
+	ctx.chunkSizeLength = 0
+	ctx.chunkLine = ctx.chunkLine[:0]
+	ctx.bodyStreamed = false
+	ctx.bodyStream = nil
+	ctx.maxBodySize = 0
 }
 
 var ctxPool = sync.Pool{New: func() interface{} { return &RequestCtx{} }}
@@ -161,10 +240,14 @@ var ctxPool = sync.Pool{New: func() interface{} { return &RequestCtx{} }}
 func acquireRequestCtx() *RequestCtx { return ctxPool.Get().(*RequestCtx) }
 
 func ReleaseRequestCtx(ctx *RequestCtx) {
-	ctx.Reset()
+	ctx.reset()
 	ctx.Response.freeWriter()
 	ctx.conn = nil
 	ctx.isTLS = false
+	ctx.hijacked = false
+	ctx.streamer = nil
+	ctx.watcher = nil
+	ctx.compression = nil
 	ctxPool.Put(ctx)
 }
 
@@ -186,6 +269,46 @@ func (ctx *RequestCtx) WriteString(s string) (int, error) {
 	return ctx.Write(utils.B(s))
 }
 
+// _ResponseStreamer sends the response before the handler returns, implemented by the http protocols.
+type _ResponseStreamer interface {
+	flushResponse(ctx *RequestCtx) error
+	streamBufferSize() int
+}
+
+// Flush sends the response header(if not sent yet) and the buffered body data to the client.
+// After the first call, the response is sent in chunked encoding and the status code and header can not be changed.
+func (ctx *RequestCtx) Flush() error {
+	if ctx.streamer == nil {
+		return ErrStreamingUnsupported
+	}
+	return ctx.streamer.flushResponse(ctx)
+}
+
+type _StreamWriter struct {
+	ctx *RequestCtx
+}
+
+func (w _StreamWriter) Write(p []byte) (int, error) {
+	n, err := w.ctx.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, w.ctx.Flush()
+}
+
+// Stream commits the response header and calls fn with a buffered writer,
+// the data is sent to the client every time the writer is flushed or full.
+func (ctx *RequestCtx) Stream(fn func(w *bufio.Writer) error) error {
+	if err := ctx.Flush(); err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(_StreamWriter{ctx: ctx}, ctx.streamer.streamBufferSize())
+	if err := fn(w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
 func (ctx *RequestCtx) WriteJSON(v interface{}) {
 	ctx.Response.Header.SetContentType(MIMEJson)
 
@@ -204,19 +327,29 @@ func (ctx *RequestCtx) WriteHTML(v []byte) {
 	}
 }
 
+// WriteFile copies the rest of f into the response body, f is owned by the caller.
+// Use SendFile to send a large file without copying it into memory.
 func (ctx *RequestCtx) WriteFile(f io.Reader, ext string) {
 	ctx.Response.Header.SetContentType(mime.TypeByExtension(ext))
+	if _, e := io.Copy(ctx, f); e != nil {
+		panic(e)
+	}
+}
 
-	buf := make([]byte, 512, 512)
-	for {
-		l, e := f.Read(buf)
-		if e != nil {
-			panic(e)
-		}
-		_, e = ctx.Write(buf[:l])
-		if e != nil {
-			panic(e)
-		}
+// SendFile sends the rest of f as the response body and takes the ownership of f, do not close it in the handler.
+// If f is a regular file, it is sent after the handler returns without being copied into memory,
+// and it is closed after the response is sent.
+func (ctx *RequestCtx) SendFile(f *os.File, ext string) {
+	ctx.Response.Header.SetContentType(mime.TypeByExtension(ext))
+
+	if size, ok := fileSize(f); ok {
+		ctx.Response.setBodyFile(f, size)
+		ctx.Response.bodyFileCloser = f
+		return
+	}
+	defer f.Close()
+	if _, e := io.Copy(ctx, f); e != nil {
+		panic(e)
 	}
 }
 
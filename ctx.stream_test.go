@@ -0,0 +1,75 @@
+package sha
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRequestCtx_Stream(t *testing.T) {
+	s, addr := startTestServer(t, RequestHandlerFunc(func(ctx *RequestCtx) {
+		if _, ok := ctx.Request.Header.Get(HeaderAcceptEncoding); ok {
+			ctx.CompressGzip()
+		}
+		err := ctx.Stream(func(w *bufio.Writer) error {
+			for i := 0; i < 3; i++ {
+				_, _ = w.WriteString(strings.Repeat("a", 5000))
+				if err := w.Flush(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	for _, compress := range []bool{false, true, false} {
+		req := "GET / HTTP/1.1\r\nHost: a\r\n\r\n"
+		if compress {
+			req = "GET / HTTP/1.1\r\nHost: a\r\nAccept-Encoding: gzip\r\n\r\n"
+		}
+		_, _ = conn.Write([]byte(req))
+
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.TransferEncoding) != 1 || res.TransferEncoding[0] != "chunked" {
+			t.Fatalf("bad transfer encoding: %v", res.TransferEncoding)
+		}
+		var body io.Reader = res.Body
+		if compress {
+			if res.Header.Get(HeaderContentEncoding) != "gzip" {
+				t.Fatal("response is not compressed")
+			}
+			if body, err = gzip.NewReader(res.Body); err != nil {
+				t.Fatal(err)
+			}
+		} else if res.Header.Get(HeaderContentEncoding) != "" {
+			t.Fatal("response should not be compressed")
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != strings.Repeat("a", 15000) {
+			t.Fatalf("bad body size %d", len(data))
+		}
+		_ = res.Body.Close()
+	}
+}
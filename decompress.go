@@ -0,0 +1,101 @@
+package sha
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+	"github.com/klauspost/compress/zstd"
+	"github.com/zzztttkkk/sha/utils"
+	"io"
+	"strings"
+)
+
+var (
+	ErrUnsupportedContentEncoding = StatusError(StatusUnsupportedMediaType)
+	ErrBadRequestBody             = StatusError(StatusBadRequest)
+)
+
+// newBodyDecoder returns the reader of the decoded data.
+func newBodyDecoder(coding string, r io.Reader, maxSize int) (io.Reader, error) {
+	switch coding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		// RFC 7230 says zlib, but some clients send the raw deflate data
+		br := bufio.NewReader(r)
+		if p, _ := br.Peek(2); !isZlibHeader(p) {
+			return flate.NewReader(br), nil
+		}
+		return zlib.NewReader(br)
+	case "br":
+		return brotli.NewReader(r), nil
+	case "zstd":
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(maxSize)+1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return nil, ErrUnsupportedContentEncoding
+	}
+}
+
+var decompressBufferPool = utils.NewBufferPoll(4096)
+
+// decompressBody decodes the request body by the `Content-Encoding`, the decoded body is limited to maxSize bytes.
+// the `Content-Encoding` is removed and the `Content-Length` is updated, so the body is used as an uncompressed one.
+func (ctx *RequestCtx) decompressBody(maxSize int) HttpError {
+	req := &ctx.Request
+	values := req.Header.GetAll(HeaderContentEncoding)
+	if len(values) < 1 {
+		return nil
+	}
+	var codings []string
+	for _, value := range values {
+		for _, v := range strings.Split(utils.S(value), ",") {
+			v = strings.ToLower(strings.TrimSpace(v))
+			if len(v) > 0 && v != "identity" {
+				codings = append(codings, v)
+			}
+		}
+	}
+
+	if len(codings) > 0 && len(ctx.buf) > 0 {
+		// the codings are listed in the order in which they were applied
+		var r io.Reader = bytes.NewReader(ctx.buf)
+		for i := len(codings) - 1; i > -1; i-- {
+			decoder, err := newBodyDecoder(codings[i], r, maxSize)
+			if err == ErrUnsupportedContentEncoding {
+				return ErrUnsupportedContentEncoding
+			}
+			if err != nil {
+				return ErrBadRequestBody
+			}
+			if closer, ok := decoder.(io.Closer); ok {
+				defer closer.Close()
+			}
+			r = decoder
+		}
+
+		buf := decompressBufferPool.Get()
+		defer decompressBufferPool.Put(buf)
+		n, err := io.Copy(buf, io.LimitReader(r, int64(maxSize)+1))
+		if err != nil {
+			return ErrBadRequestBody
+		}
+		if n > int64(maxSize) {
+			return ErrRequestEntityTooLarge
+		}
+		ctx.buf = append(ctx.buf[:0], buf.Data...)
+	}
+
+	ctx.bodySize = len(ctx.buf)
+	req.Header.Del(HeaderContentEncoding)
+	if _, ok := req.Header.Get(HeaderContentLength); ok {
+		req.Header.SetContentLength(int64(len(ctx.buf)))
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package sha
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+func decompressTestPost(conn net.Conn, r *bufio.Reader, encoding string, body []byte) (int, string, error) {
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 2))
+	head := "POST / HTTP/1.1\r\nHost: a\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Encoding: " + encoding +
+		"\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n"
+	if _, err := conn.Write(append([]byte(head), body...)); err != nil {
+		return 0, "", err
+	}
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	data, err := io.ReadAll(res.Body)
+	return res.StatusCode, string(data), err
+}
+
+func TestHttp11_DecompressRequestBody(t *testing.T) {
+	opt := ServerOption{Addr: "127.0.0.1:0"}
+	s := New(nil, &opt, NewHTTP11Protocol(&HTTPOption{DecompressRequestBody: true, MaxDecompressedBodySize: 1024}), nil)
+	s.Handler = RequestHandlerFunc(func(ctx *RequestCtx) {
+		v, _ := ctx.Request.BodyFormValue("a")
+		_, ok := ctx.Request.Header.Get(HeaderContentEncoding)
+		_, _ = ctx.WriteString(string(v) + " " + strconv.FormatBool(ok) + " " + strconv.Itoa(ctx.Request.Header.ContentLength()))
+	})
+	addr := serveTestServer(t, s)
+	defer s.Shutdown(context.Background())
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, _ = gw.Write([]byte("a=telemetry"))
+	_ = gw.Close()
+
+	var df bytes.Buffer
+	fw, _ := flate.NewWriter(&df, flate.DefaultCompression)
+	_, _ = fw.Write([]byte("a=raw-deflate"))
+	_ = fw.Close()
+
+	zw, _ := zstd.NewWriter(nil)
+	zs := zw.EncodeAll([]byte("a=zstd"), nil)
+
+	// gzip applied after deflate
+	var both bytes.Buffer
+	bw := gzip.NewWriter(&both)
+	_, _ = bw.Write(df.Bytes())
+	_ = bw.Close()
+
+	var bomb bytes.Buffer
+	gw = gzip.NewWriter(&bomb)
+	_, _ = gw.Write([]byte("a=" + strings.Repeat("b", 2048)))
+	_ = gw.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for _, c := range []struct {
+		encoding, body string
+	}{
+		{"gzip", "telemetry false 11"},
+		{"deflate", "raw-deflate false 13"},
+		{"zstd", "zstd false 6"},
+		{"deflate, gzip", "raw-deflate false 13"},
+		{"identity", "plain false 7"},
+	} {
+		var body []byte
+		switch c.encoding {
+		case "gzip":
+			body = gz.Bytes()
+		case "deflate":
+			body = df.Bytes()
+		case "zstd":
+			body = zs
+		case "deflate, gzip":
+			body = both.Bytes()
+		default:
+			body = []byte("a=plain")
+		}
+		status, data, err := decompressTestPost(conn, r, c.encoding, body)
+		if err != nil || status != StatusOK || data != c.body {
+			t.Fatalf("%s: %d %q %v", c.encoding, status, data, err)
+		}
+	}
+
+	for _, c := range []struct {
+		encoding string
+		body     []byte
+		status   int
+	}{
+		{"gzip", bomb.Bytes(), StatusRequestEntityTooLarge},
+		{"compress", []byte("a=b"), StatusUnsupportedMediaType},
+		{"gzip", []byte("a=b"), StatusBadRequest},
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, _, err := decompressTestPost(conn, bufio.NewReader(conn), c.encoding, c.body)
+		_ = conn.Close()
+		if err != nil || status != c.status {
+			t.Fatalf("%s: expected %d, got %d %v", c.encoding, c.status, status, err)
+		}
+	}
+}
@@ -40,6 +40,23 @@ func (form *Form) FromUrlEncoded(p []byte) {
 	form.onItem(key, val)
 }
 
+// EncodeToBuf appends the url-encoded form to buf, e.g. `a=1&b=2`.
+func (form *Form) EncodeToBuf(buf *[]byte) {
+	first := true
+	form.EachItem(
+		func(item *utils.KvItem) bool {
+			if !first {
+				*buf = append(*buf, '&')
+			}
+			first = false
+			utils.EncodeURIComponent(item.Key, buf)
+			*buf = append(*buf, '=')
+			utils.EncodeURIComponent(item.Val, buf)
+			return true
+		},
+	)
+}
+
 type FormFile struct {
 	Name     string
 	FileName string
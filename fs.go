@@ -186,6 +186,10 @@ func serveFileContent(ctx *RequestCtx, name string, modtime time.Time, size int6
 		w.Header.Set(HeaderAcceptRanges, []byte("bytes"))
 	}
 
+	if sendContent == content { // sent without copying
+		w.setBodyFile(content, sendSize)
+		return
+	}
 	if string(r.Method) != "HEAD" {
 		_, _ = io.CopyN(ctx, sendContent, sendSize)
 	}
@@ -455,7 +459,7 @@ func checkPreconditions(w *Response, r *Request, modtime time.Time) (done bool,
 var indexPage = []byte("/index.html")
 
 // name is '/'-separated, not filepath.Separator.
-func serveFileSystem(ctx *RequestCtx, fs http.FileSystem, name string, index bool) {
+func serveFileSystem(ctx *RequestCtx, fs http.FileSystem, name string, opt *FileSystemOption) {
 	w := &ctx.Response
 	r := &ctx.Request
 
@@ -469,7 +473,7 @@ func serveFileSystem(ctx *RequestCtx, fs http.FileSystem, name string, index boo
 		w.statusCode = toHTTPError(err)
 		return
 	}
-	defer f.Close()
+	defer w.closeFile(f)
 
 	d, err := f.Stat()
 	if err != nil {
@@ -489,7 +493,7 @@ func serveFileSystem(ctx *RequestCtx, fs http.FileSystem, name string, index boo
 		index := strings.TrimSuffix(name, "/") + utils.S(indexPage)
 		ff, err := fs.Open(index)
 		if err == nil {
-			defer ff.Close()
+			defer w.closeFile(ff)
 			dd, err := ff.Stat()
 			if err == nil {
 				name = index
@@ -501,7 +505,7 @@ func serveFileSystem(ctx *RequestCtx, fs http.FileSystem, name string, index boo
 
 	// Still a directory? (we didn't find an index.html file)
 	if d.IsDir() {
-		if index {
+		if opt.AutoIndex {
 			if checkIfModifiedSince(r, d.ModTime()) == condFalse {
 				writeNotModified(w)
 				return
@@ -514,6 +518,15 @@ func serveFileSystem(ctx *RequestCtx, fs http.FileSystem, name string, index boo
 		return
 	}
 
+	if opt.Manifest != nil && opt.Manifest.Immutable(name) {
+		w.Header.Set(HeaderCacheControl, immutableCacheControl)
+	}
+	if opt.Precompressed {
+		if servePrecompressed(ctx, fs, name, d) {
+			return
+		}
+		ctx.AutoCompress()
+	}
 	serveFileContent(ctx, d.Name(), d.ModTime(), d.Size(), f)
 }
 
@@ -536,8 +549,8 @@ func toHTTPError(err error) (httpStatus int) {
 // localRedirect gives a Moved Permanently response.
 // It does not convert relative paths to absolute paths like Redirect does.
 func localRedirect(w *Response, r *Request, newPath string) {
-	if q := utils.S(r.RawPath); len(q) > 0 {
-		newPath += "?" + q
+	if ind := bytes.IndexByte(r.RawPath, '?'); ind > -1 {
+		newPath += utils.S(r.RawPath[ind:])
 	}
 	w.Header.Set(HeaderLocation, utils.B(newPath))
 	w.statusCode = StatusMovedPermanently
@@ -19,6 +19,21 @@ func inPlaceLowercase(d []byte) []byte {
 	return d
 }
 
+// canonicalHeaderKey converts the lowercase http2 header name to the same form as the http/1.1 parser.
+func canonicalHeaderKey(name string) []byte {
+	key := make([]byte, len(name))
+	upper := true
+	for i := 0; i < len(name); i++ {
+		v := name[i]
+		if upper {
+			v = toUpperTable[v]
+		}
+		key[i] = v
+		upper = v == '-'
+	}
+	return key
+}
+
 func (header *Header) ContentLength() int {
 	v, ok := header.Kvs.Get(HeaderContentLength)
 	if !ok {
@@ -47,10 +47,10 @@ const (
 	HeaderAcceptLanguage = "Accept-Language"
 
 	// Controls
-	HeaderCookie      = "CookieValue"
+	HeaderCookie      = "Cookie"
 	HeaderExpect      = "Expect"
 	HeaderMaxForwards = "Max-Forwards"
-	HeaderSetCookie   = "Set-CookieValue"
+	HeaderSetCookie   = "Set-Cookie"
 
 	// CORS
 	HeaderAccessControlAllowCredentials = "Access-Control-Allow-Credentials"
@@ -85,6 +85,7 @@ const (
 	HeaderXForwardedFor   = "X-Forwarded-For"
 	HeaderXForwardedHost  = "X-Forwarded-Host"
 	HeaderXForwardedProto = "X-Forwarded-Proto"
+	HeaderXRealIP         = "X-Real-IP"
 
 	// Redirects
 	HeaderLocation = "Location"
@@ -134,6 +135,9 @@ const (
 	HeaderTrailer          = "Trailer"
 	HeaderTransferEncoding = "Transfer-Encoding"
 
+	// HTTP/2
+	HeaderHTTP2Settings = "Http2-Settings"
+
 	// WebSockets
 	HeaderSecWebSocketAccept     = "Sec-WebSocket-Accept"
 	HeaderSecWebSocketExtensions = "Sec-WebSocket-Extensions"
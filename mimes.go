@@ -1,12 +1,13 @@
 package sha
 
 const (
-	MIMEJson      = "application/json"
-	MIMEForm      = "application/x-www-form-urlencoded"
-	MIMEMultiPart = "multipart/form-data"
-	MIMEText      = "text/plain"
-	MIMEMarkdown  = "text/markdown"
-	MIMEHtml      = "text/html"
-	MIMEPng       = "image/png"
-	MIMEJpeg      = "image/jpeg"
+	MIMEJson        = "application/json"
+	MIMEForm        = "application/x-www-form-urlencoded"
+	MIMEMultiPart   = "multipart/form-data"
+	MIMEText        = "text/plain"
+	MIMEMarkdown    = "text/markdown"
+	MIMEHtml        = "text/html"
+	MIMEPng         = "image/png"
+	MIMEJpeg        = "image/jpeg"
+	MIMEEventStream = "text/event-stream"
 )
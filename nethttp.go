@@ -0,0 +1,509 @@
+package sha
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"github.com/imdario/mergo"
+	"github.com/zzztttkkk/sha/utils"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// the adapters between `net/http` and sha.
+
+var ErrNetHTTPHijackUnsupported = errors.New("sha: the http.ResponseWriter does not implement http.Hijacker")
+
+// _HTTPResponseWriter is a `http.ResponseWriter` that writes to a RequestCtx.
+type _HTTPResponseWriter struct {
+	ctx         *RequestCtx
+	header      http.Header
+	wroteHeader bool
+}
+
+func newHTTPResponseWriter(ctx *RequestCtx) *_HTTPResponseWriter {
+	return &_HTTPResponseWriter{ctx: ctx, header: http.Header{}}
+}
+
+func (w *_HTTPResponseWriter) Header() http.Header { return w.header }
+
+func (w *_HTTPResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.copyHeader()
+	w.ctx.Response.statusCode = statusCode
+}
+
+func (w *_HTTPResponseWriter) copyHeader() {
+	dst := &w.ctx.Response.Header
+	for k, vs := range w.header {
+		dst.Del(k)
+		for _, v := range vs {
+			dst.Append(k, utils.B(v))
+		}
+	}
+}
+
+func (w *_HTTPResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		// the same as net/http
+		if _, ok := w.header[HeaderContentType]; !ok && len(p) > 0 {
+			if _, ok = w.ctx.Response.Header.Get(HeaderContentType); !ok {
+				w.header.Set(HeaderContentType, http.DetectContentType(p))
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ctx.Write(p)
+}
+
+func (w *_HTTPResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	_ = w.ctx.Flush()
+}
+
+func (w *_HTTPResponseWriter) Hijack() (conn net.Conn, rw *bufio.ReadWriter, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			if e, ok := v.(error); ok {
+				err = e
+				return
+			}
+			panic(v)
+		}
+	}()
+	conn = w.ctx.Hijack()
+	return conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
+}
+
+// finish copies the header if the handler does not write anything.
+func (w *_HTTPResponseWriter) finish() {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.copyHeader()
+	}
+}
+
+// toHTTPRequest converts the request of ctx, the body is not copied.
+func toHTTPRequest(ctx *RequestCtx) (*http.Request, error) {
+	req := &ctx.Request
+	r := &http.Request{
+		Method:     string(req.Method),
+		RequestURI: string(req.RawPath),
+		Header:     http.Header{},
+		RemoteAddr: ctx.RemoteAddr().String(),
+	}
+
+	var err error
+	if req._method == _MConnect {
+		r.URL = &url.URL{Host: r.RequestURI}
+	} else if r.URL, err = url.ParseRequestURI(r.RequestURI); err != nil {
+		return nil, err
+	}
+
+	r.Proto = string(req.version)
+	var ok bool
+	if r.ProtoMajor, r.ProtoMinor, ok = http.ParseHTTPVersion(r.Proto); !ok {
+		r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/1.1", 1, 1
+	}
+
+	req.Header.EachItem(func(item *utils.KvItem) bool {
+		if headerKeyIs(utils.S(item.Key), HeaderHost) {
+			r.Host = string(item.Val)
+		} else {
+			r.Header.Add(string(item.Key), string(item.Val))
+		}
+		return true
+	})
+
+	body := req.BodyRaw()
+	r.ContentLength = int64(len(body))
+	if len(body) > 0 {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	} else {
+		r.Body = http.NoBody
+	}
+
+	r.TLS = ctx.TLSConnectionState()
+	return r.WithContext(ctx), nil
+}
+
+// syncHTTPRequest copies the header and context changed by a net/http middleware back to ctx.
+func syncHTTPRequest(ctx *RequestCtx, r *http.Request) {
+	req := &ctx.Request
+	// keep the key forms of sha, e.g. `X-Request-ID` instead of `X-Request-Id`
+	keys := map[string]string{}
+	req.Header.EachItem(func(item *utils.KvItem) bool {
+		keys[http.CanonicalHeaderKey(string(item.Key))] = string(item.Key)
+		return true
+	})
+	host, hasHost := req.Header.Get(HeaderHost)
+	host = append([]byte(nil), host...)
+
+	req.Header.Reset()
+	if hasHost {
+		req.Header.Append(HeaderHost, host)
+	}
+	for k, vs := range r.Header {
+		if key, ok := keys[k]; ok {
+			k = key
+		}
+		for _, v := range vs {
+			req.Header.Append(k, utils.B(v))
+		}
+	}
+	req.cookies.Reset()
+	req.cookieParsed = false
+
+	if r.Context() != ctx {
+		ctx.ctx = r.Context()
+	}
+}
+
+type _FromHTTPHandler struct {
+	handler http.Handler
+}
+
+func (h _FromHTTPHandler) Handle(ctx *RequestCtx) {
+	r, err := toHTTPRequest(ctx)
+	if err != nil {
+		ctx.SetStatus(StatusBadRequest)
+		return
+	}
+	w := newHTTPResponseWriter(ctx)
+	h.handler.ServeHTTP(w, r)
+	w.finish()
+}
+
+// FromHTTPHandler converts a net/http handler, e.g. `pprof.Index`, to a RequestHandler.
+func FromHTTPHandler(handler http.Handler) RequestHandler { return _FromHTTPHandler{handler: handler} }
+
+// FromHTTPMiddleware converts a net/http middleware to a Middleware.
+// The sha handlers behind it see the request header and context changed by the middleware,
+// and their response is written through the http.ResponseWriter passed by the middleware,
+// unless it is already sent, e.g. by `RequestCtx.Flush` or `RequestCtx.Hijack`.
+func FromHTTPMiddleware(middleware func(http.Handler) http.Handler) Middleware {
+	return MiddlewareFunc(func(ctx *RequestCtx, next func()) {
+		r, err := toHTTPRequest(ctx)
+		if err != nil {
+			ctx.SetStatus(StatusBadRequest)
+			return
+		}
+		w := newHTTPResponseWriter(ctx)
+
+		middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			syncHTTPRequest(ctx, r)
+			next()
+			replayResponse(ctx, w)
+		})).ServeHTTP(w, r)
+		w.finish()
+	})
+}
+
+// replayResponse moves the response of ctx to w, so the net/http middlewares that wrap w can observe it.
+func replayResponse(ctx *RequestCtx, w http.ResponseWriter) {
+	res := &ctx.Response
+	if ctx.hijacked || res.headerSent || res.compressWriter != nil || res.bodyFile != nil {
+		return
+	}
+
+	header := w.Header()
+	res.Header.EachItem(func(item *utils.KvItem) bool {
+		header.Add(string(item.Key), string(item.Val))
+		return true
+	})
+	res.Header.Reset()
+	status := res.statusCode
+	if status < 1 {
+		status = http.StatusOK
+	}
+	res.statusCode = 0
+	body := append([]byte(nil), res.bodyBuf.Data...)
+	res.bodyBuf.Data = res.bodyBuf.Data[:0]
+
+	w.WriteHeader(status)
+	if len(body) > 0 {
+		_, _ = w.Write(body)
+	}
+}
+
+// _HTTPConn is the connection of a RequestCtx that is served by net/http.
+// It is hijacked from the http.ResponseWriter at the first read or write.
+type _HTTPConn struct {
+	w      http.ResponseWriter
+	remote net.Addr
+	local  net.Addr
+	tls    *tls.ConnectionState // the state of the tls connection served by net/http
+
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	err  error
+}
+
+func (c *_HTTPConn) hijack() error {
+	if c.conn != nil || c.err != nil {
+		return c.err
+	}
+	hijacker, ok := c.w.(http.Hijacker)
+	if !ok {
+		c.err = ErrNetHTTPHijackUnsupported
+		return c.err
+	}
+	c.conn, c.rw, c.err = hijacker.Hijack()
+	return c.err
+}
+
+func (c *_HTTPConn) Read(p []byte) (int, error) {
+	if err := c.hijack(); err != nil {
+		return 0, err
+	}
+	return c.rw.Read(p)
+}
+
+func (c *_HTTPConn) Write(p []byte) (int, error) {
+	if err := c.hijack(); err != nil {
+		return 0, err
+	}
+	if c.rw.Writer.Buffered() > 0 {
+		if err := c.rw.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return c.conn.Write(p)
+}
+
+func (c *_HTTPConn) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+func (c *_HTTPConn) LocalAddr() net.Addr  { return c.local }
+func (c *_HTTPConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *_HTTPConn) SetDeadline(t time.Time) error {
+	if err := c.hijack(); err != nil {
+		return err
+	}
+	return c.conn.SetDeadline(t)
+}
+
+func (c *_HTTPConn) SetReadDeadline(t time.Time) error {
+	if err := c.hijack(); err != nil {
+		return err
+	}
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *_HTTPConn) SetWriteDeadline(t time.Time) error {
+	if err := c.hijack(); err != nil {
+		return err
+	}
+	return c.conn.SetWriteDeadline(t)
+}
+
+type _Addr struct{ network, addr string }
+
+func (a _Addr) Network() string { return a.network }
+func (a _Addr) String() string  { return a.addr }
+
+// _HTTPResponseStreamer sends the response of a RequestCtx to a http.ResponseWriter.
+type _HTTPResponseStreamer struct {
+	w http.ResponseWriter
+}
+
+func (s _HTTPResponseStreamer) writeHeader(ctx *RequestCtx) {
+	res := &ctx.Response
+	res.headerSent = true
+	header := s.w.Header()
+	res.Header.EachItem(func(item *utils.KvItem) bool {
+		key := utils.S(item.Key)
+		// the connection is managed by net/http
+		if !headerKeyIs(key, HeaderConnection) && !headerKeyIs(key, HeaderTransferEncoding) {
+			header.Add(key, string(item.Val))
+		}
+		return true
+	})
+	if res.statusCode < 1 {
+		res.statusCode = http.StatusOK
+	}
+	s.w.WriteHeader(res.statusCode)
+}
+
+func (s _HTTPResponseStreamer) writeBody(ctx *RequestCtx) error {
+	res := &ctx.Response
+	data := res.bodyBuf.Data
+	res.bodyBuf.Data = data[:0]
+	if len(data) < 1 || ctx.Request._method == _MHead {
+		return nil
+	}
+	_, err := s.w.Write(data)
+	return err
+}
+
+func (s _HTTPResponseStreamer) flushResponse(ctx *RequestCtx) error {
+	res := &ctx.Response
+	if !res.headerSent {
+		ctx.prepareCompression(true)
+		res.Header.Del(HeaderContentLength)
+		s.writeHeader(ctx)
+	}
+	if res.compressWriter != nil {
+		if err := res.compressWriter.Flush(); err != nil {
+			return err
+		}
+	}
+	if err := s.writeBody(ctx); err != nil {
+		return err
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func (s _HTTPResponseStreamer) streamBufferSize() int { return 4096 }
+
+func (s _HTTPResponseStreamer) finish(ctx *RequestCtx) error {
+	res := &ctx.Response
+	if !res.headerSent {
+		ctx.prepareCompression(false)
+	}
+	if res.bodyFile != nil {
+		if !res.headerSent && res.compressWriter == nil && len(res.bodyBuf.Data) == 0 {
+			size := res.bodyFileSize
+			res.Header.SetContentLength(size)
+			s.writeHeader(ctx)
+			if ctx.Request._method == _MHead || size < 1 {
+				return nil
+			}
+			// the ResponseWriter of net/http uses sendfile if it can
+			_, err := io.CopyN(s.w, res.bodyFile, size)
+			return err
+		}
+		if err := ctx.writeBodyFile(); err != nil {
+			return err
+		}
+	}
+
+	if res.compressWriter != nil {
+		if err := res.compressWriter.Close(); err != nil {
+			return err
+		}
+	}
+	if !res.headerSent {
+		res.Header.SetContentLength(int64(len(res.bodyBuf.Data)))
+		s.writeHeader(ctx)
+	}
+	return s.writeBody(ctx)
+}
+
+var netHTTPBodyBufferPool = utils.NewBufferPoll(4096)
+
+type _ToHTTPHandler struct {
+	handler            RequestHandler
+	maxRequestBodySize int
+}
+
+func (h _ToHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := acquireRequestCtx()
+	ctx.Response.bodyBuf = netHTTPBodyBufferPool.Get()
+	defer func() {
+		buf := ctx.Response.bodyBuf
+		ctx.Response.bodyBuf = nil
+		ReleaseRequestCtx(ctx)
+		netHTTPBodyBufferPool.Put(buf)
+	}()
+
+	if r.Body != nil {
+		if r.ContentLength > int64(h.maxRequestBodySize) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		body := bytes.NewBuffer(ctx.buf[:0])
+		if _, err := body.ReadFrom(http.MaxBytesReader(w, r.Body, int64(h.maxRequestBodySize))); err != nil {
+			if body.Len() >= h.maxRequestBodySize {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+			} else {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			return
+		}
+		ctx.buf = body.Bytes()
+	}
+
+	req := &ctx.Request
+	req.Method = append(req.Method, r.Method...)
+	if len(r.RequestURI) > 0 {
+		req.RawPath = append(req.RawPath, r.RequestURI...)
+	} else {
+		req.RawPath = append(req.RawPath, r.URL.RequestURI()...)
+	}
+	if len(r.Host) > 0 {
+		req.Header.Append(HeaderHost, utils.B(r.Host))
+	}
+	for k, vs := range r.Header {
+		for _, v := range vs {
+			req.Header.Append(k, utils.B(v))
+		}
+	}
+
+	ctx.ctx = r.Context()
+	conn := &_HTTPConn{w: w, remote: _Addr{network: "tcp", addr: r.RemoteAddr}, tls: r.TLS}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		conn.local = addr
+	}
+	ctx.conn = conn
+	ctx.connTime = time.Now()
+	ctx.isTLS = r.TLS != nil
+	streamer := _HTTPResponseStreamer{w: w}
+	ctx.streamer = streamer
+
+	ctx.bodySize = len(ctx.buf)
+	prepareRequest(ctx, strings.ToUpper(r.Proto))
+
+	h.handler.Handle(ctx)
+	if ctx.hijacked {
+		return
+	}
+	_ = streamer.finish(ctx)
+}
+
+// ToHTTPHandler converts a RequestHandler, e.g. a `*Mux`, to a net/http handler.
+// The request body is read before the handler is called, it is limited by the default `HTTPOption.MaxRequestBodySize`.
+func ToHTTPHandler(handler RequestHandler) http.Handler {
+	return ToHTTPHandlerWithOptions(handler, nil)
+}
+
+// ToHTTPHandlerWithOptions is the same as ToHTTPHandler, the request body larger than
+// `HTTPOption.MaxRequestBodySize` is responded by 413.
+func ToHTTPHandlerWithOptions(handler RequestHandler, option *HTTPOption) http.Handler {
+	var opt HTTPOption
+	if option != nil {
+		opt = *option
+	}
+	if err := mergo.Merge(&opt, &defaultHTTPOption); err != nil {
+		panic(err)
+	}
+	return _ToHTTPHandler{handler: handler, maxRequestBodySize: opt.MaxRequestBodySize}
+}
+
+// ToHTTPMiddleware converts a Middleware to a net/http middleware, the request body is limited as ToHTTPHandler.
+func ToHTTPMiddleware(middleware Middleware) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		handler := FromHTTPHandler(next)
+		return ToHTTPHandler(RequestHandlerFunc(func(ctx *RequestCtx) {
+			middleware.Process(ctx, func() { handler.Handle(ctx) })
+		}))
+	}
+}
@@ -0,0 +1,242 @@
+package sha
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFromHTTPHandler(t *testing.T) {
+	mux := NewMux(nil)
+	mux.HTTP(MethodPost, "/echo", FromHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		cookie, _ := r.Cookie("session")
+		w.Header().Set("X-Path", r.URL.Path+"?"+r.URL.RawQuery)
+		http.SetCookie(w, &http.Cookie{Name: "seen", Value: "1"})
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte(r.Host + " " + cookie.Value + " " + string(body)))
+	})))
+	mux.HTTP(MethodGet, "/sniff", FromHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("<html><body>x</body></html>"))
+	})))
+	s, addr := startTestServer(t, mux)
+	defer s.Shutdown(context.Background())
+
+	req, _ := http.NewRequest(MethodPost, "http://"+addr+"/echo?a=1", strings.NewReader("ping"))
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusAccepted || res.Header.Get("X-Path") != "/echo?a=1" || res.Header.Get(HeaderSetCookie) != "seen=1" {
+		t.Fatalf("unexpected response: %d %v", res.StatusCode, res.Header)
+	}
+	if string(body) != addr+" abc ping" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+
+	res, err = http.Get("http://" + addr + "/sniff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	if !strings.HasPrefix(res.Header.Get(HeaderContentType), "text/html") {
+		t.Fatalf("bad content type: %q", res.Header.Get(HeaderContentType))
+	}
+}
+
+func TestFromHTTPMiddleware(t *testing.T) {
+	var status int
+	recorder := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Set("X-Request-Id", "r1")
+			rec := httptest.NewRecorder()
+			next.ServeHTTP(rec, r)
+			status = rec.Code
+			for k, vs := range rec.Header() {
+				w.Header()[k] = vs
+			}
+			w.Header().Set("X-Wrapped", "1")
+			w.WriteHeader(rec.Code)
+			_, _ = w.Write(rec.Body.Bytes())
+		})
+	}
+
+	mux := NewMux(nil)
+	mux.HTTPWithOptions(
+		&HandlerOptions{Middlewares: []Middleware{FromHTTPMiddleware(recorder)}},
+		MethodGet, "/",
+		RequestHandlerFunc(func(ctx *RequestCtx) {
+			id, _ := ctx.Request.Header.Get("X-Request-Id")
+			ctx.SetStatus(StatusCreated)
+			_, _ = ctx.WriteString("id " + string(id))
+		}),
+	)
+	s, addr := startTestServer(t, mux)
+	defer s.Shutdown(context.Background())
+
+	res, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if status != StatusCreated || res.StatusCode != StatusCreated || res.Header.Get("X-Wrapped") != "1" || string(body) != "id r1" {
+		t.Fatalf("unexpected response: %d %d %v %q", status, res.StatusCode, res.Header, body)
+	}
+}
+
+func TestToHTTPHandler(t *testing.T) {
+	mux := NewMux(nil)
+	mux.HTTP(MethodPost, "/users/{id}", RequestHandlerFunc(func(ctx *RequestCtx) {
+		id, _ := ctx.URLParam("id")
+		q, _ := ctx.Request.QueryValue("q")
+		ctx.Response.SetCookie("seen", "1", nil)
+		_, _ = ctx.WriteString(string(id) + " " + string(q) + " " + string(ctx.Request.BodyRaw()))
+	}))
+	mux.HTTP(MethodGet, "/stream", RequestHandlerFunc(func(ctx *RequestCtx) {
+		_, _ = ctx.WriteString("hello ")
+		_ = ctx.Flush()
+		_, _ = ctx.WriteString("world")
+	}))
+
+	mux.HTTP(MethodGet, "/hijack", RequestHandlerFunc(func(ctx *RequestCtx) {
+		conn := ctx.Hijack()
+		_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked"))
+		_ = conn.Close()
+	}))
+
+	server := httptest.NewServer(ToHTTPHandler(mux))
+	defer server.Close()
+
+	res, err := http.Post(server.URL+"/users/7?q=x", MIMEText, strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "7 x body" || !strings.HasPrefix(res.Header.Get(HeaderSetCookie), "seen=1") {
+		t.Fatalf("unexpected response: %d %v %q", res.StatusCode, res.Header, body)
+	}
+
+	res, err = http.Get(server.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if string(body) != "hello world" || len(res.TransferEncoding) != 1 {
+		t.Fatalf("unexpected streamed response: %v %q", res.TransferEncoding, body)
+	}
+
+	res, err = http.Get(server.URL + "/hijack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if string(body) != "hijacked" {
+		t.Fatalf("unexpected hijacked response: %q", body)
+	}
+
+	res, err = http.Get(server.URL + "/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status: %d", res.StatusCode)
+	}
+}
+
+func TestToHTTPMiddleware(t *testing.T) {
+	middleware := ToHTTPMiddleware(MiddlewareFunc(func(ctx *RequestCtx, next func()) {
+		ctx.Request.Header.Set("X-User", []byte("u1"))
+		ctx.Response.Header.Set("X-Middleware", []byte("sha"))
+		next()
+	}))
+	server := httptest.NewServer(middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("X-User")))
+	})))
+	defer server.Close()
+
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if string(body) != "u1" || res.Header.Get("X-Middleware") != "sha" {
+		t.Fatalf("unexpected response: %v %q", res.Header, body)
+	}
+}
+
+func TestToHTTPHandler_MaxRequestBodySize(t *testing.T) {
+	server := httptest.NewServer(ToHTTPHandlerWithOptions(RequestHandlerFunc(func(ctx *RequestCtx) {
+		_, _ = ctx.Write(ctx.Request.BodyRaw())
+	}), &HTTPOption{MaxRequestBodySize: 8}))
+	defer server.Close()
+
+	for _, c := range []struct {
+		body   io.Reader
+		status int
+	}{
+		{strings.NewReader("12345678"), http.StatusOK},
+		{strings.NewReader("123456789"), http.StatusRequestEntityTooLarge},
+		// the chunked body without a content length
+		{io.MultiReader(strings.NewReader("12345"), strings.NewReader("6789")), http.StatusRequestEntityTooLarge},
+	} {
+		res, err := http.Post(server.URL, MIMEText, c.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+		if res.StatusCode != c.status {
+			t.Fatalf("expected %d, got %d", c.status, res.StatusCode)
+		}
+	}
+}
+
+func TestToHTTPHandler_TLS(t *testing.T) {
+	ca, _, _ := signTestCertificate(t, nil, func(tmpl *x509.Certificate) {
+		tmpl.IsCA = true
+		tmpl.ExtKeyUsage = nil
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	}, "ca")
+	client, _, _ := signTestCertificate(t, &ca, func(tmpl *x509.Certificate) {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}, "orders")
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	middleware := ToHTTPMiddleware(MiddlewareFunc(func(ctx *RequestCtx, next func()) {
+		ctx.Response.Header.Set("X-Peer", []byte(ctx.PeerCertificates()[0].Subject.CommonName))
+		next()
+	}))
+	server := httptest.NewUnstartedServer(middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName))
+	})))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	server.StartTLS()
+	defer server.Close()
+
+	httpClient := server.Client()
+	httpClient.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{client}
+	res, err := httpClient.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("X-Peer") != "orders" || string(body) != "orders" {
+		t.Fatalf("unexpected response: %d %v %q", res.StatusCode, res.Header, body)
+	}
+}
@@ -0,0 +1,70 @@
+package sha
+
+import (
+	"io"
+	"net"
+)
+
+// _Http11BodyReader reads the streamed request body from the connection, see `_RequestBodyStreamer`.
+// data[offset:n] is the buffered data of the connection, the rest of it belongs to the pipelined requests.
+// The body is decoded into `ctx.buf` by `feedHttp1xReqData`, so the chunked coding and the strict checks are the same.
+type _Http11BodyReader struct {
+	protocol *_Http11Protocol
+	ctx      *RequestCtx
+	conn     net.Conn
+	deadline *_ReadDeadline
+
+	data   []byte
+	offset int
+	n      int
+	read   int // the read size of ctx.buf
+	err    error
+}
+
+func (r *_Http11BodyReader) Read(p []byte) (int, error) {
+	ctx := r.ctx
+	for r.read == len(ctx.buf) {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if requestBodyDone(ctx) {
+			return 0, io.EOF
+		}
+
+		ctx.buf = ctx.buf[:0]
+		r.read = 0
+		if r.offset == r.n {
+			n, err := r.conn.Read(r.data)
+			if n < 1 {
+				if err == nil {
+					continue
+				}
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				r.err = err
+				return 0, err
+			}
+			r.offset, r.n = 0, n
+			r.deadline.feed(n)
+		}
+
+		offset, err := r.protocol.feedHttp1xReqData(ctx, r.data, r.offset, r.n)
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+		r.offset = offset
+	}
+
+	n := copy(p, ctx.buf[r.read:])
+	r.read += n
+	return n, nil
+}
+
+// drain skips the rest of the body that is not read by the handler, at most limit bytes.
+// it reports whether the body is read done, so the connection can serve the next request.
+func (r *_Http11BodyReader) drain(limit int64) bool {
+	_, _ = io.Copy(io.Discard, io.LimitReader(r, limit))
+	return r.err == nil && requestBodyDone(r.ctx) && r.read == len(r.ctx.buf)
+}
@@ -0,0 +1,213 @@
+package sha
+
+import (
+	"bytes"
+	"github.com/zzztttkkk/sha/utils"
+)
+
+var chunkedStr = []byte("chunked")
+
+// ErrUnsupportedTransferEncoding is the response of a transfer coding other than `chunked`, RFC 7230 3.3.1.
+var ErrUnsupportedTransferEncoding = StatusError(StatusNotImplemented)
+
+// isChunked reports whether the request body uses the chunked transfer coding.
+// `chunked` must be the only coding, the body length can not be determined if it is not the final one(RFC 7230 3.3.3),
+// and the other codings are not implemented.
+func isChunked(header *Header) (bool, HttpError) {
+	values := header.GetAll(HeaderTransferEncoding)
+	if len(values) < 1 {
+		return false, nil
+	}
+	var codings [][]byte
+	for _, value := range values {
+		for _, v := range bytes.Split(value, []byte(",")) {
+			if v = utils.InplaceTrimAsciiSpace(v); len(v) > 0 {
+				codings = append(codings, inPlaceLowercase(v))
+			}
+		}
+	}
+	if len(codings) < 1 || !bytes.Equal(codings[len(codings)-1], chunkedStr) {
+		return false, ErrBadConnection
+	}
+	if len(codings) > 1 {
+		return false, ErrUnsupportedTransferEncoding
+	}
+	return true, nil
+}
+
+const (
+	_ChunkSize = iota
+	_ChunkExtension
+	_ChunkData
+	_ChunkDataEnd
+	_ChunkTrailer
+)
+
+const (
+	maxChunkSizeHexLength = 16
+	maxChunkSize          = int(^uint(0) >> 1)
+)
+
+func unhex(c byte) int {
+	switch {
+	case '0' <= c && c <= '9':
+		return int(c - '0')
+	case 'a' <= c && c <= 'f':
+		return int(c - 'a' + 10)
+	case 'A' <= c && c <= 'F':
+		return int(c - 'A' + 10)
+	}
+	return -1
+}
+
+func (protocol *_Http11Protocol) onChunkSizeLineDone(ctx *RequestCtx) HttpError {
+	if ctx.chunkSizeLength < 1 {
+		return ErrBadConnection
+	}
+	ctx.chunkSizeLength = 0
+	if ctx.chunkRemain == 0 {
+		ctx.chunkStatus = _ChunkTrailer
+		return nil
+	}
+	ctx.chunkStatus = _ChunkData
+	return nil
+}
+
+func (protocol *_Http11Protocol) onTrailerLineDone(ctx *RequestCtx) HttpError {
+	line := ctx.chunkLine
+	ctx.chunkLine = ctx.chunkLine[:0]
+
+	if len(line) < 1 { // the last empty line, all the body data read done
+		ctx.status = 2
+		ctx.bodyRemain = 0
+		return nil
+	}
+
+	ind := bytes.IndexByte(line, ':')
+	if ind < 1 {
+		return ErrBadConnection
+	}
+	key := utils.InplaceTrimAsciiSpace(line[:ind])
+	if len(key) < 1 {
+		return ErrBadConnection
+	}
+	for _, v := range key {
+		if !isTokenChar[v] {
+			return ErrBadConnection
+		}
+	}
+	upper := true
+	for i, v := range key {
+		if upper {
+			key[i] = toUpperTable[v]
+		}
+		upper = v == '-'
+	}
+	ctx.Request.Trailers.AppendBytes(key, utils.InplaceTrimAsciiSpace(line[ind+1:]))
+	return nil
+}
+
+// feedHttp1xChunkedData decodes the chunked request body into `ctx.buf`.
+// When the last chunk and the trailers are read, `ctx.status` is set back to 2 with `ctx.bodyRemain` 0.
+func (protocol *_Http11Protocol) feedHttp1xChunkedData(ctx *RequestCtx, data []byte, offset, end int) (int, HttpError) {
+	var v byte
+
+	for offset < end {
+		if protocol.strict && ctx.chunkStatus != _ChunkData && !checkLineEnding(ctx, data[offset]) {
+			return -10, ErrBadConnection
+		}
+
+		switch ctx.chunkStatus {
+		case _ChunkSize:
+			v = data[offset]
+			offset++
+			switch v {
+			case '\r':
+				continue
+			case '\n':
+				if err := protocol.onChunkSizeLineDone(ctx); err != nil {
+					return -1, err
+				}
+				continue
+			case ';':
+				ctx.chunkStatus = _ChunkExtension
+				continue
+			case ' ', '\t':
+				if protocol.strict {
+					return -11, ErrBadConnection
+				}
+				continue
+			}
+
+			n := unhex(v)
+			if n < 0 {
+				return -2, ErrBadConnection
+			}
+			ctx.chunkSizeLength++
+			if ctx.chunkSizeLength > maxChunkSizeHexLength {
+				return -3, ErrRequestEntityTooLarge
+			}
+			if ctx.chunkRemain > maxChunkSize>>4 {
+				return -3, ErrRequestEntityTooLarge
+			}
+			ctx.chunkRemain = ctx.chunkRemain<<4 | n
+			// the streamed body is not buffered
+			if !ctx.bodyStreamed && len(ctx.buf)+ctx.chunkRemain > protocol.MaxRequestBodySize {
+				return -4, ErrRequestEntityTooLarge
+			}
+		case _ChunkExtension:
+			v = data[offset]
+			offset++
+			ctx.headersSize++
+			if ctx.headersSize > protocol.MaxRequestHeaderPartSize {
+				return -5, ErrRequestHeaderFieldsTooLarge
+			}
+			if v == '\n' {
+				if err := protocol.onChunkSizeLineDone(ctx); err != nil {
+					return -6, err
+				}
+			}
+		case _ChunkData:
+			size := end - offset
+			if size > ctx.chunkRemain {
+				size = ctx.chunkRemain
+			}
+			ctx.buf = append(ctx.buf, data[offset:offset+size]...)
+			offset += size
+			ctx.chunkRemain -= size
+			if ctx.chunkRemain == 0 {
+				ctx.chunkStatus = _ChunkDataEnd
+			}
+		case _ChunkDataEnd:
+			v = data[offset]
+			offset++
+			switch v {
+			case '\r':
+			case '\n':
+				ctx.chunkStatus = _ChunkSize
+			default:
+				return -7, ErrBadConnection
+			}
+		case _ChunkTrailer:
+			v = data[offset]
+			offset++
+			ctx.headersSize++
+			if ctx.headersSize > protocol.MaxRequestHeaderPartSize {
+				return -8, ErrRequestHeaderFieldsTooLarge
+			}
+			switch v {
+			case '\r':
+			case '\n':
+				if err := protocol.onTrailerLineDone(ctx); err != nil {
+					return -9, err
+				}
+				if ctx.status == 2 {
+					return offset, nil
+				}
+			default:
+				ctx.chunkLine = append(ctx.chunkLine, v)
+			}
+		}
+	}
+	return offset, nil
+}
@@ -0,0 +1,48 @@
+package sha
+
+import (
+	"github.com/zzztttkkk/sha/utils"
+)
+
+const expect100Continue = "100-continue"
+
+var continueResponse = []byte("HTTP/1.1 100 Continue\r\n\r\n")
+
+// expectsContinue reports whether the client waits for the interim response before sending the body.
+// A server must ignore the expectation of a HTTP/1.0 request, RFC 7231 5.1.1.
+func expectsContinue(ctx *RequestCtx) bool {
+	if string(ctx.Request.version) == "HTTP/1.0" {
+		return false
+	}
+	_, ok := ctx.Request.Header.Get(HeaderExpect)
+	return ok
+}
+
+// handleExpectation is called once the request header is parsed.
+// It sends `100 Continue` if the body is accepted, or returns an error which should be responded without reading the body.
+func (protocol *_Http11Protocol) handleExpectation(ctx *RequestCtx) HttpError {
+	v, _ := ctx.Request.Header.Get(HeaderExpect)
+	if string(inPlaceLowercase(utils.InplaceTrimAsciiSpace(v))) != expect100Continue {
+		return StatusError(StatusExpectationFailed)
+	}
+
+	if fn := protocol.server.OnExpectContinue; fn != nil && !fn(ctx) {
+		if ctx.Response.statusCode < 1 {
+			ctx.Response.statusCode = StatusExpectationFailed
+		}
+		return StatusError(ctx.Response.statusCode)
+	}
+
+	if ctx.status == 2 && ctx.bodyRemain < 1 { // no body
+		return nil
+	}
+
+	res := &ctx.Response
+	if _, err := res.sendBuf.Write(continueResponse); err != nil {
+		return ErrBadConnection
+	}
+	if err := res.sendBuf.Flush(); err != nil {
+		return ErrBadConnection
+	}
+	return nil
+}
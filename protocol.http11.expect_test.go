@@ -0,0 +1,65 @@
+package sha
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestHttp11Protocol_ExpectContinue(t *testing.T) {
+	s, addr := startTestServer(t, RequestHandlerFunc(func(ctx *RequestCtx) { _, _ = ctx.Write(ctx.buf) }))
+	s.OnExpectContinue = func(ctx *RequestCtx) bool {
+		if string(ctx.Request.Path) == "/forbidden" {
+			ctx.SetStatus(StatusForbidden)
+			return false
+		}
+		return true
+	}
+
+	do := func(raw string) (*bufio.Reader, net.Conn) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = conn.Write([]byte(raw))
+		return bufio.NewReader(conn), conn
+	}
+
+	r, conn := do("POST / HTTP/1.1\r\nHost: a\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+	defer conn.Close()
+	res, err := http.ReadResponse(r, nil)
+	if err != nil || res.StatusCode != http.StatusContinue {
+		t.Fatalf("expected 100 continue: %v %v", res, err)
+	}
+	_, _ = conn.Write([]byte("hello"))
+	res, err = http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Fatalf("bad response: %d %q", res.StatusCode, body)
+	}
+
+	cases := []struct {
+		raw    string
+		status int
+	}{
+		{"POST / HTTP/1.1\r\nHost: a\r\nExpect: 100-continue\r\nContent-Length: 100000\r\n\r\n", http.StatusRequestEntityTooLarge},
+		{"POST /forbidden HTTP/1.1\r\nHost: a\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n", http.StatusForbidden},
+		{"POST / HTTP/1.1\r\nHost: a\r\nExpect: something\r\nContent-Length: 5\r\n\r\n", http.StatusExpectationFailed},
+	}
+	for _, c := range cases {
+		r, conn := do(c.raw)
+		res, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != c.status || !res.Close {
+			t.Fatalf("bad response: %d close=%v, expected %d", res.StatusCode, res.Close, c.status)
+		}
+		_ = conn.Close()
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"context"
 	"github.com/imdario/mergo"
 	"github.com/zzztttkkk/sha/utils"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -21,6 +22,25 @@ type HTTPOption struct {
 	DefaultResponseSendBufferSize int  `json:"default_response_send_buffer_size" toml:"default-response-send-buffer-size"`
 	ASCIIHeader                   bool `json:"ascii_header" toml:"ascii-header"`
 	AutoCompression               bool `json:"auto_compression" toml:"auto-compress"`
+	// Compression is used by AutoCompression and `RequestCtx.AutoCompress`.
+	Compression CompressionOption `json:"compression" toml:"compression"`
+	// DecompressRequestBody decodes the request body by its `Content-Encoding` before the handler is called,
+	// gzip, deflate, br and zstd are supported, an unknown encoding is rejected by 415.
+	// MaxDecompressedBodySize limits the decoded size, MaxRequestBodySize is used if it is zero.
+	DecompressRequestBody   bool `json:"decompress_request_body" toml:"decompress-request-body"`
+	MaxDecompressedBodySize int  `json:"max_decompressed_body_size" toml:"max-decompressed-body-size"`
+	// Strict rejects the ambiguous requests that may be used for request smuggling, nil means true.
+	Strict *bool `json:"strict" toml:"strict"`
+
+	// ReadHeaderTimeout limits the time of reading the request line and the header, `ServerOption.ReadTimeout` is used if it is zero.
+	// ReadBodyTimeout limits the time of reading the body, zero means the body shares the deadline with the header.
+	ReadHeaderTimeout utils.TomlDuration `json:"read_header_timeout" toml:"read-header-timeout"`
+	ReadBodyTimeout   utils.TomlDuration `json:"read_body_timeout" toml:"read-body-timeout"`
+	// MinReadRate extends the read deadlines by the received bytes, in bytes per second, 0 means disabled.
+	// A client must send at least MinReadRate bytes per second on average after the timeouts.
+	MinReadRate int `json:"min_read_rate" toml:"min-read-rate"`
+	// MaxKeepAliveRequests closes the connection after this number of requests, 0 means no limit.
+	MaxKeepAliveRequests int `json:"max_keep_alive_requests" toml:"max-keep-alive-requests"`
 }
 
 var defaultHTTPOption = HTTPOption{
@@ -37,11 +57,13 @@ var defaultHTTPOption = HTTPOption{
 type _Http11Protocol struct {
 	HTTPOption
 
-	OnParseError func(conn net.Conn, err HttpError) bool // close connection if return true
+	OnParseError func(conn net.Conn, err HttpError) bool // respond the error and close connection if return true
 	OnWriteError func(conn net.Conn, err error) bool     // close connection if return true
 
-	server  *Server
-	handler RequestHandler
+	server      *Server
+	handler     RequestHandler
+	strict      bool
+	compression *_Compression
 
 	readBufferPool    *utils.FixedSizeBufferPool
 	resBodyBufferPool *utils.BufferPool
@@ -52,7 +74,7 @@ var upgradeStr = []byte("upgrade")
 var keepAliveStr = []byte("keep-alive")
 
 const (
-	http11  = "HTTP/1.1 "
+	http11 = "HTTP/1.1 "
 )
 
 func NewHTTP11Protocol(option *HTTPOption) HTTPProtocol {
@@ -63,6 +85,11 @@ func NewHTTP11Protocol(option *HTTPOption) HTTPProtocol {
 	if err := mergo.Merge(&v.HTTPOption, &defaultHTTPOption); err != nil {
 		panic(err)
 	}
+	v.strict = v.Strict == nil || *v.Strict
+	v.compression = newCompression(&v.Compression)
+	if v.MaxDecompressedBodySize < 1 {
+		v.MaxDecompressedBodySize = v.MaxRequestBodySize
+	}
 
 	v.readBufferPool = utils.NewFixedSizeBufferPoll(v.ReadBufferSize, v.MaxReadBufferSize)
 	v.resBodyBufferPool = utils.NewBufferPoll(v.MaxReadBufferSize)
@@ -92,8 +119,53 @@ func (protocol *_Http11Protocol) keepalive(ctx *RequestCtx) bool {
 	return string(ctx.Request.version[5:]) >= http11Str // if http version >= 1.1, enable keep-alive default
 }
 
+// reusable reports whether the connection can serve the next request, see `ServerOption.MaxConnectionKeepAlive`.
+func (protocol *_Http11Protocol) reusable(ctx *RequestCtx) bool {
+	if protocol.server.inShutdown() {
+		return false
+	}
+	lifetime := protocol.server.option.MaxConnectionKeepAlive.Duration
+	return lifetime < 1 || time.Since(ctx.connTime) < lifetime
+}
+
+// prepareConnectionHeader sets the `Connection` header of the response and reports whether to keep the connection alive.
+func (protocol *_Http11Protocol) prepareConnectionHeader(ctx *RequestCtx) bool {
+	if protocol.keepalive(ctx) && protocol.reusable(ctx) {
+		ctx.Response.Header.Set(HeaderConnection, keepAliveStr)
+		return true
+	}
+	ctx.Response.Header.Set(HeaderConnection, utils.B(closeStr))
+	return false
+}
+
 var zeroTime time.Time
 
+// _ReadDeadline limits the time of reading a part of a request, the deadline is extended by the received bytes at minRate.
+type _ReadDeadline struct {
+	conn    net.Conn
+	minRate int
+	start   time.Time
+	timeout time.Duration
+	read    int
+}
+
+// reset starts a new part, the current deadline is kept if timeout is zero.
+func (d *_ReadDeadline) reset(timeout time.Duration) {
+	if timeout < 1 {
+		return
+	}
+	d.start, d.timeout, d.read = time.Now(), timeout, 0
+	_ = d.conn.SetReadDeadline(d.start.Add(timeout))
+}
+
+func (d *_ReadDeadline) feed(n int) {
+	if d.minRate < 1 || d.timeout < 1 || n < 1 {
+		return
+	}
+	d.read += n
+	_ = d.conn.SetReadDeadline(d.start.Add(d.timeout + time.Duration(d.read)*time.Second/time.Duration(d.minRate)))
+}
+
 func (protocol *_Http11Protocol) ServeHTTPConn(ctx context.Context, conn net.Conn) {
 	var err error
 	var n int
@@ -102,6 +174,7 @@ func (protocol *_Http11Protocol) ServeHTTPConn(ctx context.Context, conn net.Con
 
 	rctx := acquireRequestCtx()
 	rctx.isTLS = protocol.server.isTls
+	rctx.compression = protocol.compression
 	readBuf := protocol.readBufferPool.Get()
 	rctx.Response.bodyBuf = protocol.resBodyBufferPool.Get()
 	bufI := protocol.resSendBufferPool.Get()
@@ -114,68 +187,138 @@ func (protocol *_Http11Protocol) ServeHTTPConn(ctx context.Context, conn net.Con
 
 	defer func() {
 		protocol.readBufferPool.Put(readBuf)
-		protocol.resBodyBufferPool.Put(rctx.Response.bodyBuf)
-		protocol.resSendBufferPool.Put(rctx.Response.sendBuf)
-		ReleaseRequestCtx(rctx)
+		bodyBuf, sendBuf := rctx.Response.bodyBuf, rctx.Response.sendBuf
+		ReleaseRequestCtx(rctx) // the reset truncates the body buffer
+		protocol.resBodyBufferPool.Put(bodyBuf)
+		protocol.resSendBufferPool.Put(sendBuf)
 	}()
 
 	rctx.conn = conn
-	rctx.connTime = time.Now()
+	rctx.connTime = protocol.server.connAcceptTime(conn)
+	rctx.streamer = protocol
+	var watcher _ConnWatcher
+	rctx.watcher = &watcher
 
 	idleTimeout := protocol.server.option.IdleTimeout.Duration
 	readTimeout := protocol.server.option.ReadTimeout.Duration
+	headerTimeout := protocol.ReadHeaderTimeout.Duration
+	if headerTimeout < 1 {
+		headerTimeout = readTimeout
+	}
+	bodyTimeout := protocol.ReadBodyTimeout.Duration
+	maxRequests := protocol.MaxKeepAliveRequests
+	lifetime := protocol.server.option.MaxConnectionKeepAlive.Duration
 	writeTimeout := protocol.server.option.WriteTimeout.Duration
 	autoCompression := protocol.AutoCompression
-	handler := protocol.server.Handler
+	server := protocol.server
+	handler := server.Handler
+	var h2 *_Http2Protocol
+	if v, ok := server.http2Protocol.(*_Http2Protocol); ok && v.H2C && !server.isTls {
+		h2 = v
+	}
 
-	inIdle := false
+	inIdle := true
+	inBody := false
+	served := 0
+	deadline := _ReadDeadline{conn: conn, minRate: protocol.MinReadRate}
 
-	if readTimeout > 0 {
-		_ = conn.SetReadDeadline(time.Now().Add(readTimeout))
+	if headerTimeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(headerTimeout))
 	}
 
+	// the buffered data in readBuf.Data[offset:n] may contain the pipelined requests
+	offset := 0
+
 	for keepAlive {
-		offset := 0
-		n, err = conn.Read(readBuf.Data)
-		if n < 1 {
-			if err == nil {
-				continue
+		received := 0
+		if offset == n {
+			offset = 0
+			n, err = conn.Read(readBuf.Data)
+			if n < 1 {
+				if err == nil {
+					continue
+				}
+				// `net.Conn.Read` is a blocking call, got 'io.EOF' means that the client closes this connection.
+				return
 			}
-			// `net.Conn.Read` is a blocking call, got 'io.EOF' means that the client closes this connection.
-			return
+			received = n
 		}
 
-		if inIdle { // got data, stop idle, reset ReadTimeout
+		if inIdle { // got data, stop idle, start the header deadline
 			inIdle = false
-			if readTimeout > 0 {
-				_ = conn.SetReadDeadline(time.Now().Add(readTimeout))
-			}
+			server.setConnState(conn, ConnStateActive)
+			deadline.reset(headerTimeout)
 		}
+		deadline.feed(received)
 
-		// consume all the buffered data
-		for offset != n {
+		// consume the buffered data until a request is read done, the rest belongs to the next requests
+		for offset != n && !requestReadDone(rctx) {
+			status := rctx.status
 			offset, err = protocol.feedHttp1xReqData(rctx, readBuf.Data, offset, n)
+			if err == nil && status < 2 && rctx.status > 1 && expectsContinue(rctx) {
+				err = protocol.handleExpectation(rctx)
+			}
 			if err != nil {
-				if protocol.OnParseError != nil {
-					if protocol.OnParseError(conn, err.(HttpError)) {
-						return
-					}
-				} else {
+				if rctx.status > 1 && expectsContinue(rctx) { // reply before the body is sent
+					protocol.respondError(rctx, err.(HttpError))
 					return
 				}
+				if protocol.OnParseError == nil || protocol.OnParseError(conn, err.(HttpError)) {
+					protocol.respondError(rctx, err.(HttpError))
+					return
+				}
+				// drop the bad data and the half-parsed request, the next data is parsed as a new request
+				rctx.reset()
+				offset = n
 			}
 		}
 
-		if rctx.status != 2 || rctx.bodyRemain > 0 {
+		if !requestReadDone(rctx) {
+			if rctx.status > 1 && !inBody {
+				inBody = true
+				deadline.reset(bodyTimeout)
+			}
 			continue
 		}
+		inBody = false
+
+		var body *_Http11BodyReader
+		if rctx.bodyStreamed && !requestBodyDone(rctx) {
+			deadline.reset(bodyTimeout)
+			body = &_Http11BodyReader{protocol: protocol, ctx: rctx, conn: conn, deadline: &deadline, data: readBuf.Data, offset: offset, n: n}
+			rctx.bodyStream = body
+		}
+
+		if protocol.DecompressRequestBody && !rctx.bodyStreamed {
+			if err := rctx.decompressBody(protocol.MaxDecompressedBodySize); err != nil {
+				protocol.respondError(rctx, err)
+				return
+			}
+		}
 
 		// got a http1x request
+		server.countConnRequest(conn)
+		served++
+		if maxRequests > 0 && served >= maxRequests {
+			rctx.Close()
+		}
+		rctx.ctx, cancelFn = context.WithCancel(ctx)
+
+		if h2 != nil && isH2cUpgrade(rctx) {
+			h2.upgradeH2c(ctx, conn, io.MultiReader(bytes.NewReader(readBuf.Data[offset:n]), conn), rctx)
+			cancelFn()
+			return
+		}
+
 		if autoCompression {
 			rctx.AutoCompress()
 		}
 
-		rctx.ctx, cancelFn = context.WithCancel(ctx)
+		// cancel the context if the client goes away while handling, the pipelined requests are not watched,
+		// and the connection is read by the handler if the body is streamed
+		if offset == n && body == nil {
+			watcher.start(conn, readBuf.Data, cancelFn)
+		}
 		handler.Handle(rctx)
 
 		if rctx.hijacked {
@@ -183,14 +326,30 @@ func (protocol *_Http11Protocol) ServeHTTPConn(ctx context.Context, conn net.Con
 			return
 		}
 
+		if body != nil {
+			// the rest of the body is skipped, the connection can not be reused if it is too large or broken
+			if !body.drain(int64(protocol.MaxRequestBodySize)) {
+				rctx.Close()
+			}
+			offset, n = body.offset, body.n
+		}
+
+		if data := watcher.stop(); len(data) > 0 {
+			offset, n = 0, len(data)
+		}
+		if watcher.closed {
+			cancelFn()
+			return
+		}
+
 		if writeTimeout > 0 {
 			_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
 		}
 
-		if protocol.keepalive(rctx) {
-			rctx.Response.Header.Set(HeaderConnection, keepAliveStr)
+		if rctx.Response.headerSent { // streaming response, the connection header is already sent
+			keepAlive = protocol.keepalive(rctx) && protocol.reusable(rctx)
 		} else {
-			keepAlive = false
+			keepAlive = protocol.prepareConnectionHeader(rctx)
 		}
 
 		if err := protocol.sendResponseBuffer(rctx); err != nil {
@@ -208,18 +367,45 @@ func (protocol *_Http11Protocol) ServeHTTPConn(ctx context.Context, conn net.Con
 			_ = conn.SetWriteDeadline(zeroTime)
 		}
 
+		cancelFn()
+		rctx.Reset()
+
+		if offset != n { // a pipelined request is buffered, serve it without idle
+			deadline.reset(headerTimeout)
+			continue
+		}
+
 		inIdle = true
+		server.setConnState(conn, ConnStateIdle)
+		idleDeadline := zeroTime
 		if idleTimeout > 0 {
-			_ = conn.SetReadDeadline(time.Now().Add(idleTimeout))
-		} else if readTimeout > 0 {
-			_ = conn.SetReadDeadline(time.Now().Add(readTimeout))
-		} else {
-			_ = conn.SetReadDeadline(zeroTime)
+			idleDeadline = time.Now().Add(idleTimeout)
+		} else if headerTimeout > 0 {
+			idleDeadline = time.Now().Add(headerTimeout)
 		}
+		// the connection is not reused after its lifetime
+		if lifetime > 0 && (idleDeadline.IsZero() || idleDeadline.After(rctx.connTime.Add(lifetime))) {
+			idleDeadline = rctx.connTime.Add(lifetime)
+		}
+		_ = conn.SetReadDeadline(idleDeadline)
+	}
+}
 
-		cancelFn()
-		rctx.Reset()
+// requestReadDone reports whether the request line, header and body are all read, the streamed body is read by the handler.
+func requestReadDone(ctx *RequestCtx) bool {
+	return requestBodyDone(ctx) || (ctx.bodyStreamed && ctx.status > 1)
+}
+
+func requestBodyDone(ctx *RequestCtx) bool { return ctx.status == 2 && ctx.bodyRemain < 1 }
+
+// streamsRequestBody reports whether the body is read by the handler, the h2c upgrade request is always buffered.
+func (protocol *_Http11Protocol) streamsRequestBody(ctx *RequestCtx) bool {
+	server := protocol.server
+	if server == nil || !server.streamsRequestBody(ctx) {
+		return false
 	}
+	h2, ok := server.http2Protocol.(*_Http2Protocol)
+	return !ok || !h2.H2C || server.isTls || !isH2cUpgrade(ctx)
 }
 
 var httpVersion = []byte("HTTP/")
@@ -243,7 +429,7 @@ func cleanPath(p []byte) []byte {
 	return p[:ind]
 }
 
-func (protocol *_Http11Protocol) initRequest(ctx *RequestCtx) {
+func initRequest(ctx *RequestCtx) {
 	req := &ctx.Request
 
 	ctx.reqTime = time.Now()
@@ -320,10 +506,14 @@ func (protocol *_Http11Protocol) feedHttp1xReqData(ctx *RequestCtx, data []byte,
 			if v > 127 {
 				return -2, ErrBadConnection
 			}
+			if protocol.strict && !checkLineEnding(ctx, v) {
+				return -11, ErrBadConnection
+			}
 
 			if v == '\n' { // end of first line
 				ctx.status++
 				ctx.buf = ctx.buf[:0]
+				ctx.cHKeyDoUpper = true
 				if len(req.RawPath) < 1 { // empty path
 					return -3, ErrBadConnection
 				}
@@ -371,30 +561,63 @@ func (protocol *_Http11Protocol) feedHttp1xReqData(ctx *RequestCtx, data []byte,
 			if protocol.ASCIIHeader && v > 127 {
 				return -7, ErrBadConnection
 			}
+			if protocol.strict {
+				if !checkLineEnding(ctx, v) {
+					return -12, ErrBadConnection
+				}
+				if err := checkHeaderByte(ctx, v); err != nil {
+					return -13, err
+				}
+			}
 
 			if v == '\n' {
 				if len(ctx.currentHeaderKey) < 1 { // all header data read done
 					ctx.status++
-					ctx.bodySize = req.Header.ContentLength()
-					if ctx.bodySize > protocol.MaxRequestBodySize {
+					if protocol.strict {
+						if err := checkMessageFraming(ctx); err != nil {
+							return -14, err
+						}
+					}
+					chunked, err := isChunked(&req.Header)
+					if err != nil {
+						return 10010, err
+					}
+					if chunked {
+						ctx.bodySize = -1
+					} else {
+						ctx.bodySize = req.Header.ContentLength()
+					}
+					initRequest(ctx)
+					if protocol.streamsRequestBody(ctx) {
+						ctx.bodyStreamed = true
+						ctx.maxBodySize = protocol.MaxRequestBodySize
+						req.bodyBufferPtr = nil
+					} else if ctx.bodySize > protocol.MaxRequestBodySize {
 						return 10008, ErrRequestEntityTooLarge
 					}
-					protocol.initRequest(ctx)
+					if chunked {
+						ctx.status = 3
+					}
 					return offset, nil
 				}
 
-				ctx.Request.Header.AppendBytes(
-					utils.InplaceTrimAsciiSpace(ctx.currentHeaderKey),
-					utils.DecodeURI(utils.InplaceTrimAsciiSpace(ctx.buf)),
-				)
+				key := utils.InplaceTrimAsciiSpace(ctx.currentHeaderKey)
+				if protocol.strict {
+					if !ctx.headerKVSepRead { // a line without colon
+						return -15, ErrBadConnection
+					}
+					key = canonicalFramingHeaderKey(key)
+				}
+				// header values are kept as the wire bytes, a decoded value can be framed differently by the intermediaries.
+				ctx.Request.Header.AppendBytes(key, utils.InplaceTrimAsciiSpace(ctx.buf))
 				ctx.currentHeaderKey = ctx.currentHeaderKey[:0]
 				ctx.buf = ctx.buf[:0]
+				ctx.headerKVSepRead = false
+				ctx.cHKeyDoUpper = true
 				return offset, nil
 			}
 
 			if v == '\r' {
-				ctx.headerKVSepRead = false
-				ctx.cHKeyDoUpper = true
 				continue
 			}
 
@@ -417,12 +640,17 @@ func (protocol *_Http11Protocol) feedHttp1xReqData(ctx *RequestCtx, data []byte,
 		}
 	case 2:
 		size := end - offset
-		if size > ctx.bodyRemain {
-			return 10009, ErrBadConnection
+		if size > ctx.bodyRemain { // the rest is the next request
+			size = ctx.bodyRemain
+		}
+		if size < 1 {
+			return offset, nil
 		}
-		ctx.buf = append(ctx.buf, data[offset:end]...)
+		ctx.buf = append(ctx.buf, data[offset:offset+size]...)
 		ctx.bodyRemain -= size
-		return end, nil
+		return offset + size, nil
+	case 3: // chunked body
+		return protocol.feedHttp1xChunkedData(ctx, data, offset, end)
 	}
 	return offset, nil
 }
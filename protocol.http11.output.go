@@ -1,6 +1,7 @@
 package sha
 
 import (
+	"errors"
 	"fmt"
 	"github.com/zzztttkkk/sha/utils"
 	"strconv"
@@ -8,8 +9,24 @@ import (
 
 func (protocol *_Http11Protocol) sendResponseBuffer(ctx *RequestCtx) error {
 	res := &ctx.Response
+	if !res.headerSent {
+		ctx.prepareCompression(false)
+	}
+	if res.bodyFile != nil {
+		if !res.headerSent && res.compressWriter == nil && len(res.bodyBuf.Data) == 0 {
+			return protocol.sendBodyFile(ctx)
+		}
+		if err := ctx.writeBodyFile(); err != nil {
+			return err
+		}
+	}
+
+	if res.headerSent {
+		return protocol.finishStreaming(ctx)
+	}
+
 	if res.compressWriter != nil {
-		err := res.compressWriter.Flush()
+		err := res.compressWriter.Close()
 		if err != nil {
 			return err
 		}
@@ -17,7 +34,9 @@ func (protocol *_Http11Protocol) sendResponseBuffer(ctx *RequestCtx) error {
 
 	size := int64(len(res.bodyBuf.Data))
 
-	res.Header.SetContentLength(size)
+	if size > 0 || !res.keepContentLength {
+		res.Header.SetContentLength(size)
+	}
 	err := protocol.writeHeader(ctx)
 	if err != nil {
 		return err
@@ -30,6 +49,17 @@ func (protocol *_Http11Protocol) sendResponseBuffer(ctx *RequestCtx) error {
 	return res.sendBuf.Flush()
 }
 
+// respondError responds the error of a request that is not read done, e.g. a bad request or a rejected expectation.
+// the rest of the request can not be skipped reliably, so the connection is closed after the response.
+func (protocol *_Http11Protocol) respondError(ctx *RequestCtx, err HttpError) {
+	res := &ctx.Response
+	if res.statusCode < 1 {
+		res.statusCode = err.StatusCode()
+	}
+	ctx.Close()
+	_ = protocol.sendResponseBuffer(ctx)
+}
+
 const (
 	EndLine     = "\r\n"
 	headerKVSep = ": "
@@ -69,3 +99,97 @@ func (protocol *_Http11Protocol) writeHeader(ctx *RequestCtx) error {
 	_, e := res.sendBuf.Write(res.headerBuf)
 	return e
 }
+
+var lastChunk = []byte("0\r\n\r\n")
+
+func (protocol *_Http11Protocol) writeChunk(res *Response, p []byte) error {
+	res.headerBuf = res.headerBuf[:0]
+	res.headerBuf = strconv.AppendInt(res.headerBuf, int64(len(p)), 16)
+	res.headerBuf = append(res.headerBuf, EndLine...)
+	if _, err := res.sendBuf.Write(res.headerBuf); err != nil {
+		return err
+	}
+	if _, err := res.sendBuf.Write(p); err != nil {
+		return err
+	}
+	_, err := res.sendBuf.WriteString(EndLine)
+	return err
+}
+
+// commitHeader sends the response header before the body is complete.
+// the body is sent in chunked encoding, or until the connection is closed for http/1.0 clients.
+func (protocol *_Http11Protocol) commitHeader(ctx *RequestCtx) error {
+	res := &ctx.Response
+	res.headerSent = true
+	res.Header.Del(HeaderContentLength)
+
+	if string(ctx.Request.version[5:]) >= http11Str {
+		res.chunked = true
+		res.Header.Set(HeaderTransferEncoding, chunkedStr)
+		protocol.prepareConnectionHeader(ctx)
+	} else {
+		res.Header.Set(HeaderConnection, utils.B(closeStr))
+	}
+	return protocol.writeHeader(ctx)
+}
+
+func (protocol *_Http11Protocol) writeStreamingBody(ctx *RequestCtx) error {
+	res := &ctx.Response
+	data := res.bodyBuf.Data
+	if len(data) < 1 || ctx.Request._method == _MHead {
+		res.bodyBuf.Data = data[:0]
+		return nil
+	}
+
+	var err error
+	if res.chunked {
+		err = protocol.writeChunk(res, data)
+	} else {
+		_, err = res.sendBuf.Write(data)
+	}
+	res.bodyBuf.Data = data[:0]
+	return err
+}
+
+func (protocol *_Http11Protocol) flushResponse(ctx *RequestCtx) error {
+	res := &ctx.Response
+	if !res.headerSent {
+		ctx.prepareCompression(true)
+		if err := protocol.commitHeader(ctx); err != nil {
+			return err
+		}
+	}
+	if res.compressWriter != nil {
+		if err := res.compressWriter.Flush(); err != nil {
+			return err
+		}
+	}
+	if err := protocol.writeStreamingBody(ctx); err != nil {
+		return err
+	}
+	return res.sendBuf.Flush()
+}
+
+func (protocol *_Http11Protocol) streamBufferSize() int {
+	return protocol.DefaultResponseSendBufferSize
+}
+
+func (protocol *_Http11Protocol) finishStreaming(ctx *RequestCtx) error {
+	res := &ctx.Response
+	if res.compressWriter != nil {
+		if err := res.compressWriter.Close(); err != nil {
+			return err
+		}
+	}
+	if err := protocol.writeStreamingBody(ctx); err != nil {
+		return err
+	}
+	if res.chunked && ctx.Request._method != _MHead {
+		if _, err := res.sendBuf.Write(lastChunk); err != nil {
+			return err
+		}
+	}
+	return res.sendBuf.Flush()
+}
+
+var ErrStreamingUnsupported = errors.New("sha: response streaming is not supported by the http protocol")
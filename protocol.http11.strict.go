@@ -0,0 +1,121 @@
+package sha
+
+import (
+	"strings"
+
+	"github.com/zzztttkkk/sha/utils"
+)
+
+// the checks of the strict mode, RFC 7230.
+// a request accepted by the server must have the same framing in all the intermediaries, otherwise,
+// the body of a request can be treated as the next request(request smuggling).
+
+var isTokenChar [256]bool
+
+func init() {
+	for c := '0'; c <= '9'; c++ {
+		isTokenChar[c] = true
+	}
+	for c := 'a'; c <= 'z'; c++ {
+		isTokenChar[c] = true
+		isTokenChar[c-'a'+'A'] = true
+	}
+	for _, c := range "!#$%&'*+-.^_`|~" {
+		isTokenChar[c] = true
+	}
+}
+
+func isToken(v []byte) bool {
+	if len(v) < 1 {
+		return false
+	}
+	for _, c := range v {
+		if !isTokenChar[c] {
+			return false
+		}
+	}
+	return true
+}
+
+// isFieldValueChar reports whether v is allowed in a header value, CR is checked as the line ending.
+func isFieldValueChar(v byte) bool { return v == '\t' || v == '\r' || (v >= 0x20 && v != 0x7f) }
+
+// checkLineEnding checks that a line ends with CRLF, and CR is not used elsewhere.
+func checkLineEnding(ctx *RequestCtx, v byte) bool {
+	if ctx.crRead != (v == '\n') {
+		return false
+	}
+	ctx.crRead = v == '\r'
+	return true
+}
+
+// checkHeaderByte rejects the non-token header names(including whitespace before colon and obsolete line folding)
+// and the control characters in header values.
+func checkHeaderByte(ctx *RequestCtx, v byte) HttpError {
+	if v == '\r' || v == '\n' {
+		return nil
+	}
+	if ctx.headerKVSepRead {
+		if !isFieldValueChar(v) {
+			return ErrBadConnection
+		}
+		return nil
+	}
+	if v == ':' {
+		if len(ctx.currentHeaderKey) < 1 {
+			return ErrBadConnection
+		}
+		return nil
+	}
+	if !isTokenChar[v] {
+		return ErrBadConnection
+	}
+	return nil
+}
+
+// canonicalFramingHeaderKey makes sure the headers that determine the message length can be found by `Header.Get`.
+func canonicalFramingHeaderKey(key []byte) []byte {
+	switch {
+	case strings.EqualFold(utils.S(key), HeaderContentLength):
+		return append(key[:0], HeaderContentLength...)
+	case strings.EqualFold(utils.S(key), HeaderTransferEncoding):
+		return append(key[:0], HeaderTransferEncoding...)
+	}
+	return key
+}
+
+func isDigits(v []byte) bool {
+	if len(v) < 1 {
+		return false
+	}
+	for _, c := range v {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// checkMessageFraming is called when the header is read done.
+func checkMessageFraming(ctx *RequestCtx) HttpError {
+	header := &ctx.Request.Header
+
+	if string(ctx.Request.version) != "HTTP/1.1" && string(ctx.Request.version) != "HTTP/1.0" {
+		return ErrBadConnection
+	}
+
+	cls := header.GetAll(HeaderContentLength)
+	if len(cls) > 1 || (len(cls) == 1 && !isDigits(cls[0])) {
+		return ErrBadConnection
+	}
+
+	if len(header.GetAll(HeaderTransferEncoding)) > 0 {
+		if len(cls) > 0 { // CL.TE and TE.CL
+			return ErrBadConnection
+		}
+		if string(ctx.Request.version) == "HTTP/1.0" { // RFC 7230 3.3.1
+			return ErrBadConnection
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package sha
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var smugglingPayloads = []struct {
+	name string
+	raw  string
+}{
+	{"CL percent encoded", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: %35\r\n\r\nhello"},
+	{"CL.CL", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nContent-Length: 5\r\n\r\nabcde"},
+	{"CL list", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5, 5\r\n\r\nabcde"},
+	{"CL sign", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: +5\r\n\r\nabcde"},
+	{"CL hex", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 0x5\r\n\r\nabcde"},
+	{"CL.TE", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nG"},
+	{"TE.CL", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n8\r\nSMUGGLED\r\n0\r\n\r\n"},
+	{"CL case", "POST / HTTP/1.1\r\nHost: a\r\nCONTENT-LENGTH: 6\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nG"},
+	{"TE space before colon", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding : chunked\r\n\r\n0\r\n\r\n"},
+	{"TE vertical tab", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding:\x0bchunked\r\n\r\n0\r\n\r\n"},
+	{"TE unknown coding", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: xchunked\r\n\r\n0\r\n\r\n"},
+	{"TE percent encoded", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunke%64\r\n\r\n5\r\nhello\r\n0\r\n\r\n"},
+	{"TE obs-fold", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: identity\r\n chunked\r\n\r\n0\r\n\r\n"},
+	{"TE http/1.0", "POST / HTTP/1.0\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"},
+	{"bare LF request line", "GET / HTTP/1.1\nHost: a\r\n\r\n"},
+	{"bare LF header", "GET / HTTP/1.1\r\nHost: a\n\r\n"},
+	{"bare CR header", "GET / HTTP/1.1\r\nHost: a\rX-Foo: b\r\n\r\n"},
+	{"non-token name", "GET / HTTP/1.1\r\nHost: a\r\nX[Foo]: b\r\n\r\n"},
+	{"whitespace in name", "GET / HTTP/1.1\r\nHost: a\r\nX Foo: b\r\n\r\n"},
+	{"empty name", "GET / HTTP/1.1\r\nHost: a\r\n: b\r\n\r\n"},
+	{"no colon", "GET / HTTP/1.1\r\nHost: a\r\nX-Foo\r\n\r\n"},
+	{"NUL in value", "GET / HTTP/1.1\r\nHost: a\r\nX-Foo: a\x00b\r\n\r\n"},
+	{"bad version", "GET / HTTP/1.10\r\nHost: a\r\n\r\n"},
+	{"chunk size whitespace", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n 3\r\nabc\r\n0\r\n\r\n"},
+	{"chunk bare LF", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\n0\r\n\r\n"},
+}
+
+func TestHttp11Protocol_Strict(t *testing.T) {
+	protocol := NewHTTP11Protocol(nil).(*_Http11Protocol)
+	for _, c := range smugglingPayloads {
+		ctx := acquireTestRequestCtx()
+		if err := feedTestRequest(protocol, ctx, c.raw, len(c.raw)); err != ErrBadConnection {
+			t.Errorf("%s: expected 400, got %v", c.name, err)
+		}
+		ReleaseRequestCtx(ctx)
+	}
+
+	raw := "POST /a HTTP/1.1\r\nhost: a\r\ncontent-length: 5\r\nX-Foo: a\tb\r\n\r\nhello"
+	ctx := acquireTestRequestCtx()
+	if err := feedTestRequest(protocol, ctx, raw, 1); err != nil || !requestReadDone(ctx) || string(ctx.buf) != "hello" {
+		t.Fatalf("valid request is rejected: %v", err)
+	}
+	ReleaseRequestCtx(ctx)
+
+	strict := false
+	lenient := NewHTTP11Protocol(&HTTPOption{Strict: &strict}).(*_Http11Protocol)
+	raw = "GET / HTTP/1.1\nHost: a\n\n"
+	ctx = acquireTestRequestCtx()
+	if err := feedTestRequest(lenient, ctx, raw, len(raw)); err != nil || !requestReadDone(ctx) {
+		t.Fatalf("bare LF should be accepted in the lenient mode: %v", err)
+	}
+	ReleaseRequestCtx(ctx)
+}
+
+func TestHttp11Protocol_StrictResponse(t *testing.T) {
+	_, addr := startTestServer(t, RequestHandlerFunc(func(ctx *RequestCtx) {}))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte(smugglingPayloads[4].raw))
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusBadRequest || !res.Close {
+		t.Fatalf("bad response: %d close=%v", res.StatusCode, res.Close)
+	}
+	_, _ = io.ReadAll(res.Body)
+	if _, err = r.ReadByte(); err != io.EOF {
+		t.Fatalf("the connection should be closed, %v", err)
+	}
+}
+
+func TestHttp11Protocol_OnParseError(t *testing.T) {
+	protocol := NewHTTP11Protocol(nil).(*_Http11Protocol)
+	protocol.OnParseError = func(conn net.Conn, err HttpError) bool { return false }
+	opt := ServerOption{Addr: "127.0.0.1:0"}
+	s := New(nil, &opt, protocol, nil)
+	s.Handler = RequestHandlerFunc(func(ctx *RequestCtx) { _, _ = ctx.Write(ctx.Request.Path) })
+	addr := serveTestServer(t, s)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 2))
+	_, _ = conn.Write([]byte("GET /bad HTTP/1.1\r\nHost: a\r\nX-Foo\r\n"))
+	time.Sleep(time.Millisecond * 100)
+
+	// the dropped request does not affect the next one
+	_, _ = conn.Write([]byte("GET /ok HTTP/1.1\r\nHost: a\r\n\r\n"))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(body) != "/ok" {
+		t.Fatalf("bad response: %d %q", res.StatusCode, body)
+	}
+}
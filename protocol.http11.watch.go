@@ -0,0 +1,68 @@
+package sha
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"time"
+)
+
+// _ConnWatcher reads the connection in background while the handler is running,
+// so that the request context is canceled when the client goes away.
+// The data read by the watcher belongs to the next request.
+type _ConnWatcher struct {
+	conn   net.Conn
+	buf    []byte
+	n      int
+	closed bool
+	active bool
+	done   chan struct{}
+}
+
+var aLongTimeAgo = time.Unix(1, 0)
+
+func (w *_ConnWatcher) start(conn net.Conn, buf []byte, cancel func()) {
+	w.conn = conn
+	w.buf = buf
+	w.n = 0
+	w.closed = false
+	w.active = true
+	w.done = make(chan struct{})
+
+	_ = conn.SetReadDeadline(zeroTime)
+	go func() {
+		defer close(w.done)
+		n, err := conn.Read(w.buf)
+		w.n = n
+		if n < 1 && err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() { // stopped
+				return
+			}
+			w.closed = true
+			cancel()
+		}
+	}()
+}
+
+// stop waits the background read to return, and returns the data read by it.
+func (w *_ConnWatcher) stop() []byte {
+	if !w.active {
+		return nil
+	}
+	w.active = false
+	_ = w.conn.SetReadDeadline(aLongTimeAgo)
+	<-w.done
+	_ = w.conn.SetReadDeadline(zeroTime)
+	return w.buf[:w.n]
+}
+
+// hijack stops the watcher, and the data read by it is still readable from the returned connection.
+func (w *_ConnWatcher) hijack(conn net.Conn) net.Conn {
+	data := w.stop()
+	if len(data) < 1 {
+		return conn
+	}
+	data = append([]byte(nil), data...)
+	return &_PeekedConn{Conn: conn, r: bufio.NewReader(io.MultiReader(bytes.NewReader(data), conn))}
+}
@@ -0,0 +1,63 @@
+package sha
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHttp11Protocol_CancelOnDisconnect(t *testing.T) {
+	canceled := make(chan bool, 1)
+	_, addr := startTestServer(t, RequestHandlerFunc(func(ctx *RequestCtx) {
+		select {
+		case <-ctx.Done():
+			canceled <- true
+		case <-time.After(time.Second * 5):
+			canceled <- false
+		}
+	}))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n"))
+	time.Sleep(time.Millisecond * 50)
+	_ = conn.Close()
+
+	if !<-canceled {
+		t.Fatal("the request context is not canceled after the client closed the connection")
+	}
+}
+
+func TestHttp11Protocol_RequestWhileHandling(t *testing.T) {
+	_, addr := startTestServer(t, RequestHandlerFunc(func(ctx *RequestCtx) {
+		time.Sleep(time.Millisecond * 100)
+		_, _ = ctx.Write(ctx.Request.Path)
+	}))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, _ = conn.Write([]byte("GET /a HTTP/1.1\r\nHost: a\r\n\r\n"))
+	time.Sleep(time.Millisecond * 30) // read by the watcher
+	_, _ = conn.Write([]byte("GET /b HTTP/1.1\r\nHost: a\r\n\r\n"))
+
+	r := bufio.NewReader(conn)
+	for _, expected := range []string{"/a", "/b"} {
+		res, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		if string(body) != expected {
+			t.Fatalf("bad response: %q, expected %q", body, expected)
+		}
+	}
+}
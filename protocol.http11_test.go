@@ -0,0 +1,134 @@
+package sha
+
+import (
+	"bufio"
+	"context"
+	"github.com/zzztttkkk/sha/utils"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// acquireTestRequestCtx returns a RequestCtx that can be cleaned by `ReleaseRequestCtx`.
+func acquireTestRequestCtx() *RequestCtx {
+	ctx := acquireRequestCtx()
+	ctx.Response.bodyBuf = &utils.Buf{}
+	ctx.ctx = context.Background()
+	ctx.Reset()
+	ctx.ctx = context.Background()
+	return ctx
+}
+
+func feedTestRequest(protocol *_Http11Protocol, ctx *RequestCtx, raw string, step int) HttpError {
+	data := []byte(raw)
+	for begin := 0; begin < len(data); begin += step {
+		end := begin + step
+		if end > len(data) {
+			end = len(data)
+		}
+		offset := begin
+		for offset != end && !requestReadDone(ctx) {
+			var err HttpError
+			offset, err = protocol.feedHttp1xReqData(ctx, data, offset, end)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestHttp11Protocol_ChunkedBody(t *testing.T) {
+	protocol := NewHTTP11Protocol(nil).(*_Http11Protocol)
+	raw := "POST /upload HTTP/1.1\r\n" +
+		"Host: a\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"Trailer: X-Checksum\r\n" +
+		"\r\n" +
+		"5;name=value\r\nhello\r\n" +
+		"7\r\n, world\r\n" +
+		"0\r\n" +
+		"X-Checksum: abc\r\n" +
+		"\r\n"
+
+	for _, step := range []int{1, 3, 7, len(raw)} {
+		ctx := acquireTestRequestCtx()
+		if err := feedTestRequest(protocol, ctx, raw, step); err != nil {
+			t.Fatalf("step %d: %s", step, err)
+		}
+		if ctx.status != 2 || ctx.bodyRemain != 0 {
+			t.Fatalf("step %d: request is not completed", step)
+		}
+		if string(ctx.Request.BodyRaw()) != "hello, world" {
+			t.Fatalf("step %d: bad body %q", step, ctx.Request.BodyRaw())
+		}
+		v, _ := ctx.Request.Trailers.Get("X-Checksum")
+		if string(v) != "abc" {
+			t.Fatalf("step %d: bad trailer %q", step, v)
+		}
+		ReleaseRequestCtx(ctx)
+	}
+}
+
+func TestHttp11Protocol_ChunkedBodyTooLarge(t *testing.T) {
+	protocol := NewHTTP11Protocol(&HTTPOption{MaxRequestBodySize: 8}).(*_Http11Protocol)
+
+	for _, raw := range []string{
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n5\r\nworld\r\n0\r\n\r\n",
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nffffffffffffffffff\r\n",
+	} {
+		ctx := acquireTestRequestCtx()
+		if err := feedTestRequest(protocol, ctx, raw, len(raw)); err != ErrRequestEntityTooLarge {
+			t.Fatalf("expected 413, got %v", err)
+		}
+		ReleaseRequestCtx(ctx)
+	}
+
+	for raw, expected := range map[string]HttpError{
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked, gzip\r\n\r\n":                           ErrBadConnection,
+		"POST / HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n":                           ErrUnsupportedTransferEncoding,
+		"POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\nTransfer-Encoding: chunked\r\n\r\n":      ErrUnsupportedTransferEncoding,
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nX Checksum: abc\r\n\r\n":     ErrBadConnection,
+		"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nX-Checksum\x01: abc\r\n\r\n": ErrBadConnection,
+	} {
+		ctx := acquireTestRequestCtx()
+		if err := feedTestRequest(protocol, ctx, raw, len(raw)); err != expected {
+			t.Fatalf("%q: expected %v, got %v", raw, expected, err)
+		}
+		ReleaseRequestCtx(ctx)
+	}
+}
+
+func TestHttp11Protocol_Pipelining(t *testing.T) {
+	_, addr := startTestServer(t, RequestHandlerFunc(func(ctx *RequestCtx) {
+		_, _ = ctx.Write(ctx.Request.Path)
+		_, _ = ctx.WriteString(" ")
+		_, _ = ctx.Write(ctx.buf)
+	}))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, _ = conn.Write([]byte(
+		"GET /a HTTP/1.1\r\nHost: a\r\n\r\n" +
+			"POST /b HTTP/1.1\r\nHost: a\r\nContent-Length: 2\r\n\r\nxy" +
+			"POST /c HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n" +
+			"GET /d HTTP/1.1\r\nHost: a\r\n\r\n",
+	))
+
+	r := bufio.NewReader(conn)
+	for _, expected := range []string{"/a ", "/b xy", "/c abc", "/d "} {
+		res, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		if string(body) != expected {
+			t.Fatalf("bad response: %q, expected %q", body, expected)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package sha
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// _Http2BodyPipe passes the DATA frames of a streamed request body from the read loop to the handler.
+// The window of the stream is given back after the data is read by the handler, so the client can not send more data
+// than the window, which limits the buffered data.
+type _Http2BodyPipe struct {
+	stream *_Http2Stream
+	limit  int
+
+	mutex sync.Mutex
+	cond  *sync.Cond
+	buf   bytes.Buffer
+	err   error // io.EOF after the END_STREAM flag
+}
+
+// initialRecvWindow is the receive window of a new stream,
+// the client may use the default window before our settings are acknowledged.
+func (protocol *_Http2Protocol) initialRecvWindow() int32 {
+	if protocol.InitialWindowSize < http2DefaultWindow {
+		return http2DefaultWindow
+	}
+	return int32(protocol.InitialWindowSize)
+}
+
+func newHttp2BodyPipe(stream *_Http2Stream) *_Http2BodyPipe {
+	pipe := &_Http2BodyPipe{stream: stream, limit: int(stream.hc.protocol.initialRecvWindow())}
+	pipe.cond = sync.NewCond(&pipe.mutex)
+	return pipe
+}
+
+// write is called in the read loop, it reports false if the client exceeds the flow-control window.
+func (pipe *_Http2BodyPipe) write(data []byte, endStream bool) bool {
+	pipe.mutex.Lock()
+	defer pipe.mutex.Unlock()
+	if pipe.err != nil {
+		return true
+	}
+	if pipe.buf.Len()+len(data) > pipe.limit {
+		return false
+	}
+	pipe.buf.Write(data)
+	if endStream {
+		pipe.err = io.EOF
+	}
+	pipe.cond.Broadcast()
+	return true
+}
+
+func (pipe *_Http2BodyPipe) close(err error) {
+	pipe.mutex.Lock()
+	if pipe.err == nil {
+		pipe.err = err
+	}
+	pipe.cond.Broadcast()
+	pipe.mutex.Unlock()
+}
+
+// done reports whether the whole body is received.
+func (pipe *_Http2BodyPipe) done() bool {
+	pipe.mutex.Lock()
+	defer pipe.mutex.Unlock()
+	return pipe.err == io.EOF
+}
+
+func (pipe *_Http2BodyPipe) Read(p []byte) (int, error) {
+	if len(p) < 1 {
+		return 0, nil
+	}
+	pipe.mutex.Lock()
+	for pipe.buf.Len() == 0 && pipe.err == nil {
+		pipe.cond.Wait()
+	}
+	if pipe.buf.Len() == 0 {
+		err := pipe.err
+		pipe.mutex.Unlock()
+		return 0, err
+	}
+	n, _ := pipe.buf.Read(p)
+	ended := pipe.err != nil
+	pipe.mutex.Unlock()
+
+	if !ended {
+		stream := pipe.stream
+		hc := stream.hc
+		hc.mutex.Lock()
+		if !hc.closed && !stream.reset && hc.framer.WriteWindowUpdate(stream.id, uint32(n)) == nil {
+			stream.recvWindow += int32(n)
+			_ = hc.bw.Flush()
+		}
+		hc.mutex.Unlock()
+	}
+	return n, nil
+}
@@ -0,0 +1,688 @@
+package sha
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"github.com/imdario/mergo"
+	"github.com/zzztttkkk/sha/utils"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+type HTTP2Option struct {
+	MaxConcurrentStreams uint32 `json:"max_concurrent_streams" toml:"max-concurrent-streams"`
+	InitialWindowSize    uint32 `json:"initial_window_size" toml:"initial-window-size"`
+	MaxFrameSize         uint32 `json:"max_frame_size" toml:"max-frame-size"`
+	MaxHeaderListSize    uint32 `json:"max_header_list_size" toml:"max-header-list-size"`
+	MaxRequestBodySize   int    `json:"max_request_body_size" toml:"max-request-body-size"`
+	WriteBufferSize      int    `json:"write_buffer_size" toml:"write-buffer-size"`
+	AutoCompression      bool   `json:"auto_compression" toml:"auto-compress"`
+	H2C                  bool   `json:"h2c" toml:"h2c"` // enable http2 over cleartext tcp, by prior-knowledge or `Upgrade: h2c`
+	// Compression is used by AutoCompression and `RequestCtx.AutoCompress`.
+	Compression CompressionOption `json:"compression" toml:"compression"`
+	// DecompressRequestBody and MaxDecompressedBodySize are the same as `HTTPOption`.
+	DecompressRequestBody   bool `json:"decompress_request_body" toml:"decompress-request-body"`
+	MaxDecompressedBodySize int  `json:"max_decompressed_body_size" toml:"max-decompressed-body-size"`
+}
+
+var defaultHTTP2Option = HTTP2Option{
+	MaxConcurrentStreams: 250,
+	InitialWindowSize:    65535,
+	MaxFrameSize:         16384,
+	MaxHeaderListSize:    4096,
+	MaxRequestBodySize:   4096,
+	WriteBufferSize:      4096,
+}
+
+type _Http2Protocol struct {
+	HTTP2Option
+
+	server            *Server
+	resBodyBufferPool *utils.BufferPool
+	compression       *_Compression
+}
+
+func NewHTTP2Protocol(option *HTTP2Option) HTTPProtocol {
+	v := &_Http2Protocol{}
+	if option != nil {
+		v.HTTP2Option = *option
+	}
+	if err := mergo.Merge(&v.HTTP2Option, &defaultHTTP2Option); err != nil {
+		panic(err)
+	}
+	v.resBodyBufferPool = utils.NewBufferPoll(int(v.MaxFrameSize))
+	v.compression = newCompression(&v.Compression)
+	if v.MaxDecompressedBodySize < 1 {
+		v.MaxDecompressedBodySize = v.MaxRequestBodySize
+	}
+	return v
+}
+
+// getAllHeaderFold is like Header.GetAll, but the name is case-insensitive,
+// clients send both `HTTP2-Settings` and `Http2-Settings`.
+func getAllHeaderFold(header *Header, name string) [][]byte {
+	var rv [][]byte
+	header.EachItem(func(item *utils.KvItem) bool {
+		if strings.EqualFold(utils.S(item.Key), name) {
+			rv = append(rv, item.Val)
+		}
+		return true
+	})
+	return rv
+}
+
+// isH2cUpgrade reports whether the http/1.1 request asks to upgrade to http2 over cleartext tcp, RFC 7540 3.2.
+func isH2cUpgrade(ctx *RequestCtx) bool {
+	header := &ctx.Request.Header
+	upgrade, ok := header.Get(HeaderUpgrade)
+	if !ok || string(inPlaceLowercase(upgrade)) != "h2c" {
+		return false
+	}
+	if len(getAllHeaderFold(header, HeaderHTTP2Settings)) != 1 {
+		return false
+	}
+	var hasUpgrade, hasSettings bool
+	for _, v := range header.GetAll(HeaderConnection) {
+		for _, token := range bytes.Split(v, []byte(",")) {
+			switch string(inPlaceLowercase(utils.InplaceTrimAsciiSpace(token))) {
+			case "upgrade":
+				hasUpgrade = true
+			case "http2-settings":
+				hasSettings = true
+			}
+		}
+	}
+	return hasUpgrade && hasSettings
+}
+
+var h2cSwitchingProtocolsResponse = []byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+
+// upgradeH2c switches the http/1.1 connection to http2, the request is served as the stream 1.
+// r contains the data buffered by the http/1.1 protocol.
+func (protocol *_Http2Protocol) upgradeH2c(ctx context.Context, conn net.Conn, r io.Reader, rctx *RequestCtx) {
+	if _, err := conn.Write(h2cSwitchingProtocolsResponse); err != nil {
+		return
+	}
+	_ = conn.SetReadDeadline(zeroTime)
+	protocol.serve(ctx, conn, r, rctx)
+}
+
+// _PeekedConn is a connection that some data is already read into the reader.
+type _PeekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *_PeekedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// ReadFrom keeps the sendfile of the underlying connection, only the read side is buffered.
+func (c *_PeekedConn) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(_WriterOnly{c}, r)
+}
+
+// peekHttp2Preface reads the beginning of the connection and reports whether it is a http2 client preface.
+func peekHttp2Preface(r *bufio.Reader) bool {
+	for i := 1; i <= len(http2ClientPreface); i++ {
+		data, err := r.Peek(i)
+		if err != nil || data[i-1] != http2ClientPreface[i-1] {
+			return false
+		}
+	}
+	return true
+}
+
+func init() {
+	serverPrepareFunc = append(
+		serverPrepareFunc,
+		func(server *Server) {
+			hp, ok := server.http2Protocol.(*_Http2Protocol)
+			if ok {
+				hp.server = server
+			}
+		},
+	)
+}
+
+const (
+	http2Str           = "HTTP/2.0"
+	http2ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+	http2DefaultWindow = 65535
+	http2MaxWindow     = 1<<31 - 1
+)
+
+type _Http2Conn struct {
+	protocol *_Http2Protocol
+	server   *Server
+	conn     net.Conn
+	ctx      context.Context
+	framer   *http2.Framer
+	bw       *bufio.Writer
+
+	// writing and the fields below are protected by mutex
+	mutex            sync.Mutex
+	cond             *sync.Cond
+	hpackEncoder     *hpack.Encoder
+	hpackBuf         bytes.Buffer
+	streams          map[uint32]*_Http2Stream
+	lastStreamID     uint32
+	sendWindow       int32
+	recvWindow       int32 // the window advertised to the client
+	peerWindowSize   int32
+	peerMaxFrameSize uint32
+	goAway           bool
+	closed           bool
+
+	wg sync.WaitGroup
+}
+
+func (protocol *_Http2Protocol) newConn(ctx context.Context, conn net.Conn, r io.Reader) *_Http2Conn {
+	hc := &_Http2Conn{
+		protocol:         protocol,
+		server:           protocol.server,
+		conn:             conn,
+		ctx:              ctx,
+		streams:          map[uint32]*_Http2Stream{},
+		sendWindow:       http2DefaultWindow,
+		recvWindow:       http2DefaultWindow,
+		peerWindowSize:   http2DefaultWindow,
+		peerMaxFrameSize: 16384,
+	}
+	hc.cond = sync.NewCond(&hc.mutex)
+	hc.bw = bufio.NewWriterSize(conn, protocol.WriteBufferSize)
+	hc.framer = http2.NewFramer(hc.bw, r)
+	hc.framer.SetMaxReadFrameSize(protocol.MaxFrameSize)
+	hc.framer.MaxHeaderListSize = protocol.MaxHeaderListSize
+	hc.framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	hc.hpackEncoder = hpack.NewEncoder(&hc.hpackBuf)
+	return hc
+}
+
+func (protocol *_Http2Protocol) ServeHTTPConn(ctx context.Context, conn net.Conn) {
+	protocol.serve(ctx, conn, conn, nil)
+}
+
+// serve reads the client preface from r, and serves the http2 connection.
+// upgradeReq is the http/1.1 request with `Upgrade: h2c`, which is served as the stream 1.
+func (protocol *_Http2Protocol) serve(ctx context.Context, conn net.Conn, r io.Reader, upgradeReq *RequestCtx) {
+	preface := make([]byte, len(http2ClientPreface))
+	if _, err := io.ReadFull(r, preface); err != nil || string(preface) != http2ClientPreface {
+		return
+	}
+
+	hc := protocol.newConn(ctx, conn, r)
+	defer hc.close()
+
+	settings := []http2.Setting{
+		{ID: http2.SettingMaxConcurrentStreams, Val: protocol.MaxConcurrentStreams},
+		{ID: http2.SettingInitialWindowSize, Val: protocol.InitialWindowSize},
+		{ID: http2.SettingMaxFrameSize, Val: protocol.MaxFrameSize},
+		{ID: http2.SettingMaxHeaderListSize, Val: protocol.MaxHeaderListSize},
+	}
+	hc.mutex.Lock()
+	err := hc.framer.WriteSettings(settings...)
+	if err == nil {
+		err = hc.bw.Flush()
+	}
+	hc.mutex.Unlock()
+	if err != nil {
+		return
+	}
+
+	hc.server.setConnShutdownHook(conn, hc.onServerShutdown)
+	// no new streams after the lifetime, the open ones are served
+	if lifetime := hc.server.option.MaxConnectionKeepAlive.Duration; lifetime > 0 {
+		timer := time.AfterFunc(lifetime-time.Since(hc.server.connAcceptTime(conn)), hc.onServerShutdown)
+		defer timer.Stop()
+	}
+
+	if upgradeReq != nil {
+		settingsPayload, _ := base64.RawURLEncoding.DecodeString(
+			strings.TrimRight(string(getAllHeaderFold(&upgradeReq.Request.Header, HeaderHTTP2Settings)[0]), "="),
+		)
+		rctx := hc.newRequestCtx()
+		copyUpgradeRequest(rctx, upgradeReq)
+
+		hc.mutex.Lock()
+		for i := 0; i+6 <= len(settingsPayload); i += 6 {
+			err = hc.applySetting(
+				http2.Setting{
+					ID:  http2.SettingID(binary.BigEndian.Uint16(settingsPayload[i:])),
+					Val: binary.BigEndian.Uint32(settingsPayload[i+2:]),
+				},
+			)
+			if err != nil {
+				break
+			}
+		}
+		hc.lastStreamID = 1
+		stream := hc.newStream(1, rctx)
+		stream.remoteClosed = true
+		hc.mutex.Unlock()
+		if err != nil {
+			hc.writeGoAway(http2.ErrCodeProtocol)
+			return
+		}
+		hc.dispatch(stream)
+	}
+
+	hc.readLoop()
+}
+
+func (hc *_Http2Conn) readLoop() {
+	idleTimeout := hc.server.option.IdleTimeout.Duration
+
+	for {
+		if idleTimeout > 0 {
+			hc.mutex.Lock()
+			idle := len(hc.streams) == 0
+			hc.mutex.Unlock()
+			if idle {
+				_ = hc.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+			} else {
+				_ = hc.conn.SetReadDeadline(zeroTime)
+			}
+		}
+
+		frame, err := hc.framer.ReadFrame()
+		if err != nil {
+			switch e := err.(type) {
+			case http2.StreamError:
+				hc.resetStream(e.StreamID, e.Code)
+				continue
+			case http2.ConnectionError:
+				hc.writeGoAway(http2.ErrCode(e))
+			}
+			return
+		}
+
+		switch f := frame.(type) {
+		case *http2.SettingsFrame:
+			err = hc.onSettings(f)
+		case *http2.MetaHeadersFrame:
+			err = hc.onHeaders(f)
+		case *http2.DataFrame:
+			err = hc.onData(f)
+		case *http2.WindowUpdateFrame:
+			err = hc.onWindowUpdate(f)
+		case *http2.PingFrame:
+			if !f.IsAck() {
+				hc.mutex.Lock()
+				err = hc.framer.WritePing(true, f.Data)
+				if err == nil {
+					err = hc.bw.Flush()
+				}
+				hc.mutex.Unlock()
+			}
+		case *http2.RSTStreamFrame:
+			hc.abortStream(f.StreamID)
+		case *http2.GoAwayFrame:
+			hc.mutex.Lock()
+			hc.goAway = true
+			idle := len(hc.streams) == 0
+			hc.mutex.Unlock()
+			if idle {
+				return
+			}
+		case *http2.PushPromiseFrame:
+			err = http2.ConnectionError(http2.ErrCodeProtocol)
+		}
+
+		if err != nil {
+			if ce, ok := err.(http2.ConnectionError); ok {
+				hc.writeGoAway(http2.ErrCode(ce))
+			}
+			return
+		}
+	}
+}
+
+// applySetting must be called with the mutex locked
+func (hc *_Http2Conn) applySetting(setting http2.Setting) error {
+	if err := setting.Valid(); err != nil {
+		return err
+	}
+	switch setting.ID {
+	case http2.SettingHeaderTableSize:
+		hc.hpackEncoder.SetMaxDynamicTableSize(setting.Val)
+	case http2.SettingInitialWindowSize:
+		delta := int32(setting.Val) - hc.peerWindowSize
+		for _, stream := range hc.streams {
+			if int64(stream.sendWindow)+int64(delta) > http2MaxWindow {
+				return http2.ConnectionError(http2.ErrCodeFlowControl)
+			}
+			stream.sendWindow += delta
+		}
+		hc.peerWindowSize = int32(setting.Val)
+	case http2.SettingMaxFrameSize:
+		hc.peerMaxFrameSize = setting.Val
+	}
+	return nil
+}
+
+func (hc *_Http2Conn) onSettings(f *http2.SettingsFrame) error {
+	if f.IsAck() {
+		return nil
+	}
+
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	if err := f.ForeachSetting(hc.applySetting); err != nil {
+		return err
+	}
+	hc.cond.Broadcast()
+
+	if err := hc.framer.WriteSettingsAck(); err != nil {
+		return err
+	}
+	return hc.bw.Flush()
+}
+
+func (hc *_Http2Conn) onWindowUpdate(f *http2.WindowUpdateFrame) error {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	if f.StreamID == 0 {
+		if int64(hc.sendWindow)+int64(f.Increment) > http2MaxWindow {
+			return http2.ConnectionError(http2.ErrCodeFlowControl)
+		}
+		hc.sendWindow += int32(f.Increment)
+	} else {
+		stream := hc.streams[f.StreamID]
+		if stream == nil {
+			return nil
+		}
+		if int64(stream.sendWindow)+int64(f.Increment) > http2MaxWindow {
+			hc.writeRSTStream(f.StreamID, http2.ErrCodeFlowControl)
+			stream.abort()
+			return nil
+		}
+		stream.sendWindow += int32(f.Increment)
+	}
+	hc.cond.Broadcast()
+	return nil
+}
+
+func (hc *_Http2Conn) onHeaders(f *http2.MetaHeadersFrame) error {
+	id := f.StreamID
+
+	hc.mutex.Lock()
+	stream := hc.streams[id]
+	if stream != nil { // trailers
+		hc.mutex.Unlock()
+		if stream.remoteClosed {
+			return http2.ConnectionError(http2.ErrCodeStreamClosed)
+		}
+		if !f.StreamEnded() || !stream.bodyLengthMatched(true) {
+			hc.resetStream(id, http2.ErrCodeProtocol)
+			return nil
+		}
+		for _, field := range f.RegularFields() {
+			stream.rctx.Request.Trailers.AppendBytes(canonicalHeaderKey(field.Name), utils.B(field.Value))
+		}
+		stream.remoteClosed = true
+		if stream.body != nil {
+			stream.body.close(io.EOF)
+		}
+		hc.dispatch(stream)
+		return nil
+	}
+
+	if id%2 != 1 || id <= hc.lastStreamID {
+		hc.mutex.Unlock()
+		return http2.ConnectionError(http2.ErrCodeProtocol)
+	}
+	hc.lastStreamID = id
+	if hc.goAway {
+		hc.mutex.Unlock()
+		return nil
+	}
+	if uint32(len(hc.streams)) >= hc.protocol.MaxConcurrentStreams {
+		hc.writeRSTStream(id, http2.ErrCodeRefusedStream)
+		hc.mutex.Unlock()
+		return nil
+	}
+
+	rctx := hc.newRequestCtx()
+	stream = hc.newStream(id, rctx)
+	hc.mutex.Unlock()
+
+	if f.Truncated {
+		stream.remoteClosed = f.StreamEnded()
+		stream.respondError(ErrRequestHeaderFieldsTooLarge)
+		return nil
+	}
+	if err := stream.readRequestHeaders(f); err != nil {
+		stream.remoteClosed = f.StreamEnded()
+		stream.respondError(err)
+		return nil
+	}
+
+	if f.StreamEnded() {
+		if !stream.bodyLengthMatched(true) {
+			hc.resetStream(id, http2.ErrCodeProtocol)
+			return nil
+		}
+		stream.remoteClosed = true
+		hc.dispatch(stream)
+	} else if stream.rctx.bodyStreamed {
+		stream.body = newHttp2BodyPipe(stream)
+		stream.rctx.bodyStream = stream.body
+		hc.dispatch(stream)
+	}
+	return nil
+}
+
+func (hc *_Http2Conn) onData(f *http2.DataFrame) error {
+	id := f.StreamID
+	size := f.Length
+
+	hc.mutex.Lock()
+	stream := hc.streams[id]
+	// the frames of the closed streams are counted by the connection window only, RFC 9113 6.9.1
+	if int64(size) > int64(hc.recvWindow) || (stream != nil && int64(size) > int64(stream.recvWindow)) {
+		hc.mutex.Unlock()
+		return http2.ConnectionError(http2.ErrCodeFlowControl)
+	}
+	hc.recvWindow -= int32(size)
+	if stream != nil {
+		stream.recvWindow -= int32(size)
+	}
+	if size > 0 { // the data is consumed immediately, so give back the flow-control window
+		_ = hc.framer.WriteWindowUpdate(0, size)
+		hc.recvWindow += int32(size)
+		if stream != nil && !f.StreamEnded() {
+			if stream.body == nil {
+				_ = hc.framer.WriteWindowUpdate(id, size)
+				stream.recvWindow += int32(size)
+			} else if padding := size - uint32(len(f.Data())); padding > 0 {
+				// the window of the streamed data is given back after it is read by the handler
+				_ = hc.framer.WriteWindowUpdate(id, padding)
+				stream.recvWindow += int32(padding)
+			}
+		}
+		if err := hc.bw.Flush(); err != nil {
+			hc.mutex.Unlock()
+			return err
+		}
+	}
+	hc.mutex.Unlock()
+
+	if stream == nil || stream.remoteClosed {
+		if id > hc.lastStreamID {
+			return http2.ConnectionError(http2.ErrCodeProtocol)
+		}
+		hc.resetStream(id, http2.ErrCodeStreamClosed)
+		return nil
+	}
+	rctx := stream.rctx
+	data := f.Data()
+	stream.received += len(data)
+	if !stream.bodyLengthMatched(f.StreamEnded()) {
+		hc.resetStream(id, http2.ErrCodeProtocol)
+		return nil
+	}
+	if stream.body != nil {
+		if !stream.body.write(data, f.StreamEnded()) {
+			hc.resetStream(id, http2.ErrCodeFlowControl)
+			return nil
+		}
+		stream.remoteClosed = f.StreamEnded()
+		return nil
+	}
+	if len(rctx.buf)+len(data) > hc.protocol.MaxRequestBodySize {
+		stream.remoteClosed = f.StreamEnded()
+		stream.respondError(ErrRequestEntityTooLarge)
+		return nil
+	}
+	rctx.buf = append(rctx.buf, data...)
+
+	if f.StreamEnded() {
+		stream.remoteClosed = true
+		hc.dispatch(stream)
+	}
+	return nil
+}
+
+func (hc *_Http2Conn) newRequestCtx() *RequestCtx {
+	rctx := acquireRequestCtx()
+	rctx.isTLS = hc.server.isTls
+	rctx.compression = hc.protocol.compression
+	rctx.conn = hc.conn
+	rctx.connTime = hc.server.connAcceptTime(hc.conn)
+	rctx.Response.bodyBuf = hc.protocol.resBodyBufferPool.Get()
+	return rctx
+}
+
+// newStream must be called with the mutex locked
+func (hc *_Http2Conn) newStream(id uint32, rctx *RequestCtx) *_Http2Stream {
+	stream := &_Http2Stream{
+		id: id, hc: hc, rctx: rctx, sendWindow: hc.peerWindowSize, recvWindow: hc.protocol.initialRecvWindow(), contentLength: -1,
+	}
+	rctx.ctx, stream.cancel = context.WithCancel(hc.ctx)
+	rctx.streamer = stream
+	hc.server.countConnRequest(hc.conn)
+	if len(hc.streams) == 0 {
+		hc.server.setConnState(hc.conn, ConnStateActive)
+	}
+	hc.streams[id] = stream
+	return stream
+}
+
+func (hc *_Http2Conn) dispatch(stream *_Http2Stream) {
+	if stream.dispatched {
+		return
+	}
+	stream.dispatched = true
+	hc.wg.Add(1)
+	go func() {
+		defer hc.wg.Done()
+		stream.serve()
+	}()
+}
+
+func (hc *_Http2Conn) closeStream(stream *_Http2Stream) {
+	hc.mutex.Lock()
+	delete(hc.streams, stream.id)
+	idle := len(hc.streams) == 0
+	goAway := hc.goAway
+	hc.mutex.Unlock()
+
+	stream.cancel()
+	if idle {
+		hc.server.setConnState(hc.conn, ConnStateIdle)
+		if goAway {
+			_ = hc.conn.Close()
+		}
+	}
+}
+
+// writeRSTStream must be called with the mutex locked
+func (hc *_Http2Conn) writeRSTStream(id uint32, code http2.ErrCode) {
+	if hc.framer.WriteRSTStream(id, code) == nil {
+		_ = hc.bw.Flush()
+	}
+}
+
+func (hc *_Http2Conn) resetStream(id uint32, code http2.ErrCode) {
+	hc.mutex.Lock()
+	hc.writeRSTStream(id, code)
+	hc.mutex.Unlock()
+	hc.abortStream(id)
+}
+
+// abortStream aborts the stream reset by either side, the stream that is not dispatched is released here,
+// otherwise it keeps a slot of MaxConcurrentStreams forever.
+func (hc *_Http2Conn) abortStream(id uint32) {
+	hc.mutex.Lock()
+	stream := hc.streams[id]
+	if stream != nil {
+		stream.abort()
+	}
+	hc.mutex.Unlock()
+
+	if stream != nil && !stream.dispatched {
+		hc.closeStream(stream)
+		hc.releaseRequestCtx(stream.rctx)
+	}
+}
+
+func (hc *_Http2Conn) writeGoAway(code http2.ErrCode) {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	hc.goAway = true
+	if hc.framer.WriteGoAway(hc.lastStreamID, code, nil) == nil {
+		_ = hc.bw.Flush()
+	}
+}
+
+// onServerShutdown tells the client to stop creating streams, the connection is closed after the active streams are done.
+func (hc *_Http2Conn) onServerShutdown() {
+	hc.writeGoAway(http2.ErrCodeNo)
+
+	hc.mutex.Lock()
+	idle := len(hc.streams) == 0
+	hc.mutex.Unlock()
+	if idle {
+		_ = hc.conn.Close()
+	}
+}
+
+// releaseRequestCtx puts the body buffer back after the reset, which truncates it.
+func (hc *_Http2Conn) releaseRequestCtx(rctx *RequestCtx) {
+	bodyBuf := rctx.Response.bodyBuf
+	ReleaseRequestCtx(rctx)
+	hc.protocol.resBodyBufferPool.Put(bodyBuf)
+}
+
+func (hc *_Http2Conn) close() {
+	_ = hc.conn.Close() // unblock the handlers writing to the connection
+	hc.mutex.Lock()
+	hc.closed = true
+	var pending []*_Http2Stream
+	for _, stream := range hc.streams {
+		stream.abort()
+		if !stream.dispatched {
+			pending = append(pending, stream)
+		}
+	}
+	hc.cond.Broadcast()
+	hc.mutex.Unlock()
+
+	for _, stream := range pending {
+		hc.closeStream(stream)
+		hc.releaseRequestCtx(stream.rctx)
+	}
+	hc.wg.Wait()
+}
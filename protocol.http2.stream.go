@@ -0,0 +1,399 @@
+package sha
+
+import (
+	"bytes"
+	"errors"
+	"github.com/zzztttkkk/sha/utils"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+	"strconv"
+	"strings"
+)
+
+type _Http2Stream struct {
+	id     uint32
+	hc     *_Http2Conn
+	rctx   *RequestCtx
+	cancel func()
+
+	// owned by the read loop
+	remoteClosed  bool
+	dispatched    bool
+	body          *_Http2BodyPipe // the streamed request body, it is dispatched before the body is received
+	contentLength int             // the declared content-length, -1 if it is absent
+	received      int             // the DATA payload received, padding excluded
+
+	// protected by hc.mutex
+	sendWindow int32
+	recvWindow int32
+	reset      bool
+}
+
+var ErrHttp2StreamClosed = errors.New("sha.http2: stream closed")
+
+// abort must be called with hc.mutex locked
+func (stream *_Http2Stream) abort() {
+	stream.reset = true
+	stream.cancel()
+	if stream.body != nil {
+		stream.body.close(ErrHttp2StreamClosed)
+	}
+	stream.hc.cond.Broadcast()
+}
+
+// bodyLengthMatched reports whether the received DATA payload is consistent with the declared content-length,
+// the request is malformed if it overshoots, or falls short at the end of the stream, RFC 9113 8.1.1.
+func (stream *_Http2Stream) bodyLengthMatched(ended bool) bool {
+	if stream.contentLength < 0 {
+		return true
+	}
+	if ended {
+		return stream.received == stream.contentLength
+	}
+	return stream.received <= stream.contentLength
+}
+
+var http2ConnectionSpecificHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+var cookieSep = []byte("; ")
+
+func (stream *_Http2Stream) readRequestHeaders(f *http2.MetaHeadersFrame) HttpError {
+	rctx := stream.rctx
+	req := &rctx.Request
+
+	var authority string
+	for _, field := range f.PseudoFields() {
+		switch field.Name {
+		case ":method":
+			req.Method = append(req.Method, field.Value...)
+		case ":path":
+			req.RawPath = append(req.RawPath, field.Value...)
+		case ":authority":
+			authority = field.Value
+		}
+	}
+	if len(req.Method) < 1 || (string(req.Method) != MethodConnect && len(req.RawPath) < 1) {
+		return ErrBadConnection
+	}
+
+	var cookie []byte
+	for _, field := range f.RegularFields() {
+		if http2ConnectionSpecificHeaders[field.Name] {
+			return ErrBadConnection
+		}
+		switch field.Name {
+		case "te":
+			if field.Value != "trailers" {
+				return ErrBadConnection
+			}
+		case "cookie": // the cookie header may be split into multiple fields, RFC 7540 8.1.2.5
+			if len(cookie) > 0 {
+				cookie = append(cookie, cookieSep...)
+			}
+			cookie = append(cookie, field.Value...)
+			continue
+		}
+		req.Header.AppendBytes(canonicalHeaderKey(field.Name), utils.B(field.Value))
+	}
+	if len(cookie) > 0 {
+		req.Header.AppendBytes(canonicalHeaderKey("cookie"), cookie)
+	}
+	if _, ok := req.Header.Get(HeaderHost); !ok && len(authority) > 0 {
+		req.Header.Append(HeaderHost, utils.B(authority))
+	}
+
+	cls := req.Header.GetAll(HeaderContentLength)
+	if len(cls) > 1 || (len(cls) == 1 && !isDigits(cls[0])) {
+		return ErrBadConnection
+	}
+	rctx.bodySize = req.Header.ContentLength()
+	stream.contentLength = rctx.bodySize
+	prepareHttp2Request(rctx)
+	if stream.hc.server.streamsRequestBody(rctx) {
+		rctx.bodyStreamed = true
+		rctx.maxBodySize = stream.hc.protocol.MaxRequestBodySize
+		req.bodyBufferPtr = nil
+	} else if rctx.bodySize > stream.hc.protocol.MaxRequestBodySize {
+		return ErrRequestEntityTooLarge
+	}
+	return nil
+}
+
+func prepareHttp2Request(rctx *RequestCtx) { prepareRequest(rctx, http2Str) }
+
+// prepareRequest prepares a request that is not parsed by the http/1.1 protocol.
+func prepareRequest(rctx *RequestCtx, version string) {
+	req := &rctx.Request
+	req.version = append(req.version[:0], version...)
+	if ind := bytes.IndexByte(req.RawPath, '?'); ind > -1 {
+		req.gotQuestionMark = true
+		req.questionMarkIndex = ind + 1
+	} else {
+		req.questionMarkIndex = len(req.RawPath)
+	}
+	initRequest(rctx)
+}
+
+// copyUpgradeRequest copies the http/1.1 request with `Upgrade: h2c` to dst, as the stream 1.
+func copyUpgradeRequest(dst, src *RequestCtx) {
+	req := &dst.Request
+	req.Method = append(req.Method, src.Request.Method...)
+	req.RawPath = append(req.RawPath, src.Request.RawPath...)
+	src.Request.Header.EachItem(func(item *utils.KvItem) bool {
+		if !http2ConnectionSpecificHeaders[strings.ToLower(utils.S(item.Key))] && !strings.EqualFold(utils.S(item.Key), HeaderHTTP2Settings) {
+			req.Header.AppendBytes(item.Key, item.Val)
+		}
+		return true
+	})
+	dst.buf = append(dst.buf, src.buf...)
+	dst.bodySize = len(dst.buf)
+	prepareHttp2Request(dst)
+}
+
+func (stream *_Http2Stream) serve() {
+	hc := stream.hc
+	rctx := stream.rctx
+	defer func() {
+		hc.closeStream(stream)
+		hc.releaseRequestCtx(rctx)
+	}()
+
+	if hc.protocol.DecompressRequestBody && !rctx.bodyStreamed {
+		if err := rctx.decompressBody(hc.protocol.MaxDecompressedBodySize); err != nil {
+			rctx.Response.statusCode = err.StatusCode()
+			if err := stream.finish(); err != nil && err != ErrHttp2StreamClosed {
+				_ = hc.conn.Close()
+			}
+			return
+		}
+	}
+	if hc.protocol.AutoCompression {
+		rctx.AutoCompress()
+	}
+	hc.server.Handler.Handle(rctx)
+
+	if err := stream.finish(); err != nil && err != ErrHttp2StreamClosed {
+		_ = hc.conn.Close()
+		return
+	}
+	if stream.body != nil && !stream.body.done() {
+		// tell the client to stop sending the rest of the body
+		hc.mutex.Lock()
+		if !hc.closed && !stream.reset && hc.framer.WriteRSTStream(stream.id, http2.ErrCodeNo) == nil {
+			_ = hc.bw.Flush()
+		}
+		hc.mutex.Unlock()
+	}
+}
+
+// respondError sends the error status without calling the handler, it is called in the read loop.
+func (stream *_Http2Stream) respondError(err HttpError) {
+	hc := stream.hc
+	stream.dispatched = true
+	stream.rctx.Response.statusCode = err.StatusCode()
+
+	hc.mutex.Lock()
+	if stream.writeHeaders(true) == nil && !stream.remoteClosed {
+		// tell the client to stop sending the request body
+		_ = hc.framer.WriteRSTStream(stream.id, http2.ErrCodeNo)
+	}
+	_ = hc.bw.Flush()
+	hc.mutex.Unlock()
+
+	hc.closeStream(stream)
+	hc.releaseRequestCtx(stream.rctx)
+}
+
+// writeHeaders must be called with hc.mutex locked
+func (stream *_Http2Stream) writeHeaders(endStream bool) error {
+	hc := stream.hc
+	res := &stream.rctx.Response
+	if hc.closed || stream.reset {
+		return ErrHttp2StreamClosed
+	}
+
+	if res.statusCode < 1 {
+		res.statusCode = 200
+	}
+	if len(statusTextMap[res.statusCode]) < 1 {
+		return ErrUnknownResponseStatusCode
+	}
+
+	hc.hpackBuf.Reset()
+	_ = hc.hpackEncoder.WriteField(hpack.HeaderField{Name: ":status", Value: strconv.FormatInt(int64(res.statusCode), 10)})
+	res.Header.EachItem(func(item *utils.KvItem) bool {
+		name := strings.ToLower(utils.S(item.Key))
+		if !http2ConnectionSpecificHeaders[name] {
+			_ = hc.hpackEncoder.WriteField(hpack.HeaderField{Name: name, Value: string(item.Val)})
+		}
+		return true
+	})
+
+	block := hc.hpackBuf.Bytes()
+	first := true
+	for first || len(block) > 0 {
+		size := len(block)
+		if size > int(hc.peerMaxFrameSize) {
+			size = int(hc.peerMaxFrameSize)
+		}
+		fragment := block[:size]
+		block = block[size:]
+
+		var err error
+		if first {
+			err = hc.framer.WriteHeaders(
+				http2.HeadersFrameParam{
+					StreamID:      stream.id,
+					BlockFragment: fragment,
+					EndStream:     endStream,
+					EndHeaders:    len(block) == 0,
+				},
+			)
+		} else {
+			err = hc.framer.WriteContinuation(stream.id, len(block) == 0, fragment)
+		}
+		if err != nil {
+			return err
+		}
+		first = false
+	}
+	return nil
+}
+
+// writeData must be called with hc.mutex locked, it waits for the flow-control windows.
+func (stream *_Http2Stream) writeData(p []byte, endStream bool) error {
+	hc := stream.hc
+
+	for len(p) > 0 {
+		for !hc.closed && !stream.reset && (hc.sendWindow <= 0 || stream.sendWindow <= 0) {
+			// the buffered frames must reach the client, otherwise it never gives back the window
+			if hc.bw.Buffered() > 0 {
+				if err := hc.bw.Flush(); err != nil {
+					return err
+				}
+			}
+			hc.cond.Wait()
+		}
+		if hc.closed || stream.reset {
+			return ErrHttp2StreamClosed
+		}
+
+		size := len(p)
+		if size > int(hc.sendWindow) {
+			size = int(hc.sendWindow)
+		}
+		if size > int(stream.sendWindow) {
+			size = int(stream.sendWindow)
+		}
+		if size > int(hc.peerMaxFrameSize) {
+			size = int(hc.peerMaxFrameSize)
+		}
+
+		if err := hc.framer.WriteData(stream.id, endStream && size == len(p), p[:size]); err != nil {
+			return err
+		}
+		hc.sendWindow -= int32(size)
+		stream.sendWindow -= int32(size)
+		p = p[size:]
+		if endStream && len(p) == 0 {
+			return nil
+		}
+	}
+
+	if endStream {
+		if hc.closed || stream.reset {
+			return ErrHttp2StreamClosed
+		}
+		return hc.framer.WriteData(stream.id, true, nil)
+	}
+	return nil
+}
+
+func (stream *_Http2Stream) streamBufferSize() int { return int(stream.hc.protocol.MaxFrameSize) }
+
+func (stream *_Http2Stream) flushResponse(ctx *RequestCtx) error {
+	hc := stream.hc
+	res := &ctx.Response
+
+	if !res.headerSent {
+		ctx.prepareCompression(true)
+	}
+	if res.compressWriter != nil {
+		if err := res.compressWriter.Flush(); err != nil {
+			return err
+		}
+	}
+
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	if !res.headerSent {
+		res.headerSent = true
+		res.Header.Del(HeaderContentLength)
+		if err := stream.writeHeaders(false); err != nil {
+			return err
+		}
+	}
+
+	data := res.bodyBuf.Data
+	res.bodyBuf.Data = data[:0]
+	if ctx.Request._method != _MHead {
+		if err := stream.writeData(data, false); err != nil {
+			return err
+		}
+	}
+	return hc.bw.Flush()
+}
+
+func (stream *_Http2Stream) finish() error {
+	hc := stream.hc
+	ctx := stream.rctx
+	res := &ctx.Response
+
+	if !res.headerSent {
+		ctx.prepareCompression(false)
+	}
+	if res.bodyFile != nil {
+		if err := ctx.writeBodyFile(); err != nil {
+			return err
+		}
+	}
+
+	if res.compressWriter != nil {
+		if err := res.compressWriter.Close(); err != nil {
+			return err
+		}
+	}
+
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+
+	data := res.bodyBuf.Data
+	if ctx.Request._method == _MHead {
+		data = nil
+	}
+
+	var err error
+	if !res.headerSent {
+		res.headerSent = true
+		if len(res.bodyBuf.Data) > 0 || !res.keepContentLength {
+			res.Header.SetContentLength(int64(len(res.bodyBuf.Data)))
+		}
+		err = stream.writeHeaders(len(data) == 0)
+		if err == nil && len(data) > 0 {
+			err = stream.writeData(data, true)
+		}
+	} else {
+		err = stream.writeData(data, true)
+	}
+	if err != nil {
+		return err
+	}
+	return hc.bw.Flush()
+}
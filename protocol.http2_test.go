@@ -0,0 +1,383 @@
+package sha
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+func startTestH2cServer(t *testing.T, handler RequestHandler) string {
+	opt := ServerOption{Addr: "127.0.0.1:0"}
+	s := New(nil, &opt, nil, nil)
+	s.Handler = handler
+	s.EnableHTTP2(&HTTP2Option{H2C: true})
+	return serveTestServer(t, s)
+}
+
+func TestHttp2Protocol_PriorKnowledge(t *testing.T) {
+	addr := startTestH2cServer(t, RequestHandlerFunc(func(ctx *RequestCtx) {
+		_, _ = ctx.WriteString(string(ctx.Request.Method))
+		_, _ = ctx.WriteString(" ")
+		_, _ = ctx.Write(ctx.Request.Path)
+		_, _ = ctx.WriteString(" ")
+		_, _ = ctx.Write(ctx.buf)
+	}))
+
+	client := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := client.Post("http://"+addr+"/echo", "text/plain", strings.NewReader("hello"))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer res.Body.Close()
+			body, _ := io.ReadAll(res.Body)
+			if res.ProtoMajor != 2 || string(body) != "POST /echo hello" {
+				t.Errorf("bad response: %s %q", res.Proto, body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// http/1.1 still works on the same port
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("GET /h1 HTTP/1.1\r\nHost: a\r\n\r\n"))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != "GET /h1 " {
+		t.Fatalf("bad http/1.1 response: %q", body)
+	}
+}
+
+func TestHttp2Protocol_Upgrade(t *testing.T) {
+	addr := startTestH2cServer(t, RequestHandlerFunc(func(ctx *RequestCtx) {
+		_, _ = ctx.WriteString("upgraded ")
+		_, _ = ctx.Write(ctx.Request.Path)
+	}))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	settings := base64.RawURLEncoding.EncodeToString([]byte{0, 4, 0, 0, 0xff, 0xff})
+	_, _ = conn.Write([]byte(
+		"GET /up HTTP/1.1\r\nHost: a\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: " + settings + "\r\n\r\n",
+	))
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("bad status: %d", res.StatusCode)
+	}
+
+	_, _ = conn.Write([]byte(http2ClientPreface))
+	framer := http2.NewFramer(conn, r)
+	framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	_ = framer.WriteSettings()
+
+	var status string
+	var body bytes.Buffer
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch f := frame.(type) {
+		case *http2.MetaHeadersFrame:
+			if f.StreamID != 1 {
+				t.Fatalf("bad stream id: %d", f.StreamID)
+			}
+			status = f.PseudoValue("status")
+		case *http2.DataFrame:
+			body.Write(f.Data())
+			if f.StreamEnded() {
+				if status != "200" || body.String() != "upgraded /up" {
+					t.Fatalf("bad response: %s %q", status, body.String())
+				}
+				return
+			}
+		}
+	}
+}
+
+func TestHttp2Protocol_RapidReset(t *testing.T) {
+	opt := ServerOption{Addr: "127.0.0.1:0"}
+	s := New(nil, &opt, nil, nil)
+	s.Handler = RequestHandlerFunc(func(ctx *RequestCtx) { _, _ = ctx.WriteString("ok") })
+	s.EnableHTTP2(&HTTP2Option{H2C: true, MaxConcurrentStreams: 2})
+	addr := serveTestServer(t, s)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte(http2ClientPreface))
+	framer := http2.NewFramer(conn, conn)
+	framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	_ = framer.WriteSettings()
+
+	var block bytes.Buffer
+	encoder := hpack.NewEncoder(&block)
+	header := func() []byte {
+		block.Reset()
+		for _, v := range [][2]string{{":method", "POST"}, {":scheme", "http"}, {":authority", "a"}, {":path", "/"}} {
+			_ = encoder.WriteField(hpack.HeaderField{Name: v[0], Value: v[1]})
+		}
+		return block.Bytes()
+	}
+
+	// the streams reset before their bodies are sent must release their slots
+	id := uint32(1)
+	for ; id < 20; id += 2 {
+		_ = framer.WriteHeaders(http2.HeadersFrameParam{StreamID: id, BlockFragment: header(), EndHeaders: true})
+		_ = framer.WriteRSTStream(id, http2.ErrCodeCancel)
+	}
+	_ = framer.WriteHeaders(http2.HeadersFrameParam{StreamID: id, BlockFragment: header(), EndHeaders: true, EndStream: true})
+
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch f := frame.(type) {
+		case *http2.RSTStreamFrame:
+			t.Fatalf("the stream %d is reset: %v", f.StreamID, f.ErrCode)
+		case *http2.MetaHeadersFrame:
+			if f.StreamID != id || f.PseudoValue("status") != "200" {
+				t.Fatalf("bad response: %d %s", f.StreamID, f.PseudoValue("status"))
+			}
+			return
+		}
+	}
+}
+
+func TestHttp2Protocol_ContentLength(t *testing.T) {
+	addr := startTestH2cServer(t, RequestHandlerFunc(func(ctx *RequestCtx) { _, _ = ctx.Write(ctx.buf) }))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte(http2ClientPreface))
+	framer := http2.NewFramer(conn, conn)
+	framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	_ = framer.WriteSettings()
+
+	var block bytes.Buffer
+	encoder := hpack.NewEncoder(&block)
+	header := func() []byte {
+		block.Reset()
+		for _, v := range [][2]string{
+			{":method", "POST"}, {":scheme", "http"}, {":authority", "a"}, {":path", "/"}, {"content-length", "5"},
+		} {
+			_ = encoder.WriteField(hpack.HeaderField{Name: v[0], Value: v[1]})
+		}
+		return block.Bytes()
+	}
+
+	for i, c := range []struct {
+		data []string
+		code http2.ErrCode // 0 for a 200 response
+	}{
+		{[]string{}, http2.ErrCodeProtocol},
+		{[]string{"abc"}, http2.ErrCodeProtocol},
+		{[]string{"abc", "def"}, http2.ErrCodeProtocol},
+		{[]string{"hello!"}, http2.ErrCodeProtocol},
+		{[]string{"he", "llo"}, 0},
+	} {
+		id := uint32(2*i + 1)
+		_ = framer.WriteHeaders(http2.HeadersFrameParam{
+			StreamID: id, BlockFragment: header(), EndHeaders: true, EndStream: len(c.data) < 1,
+		})
+		for j, data := range c.data {
+			_ = framer.WriteData(id, j == len(c.data)-1, []byte(data))
+		}
+
+	read:
+		for {
+			frame, err := framer.ReadFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch f := frame.(type) {
+			case *http2.RSTStreamFrame:
+				if f.StreamID != id || f.ErrCode != c.code {
+					t.Fatalf("%d: unexpected reset: %d %v", i, f.StreamID, f.ErrCode)
+				}
+				break read
+			case *http2.MetaHeadersFrame:
+				if f.StreamID != id || c.code != 0 || f.PseudoValue("status") != "200" {
+					t.Fatalf("%d: unexpected response: %d %s", i, f.StreamID, f.PseudoValue("status"))
+				}
+				break read
+			}
+		}
+	}
+}
+
+func TestHttp2Protocol_SendWindow(t *testing.T) {
+	content := strings.Repeat("0123456789abcdef", 200*1024/16)
+	addr := startTestH2cServer(t, RequestHandlerFunc(func(ctx *RequestCtx) { _, _ = ctx.WriteString(content) }))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+	_, _ = conn.Write([]byte(http2ClientPreface))
+	framer := http2.NewFramer(conn, conn)
+	framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	// the frames smaller than the write buffer of the server are buffered
+	_ = framer.WriteSettings(http2.Setting{ID: http2.SettingInitialWindowSize, Val: 1000})
+
+	var block bytes.Buffer
+	encoder := hpack.NewEncoder(&block)
+	for _, v := range [][2]string{{":method", "GET"}, {":scheme", "http"}, {":authority", "a"}, {":path", "/"}} {
+		_ = encoder.WriteField(hpack.HeaderField{Name: v[0], Value: v[1]})
+	}
+	_ = framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block.Bytes(), EndHeaders: true, EndStream: true})
+
+	// the window is given back only after the data is read
+	var body []byte
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatalf("%d bytes received: %v", len(body), err)
+		}
+		f, ok := frame.(*http2.DataFrame)
+		if !ok {
+			continue
+		}
+		body = append(body, f.Data()...)
+		if f.StreamEnded() {
+			break
+		}
+		if n := uint32(len(f.Data())); n > 0 {
+			_ = framer.WriteWindowUpdate(0, n)
+			_ = framer.WriteWindowUpdate(1, n)
+		}
+	}
+	if string(body) != content {
+		t.Fatalf("bad body: %d", len(body))
+	}
+}
+
+// _StreamedBodyTestHandler streams the request body and never reads it.
+type _StreamedBodyTestHandler struct{ done chan struct{} }
+
+func (h _StreamedBodyTestHandler) Handle(ctx *RequestCtx) {
+	select {
+	case <-h.done:
+	case <-ctx.Done():
+	}
+}
+
+func (h _StreamedBodyTestHandler) streamsRequestBody(_ *RequestCtx) bool { return true }
+
+func TestHttp2Protocol_RecvWindow(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	open := func(handler RequestHandler, option *HTTP2Option) *http2.Framer {
+		s := New(nil, &ServerOption{Addr: "127.0.0.1:0"}, nil, nil)
+		s.Handler = handler
+		s.EnableHTTP2(option)
+		conn, err := net.Dial("tcp", serveTestServer(t, s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+		_, _ = conn.Write([]byte(http2ClientPreface))
+		framer := http2.NewFramer(conn, conn)
+		framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+		_ = framer.WriteSettings()
+
+		var block bytes.Buffer
+		encoder := hpack.NewEncoder(&block)
+		for _, v := range [][2]string{{":method", "POST"}, {":scheme", "http"}, {":authority", "a"}, {":path", "/"}} {
+			_ = encoder.WriteField(hpack.HeaderField{Name: v[0], Value: v[1]})
+		}
+		_ = framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block.Bytes(), EndHeaders: true})
+		return framer
+	}
+	expectFlowControlError := func(name string, framer *http2.Framer) {
+		for {
+			frame, err := framer.ReadFrame()
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			switch f := frame.(type) {
+			case *http2.GoAwayFrame:
+				if f.ErrCode != http2.ErrCodeFlowControl {
+					t.Fatalf("%s: unexpected goaway: %v", name, f.ErrCode)
+				}
+				return
+			case *http2.RSTStreamFrame:
+				t.Fatalf("%s: unexpected reset: %v", name, f.ErrCode)
+			}
+		}
+	}
+
+	// the data of a closed stream exceeds the window of the connection
+	framer := open(
+		RequestHandlerFunc(func(ctx *RequestCtx) {}),
+		&HTTP2Option{H2C: true, MaxFrameSize: 1 << 20, MaxRequestBodySize: 1 << 20},
+	)
+	_ = framer.WriteData(1, true, nil)
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f, ok := frame.(*http2.MetaHeadersFrame); ok && f.StreamEnded() {
+			break
+		}
+	}
+	_ = framer.WriteData(1, false, make([]byte, http2DefaultWindow+1))
+	expectFlowControlError("connection", framer)
+
+	// the streamed body is not read, so the window of the stream is not given back
+	framer = open(_StreamedBodyTestHandler{done: done}, &HTTP2Option{H2C: true})
+	for i := 0; i < 4; i++ {
+		_ = framer.WriteData(1, false, make([]byte, 16384))
+	}
+	expectFlowControlError("stream", framer)
+}
@@ -7,8 +7,10 @@ import (
 	"github.com/zzztttkkk/sha/utils"
 	"github.com/zzztttkkk/websocket"
 	"log"
+	"net"
 	"net/http"
 	"sync"
+	"time"
 )
 
 type WebSocketProtocolOption struct {
@@ -16,6 +18,12 @@ type WebSocketProtocolOption struct {
 	WriteBufferSize int      `json:"write_buffer_size" toml:"write-buffer-size"`
 	Subprotocols    []string `json:"subprotocols" toml:"subprotocols"`
 	Compression     bool     `json:"compression" toml:"compression"`
+
+	// IdleTimeout closes the connection if no data is received in this duration, 0 means twice of PingInterval.
+	// It applies to the reads of the handler, a handler that never reads the connection is not affected.
+	IdleTimeout utils.TomlDuration `json:"idle_timeout" toml:"idle-timeout"`
+	// PingInterval sends a ping message in this interval, the pong messages keep the connection alive, 0 means disabled.
+	PingInterval utils.TomlDuration `json:"ping_interval" toml:"ping-interval"`
 }
 
 var defaultWebSocketProtocolOption = WebSocketProtocolOption{
@@ -125,14 +133,73 @@ func (p *_WebSocketProtocol) Handshake(ctx *RequestCtx) bool {
 
 var websocketWriteBufferPool sync.Pool
 
+// _IdleTimeoutConn extends the read deadline before every read.
+type _IdleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *_IdleTimeoutConn) Read(p []byte) (int, error) {
+	_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+// _ClosedNotifyConn closes the done channel when the connection is closed.
+type _ClosedNotifyConn struct {
+	net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *_ClosedNotifyConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
 func (p *_WebSocketProtocol) Hijack(ctx *RequestCtx) *websocket.Conn {
 	req := &ctx.Request
-	ctx.hijacked = true
-	return websocket.NewConn(
-		ctx.conn, true, req.webSocketShouldDoCompression,
+	var conn net.Conn = ctx.hijackConn()
+	pingInterval := p.conf.PingInterval.Duration
+	idleTimeout := p.conf.IdleTimeout.Duration
+	if idleTimeout < 1 {
+		idleTimeout = pingInterval * 2
+	}
+	if idleTimeout > 0 {
+		conn = &_IdleTimeoutConn{Conn: conn, timeout: idleTimeout}
+	}
+
+	// the connection outlives the handler, so the pings are stopped when it is closed
+	var done chan struct{}
+	if pingInterval > 0 {
+		done = make(chan struct{})
+		conn = &_ClosedNotifyConn{Conn: conn, done: done}
+	}
+
+	wsc := websocket.NewConn(
+		conn, true, req.webSocketShouldDoCompression,
 		p.conf.ReadBufferSize, p.conf.WriteBufferSize,
 		&websocketWriteBufferPool, nil, nil,
 	)
+	if pingInterval > 0 {
+		go websocketPing(done, wsc, pingInterval)
+	}
+	return wsc
+}
+
+// websocketPing stops after the connection is closed or broken.
+func websocketPing(done <-chan struct{}, conn *websocket.Conn, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval)); err != nil {
+				return
+			}
+		}
+	}
 }
 
 type WebsocketHandlerFunc func(ctx context.Context, req *Request, conn *websocket.Conn, subProtocolName string)
@@ -0,0 +1,128 @@
+package sha
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zzztttkkk/sha/utils"
+	"github.com/zzztttkkk/websocket"
+)
+
+func startTestWebSocketServer(t *testing.T, opt ServerOption, wsOpt WebSocketProtocolOption) (*Server, string, chan error) {
+	closed := make(chan error, 4)
+	mux := NewMux(nil)
+	mux.Websocket("/ws", func(ctx context.Context, req *Request, conn *websocket.Conn, _ string) {
+		for {
+			typ, p, err := conn.ReadMessage()
+			if err != nil {
+				closed <- err
+				return
+			}
+			if err = conn.WriteMessage(typ, p); err != nil {
+				closed <- err
+				return
+			}
+		}
+	}, nil)
+
+	opt.Addr = "127.0.0.1:0"
+	s := New(nil, &opt, nil, NewWebSocketProtocol(&wsOpt))
+	s.Handler = mux
+	return s, serveTestServer(t, s), closed
+}
+
+func TestWebSocket_MaxConnectionKeepAlive(t *testing.T) {
+	s, addr, _ := startTestWebSocketServer(
+		t, ServerOption{MaxConnectionKeepAlive: utils.TomlDuration{Duration: time.Millisecond * 100}}, WebSocketProtocolOption{},
+	)
+	defer s.Shutdown(context.Background())
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(time.Millisecond * 300)
+	if err = conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, p, err := conn.ReadMessage(); err != nil || string(p) != "hello" {
+		t.Fatalf("%q %v", p, err)
+	}
+}
+
+func TestWebSocket_IdleTimeout(t *testing.T) {
+	s, addr, closed := startTestWebSocketServer(t, ServerOption{}, WebSocketProtocolOption{
+		PingInterval: utils.TomlDuration{Duration: time.Millisecond * 50},
+		IdleTimeout:  utils.TomlDuration{Duration: time.Millisecond * 150},
+	})
+	defer s.Shutdown(context.Background())
+
+	// the pings are answered by the default ping handler while reading
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	messages := make(chan string, 1)
+	go func() {
+		for {
+			_, p, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			messages <- string(p)
+		}
+	}()
+	time.Sleep(time.Millisecond * 500)
+	if err = conn.WriteMessage(websocket.TextMessage, []byte("alive")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-messages:
+		if msg != "alive" {
+			t.Fatalf("unexpected message: %q", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the answering connection is closed")
+	}
+
+	// the raw connection never answers the pings
+	raw, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	select {
+	case err = <-closed:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the idle connection is not closed")
+	}
+}
+
+func TestWebSocket_PingStopsAfterClose(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	conn := &_ClosedNotifyConn{Conn: server, done: done}
+	wsc := websocket.NewConn(conn, true, false, 0, 0, nil, nil, nil)
+
+	stopped := make(chan struct{})
+	go func() {
+		websocketPing(done, wsc, time.Hour)
+		close(stopped)
+	}()
+	_ = wsc.Close()
+	_ = wsc.Close()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the ping goroutine is not stopped after the connection is closed")
+	}
+}
@@ -0,0 +1,44 @@
+package sha
+
+import (
+	"github.com/zzztttkkk/sha/utils"
+)
+
+// _RequestBodyStreamer is a handler that reads the request body itself, e.g. the reverse proxy.
+// The body of its requests is not buffered by the protocols, so `HTTPOption.MaxRequestBodySize` is not applied by them,
+// the handler reads it from `RequestCtx.bodyStream` while the protocol is serving the request, and limits it itself.
+type _RequestBodyStreamer interface {
+	// streamsRequestBody is called after the request header is read.
+	streamsRequestBody(ctx *RequestCtx) bool
+}
+
+// _StreamedBodyHandler keeps the body streaming of a route, whose handler is wrapped by the middlewares.
+type _StreamedBodyHandler struct {
+	RequestHandler
+	streamer _RequestBodyStreamer
+}
+
+func (h *_StreamedBodyHandler) streamsRequestBody(ctx *RequestCtx) bool {
+	return h.streamer.streamsRequestBody(ctx)
+}
+
+func (s *Server) streamsRequestBody(ctx *RequestCtx) bool {
+	h, ok := s.Handler.(_RequestBodyStreamer)
+	return ok && h.streamsRequestBody(ctx)
+}
+
+// streamsRequestBody looks up the route without setting the url params.
+func (m *Mux) streamsRequestBody(ctx *RequestCtx) bool {
+	var tree *_RadixTree
+	if ctx.Request._method != 0 {
+		tree = m.stdTrees[ctx.Request._method]
+	} else {
+		tree = m.customTrees[utils.S(ctx.Request.Method)]
+	}
+	if tree == nil {
+		return false
+	}
+	h, _ := tree.Get(utils.S(ctx.Request.Path), nil)
+	streamer, ok := h.(_RequestBodyStreamer)
+	return ok && streamer.streamsRequestBody(ctx)
+}
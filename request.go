@@ -24,9 +24,10 @@ func (up *URLParams) GetInt(name string, base int) (int64, bool) {
 }
 
 type Request struct {
-	Header  Header
-	Method  []byte
-	_method _Method
+	Header   Header
+	Trailers Header // trailer fields of a chunked request body
+	Method   []byte
+	_method  _Method
 
 	RawPath           []byte
 	Path              []byte
@@ -51,6 +52,7 @@ type Request struct {
 
 func (req *Request) Reset() {
 	req.Header.Reset()
+	req.Trailers.Reset()
 	req.Method = req.Method[:0]
 	req.questionMarkIndex = 0
 	req.gotQuestionMark = false
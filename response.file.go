@@ -0,0 +1,130 @@
+package sha
+
+import (
+	"io"
+	"net"
+	"os"
+)
+
+// setBodyFile sets a file as the response body, which is sent after the header without being copied into the body buffer.
+// r is read from its current position.
+func (res *Response) setBodyFile(r io.Reader, size int64) {
+	res.freeBodyFile()
+	res.bodyFile = r
+	res.bodyFileSize = size
+}
+
+// closeFile closes f, or closes it after the response is sent if it is the body file.
+func (res *Response) closeFile(f io.Closer) {
+	if r, ok := f.(io.Reader); ok && res.bodyFile != nil && res.bodyFile == r {
+		res.bodyFileCloser = f
+		return
+	}
+	_ = f.Close()
+}
+
+func (res *Response) freeBodyFile() {
+	if res.bodyFileCloser != nil {
+		_ = res.bodyFileCloser.Close()
+	}
+	res.bodyFile = nil
+	res.bodyFileSize = 0
+	res.bodyFileCloser = nil
+}
+
+const bodyFileReadSize = 32 * 1024
+
+// writeBodyFile copies the body file through the compression writer and the response streaming,
+// it is used when the file can not be sent to the connection directly.
+func (ctx *RequestCtx) writeBodyFile() error {
+	res := &ctx.Response
+	r := io.LimitReader(res.bodyFile, res.bodyFileSize)
+	res.bodyFile = nil
+	if ctx.Request._method == _MHead {
+		return nil
+	}
+
+	limit := bodyFileReadSize
+	if ctx.streamer != nil {
+		limit = ctx.streamer.streamBufferSize()
+	}
+	buf := make([]byte, bodyFileReadSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, e := res.Write(buf[:n]); e != nil {
+				return e
+			}
+			if len(res.bodyBuf.Data) >= limit && ctx.streamer != nil {
+				if e := ctx.Flush(); e != nil {
+					return e
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// tcpConn returns the writer of the underlying *net.TCPConn, whose `ReadFrom` uses sendfile/splice.
+func tcpConn(conn net.Conn) (io.Writer, bool) {
+	for {
+		pc, ok := conn.(*_PeekedConn)
+		if !ok {
+			break
+		}
+		conn = pc.Conn
+	}
+	if tc, ok := conn.(*_TrackedConn); ok {
+		_, isTCP := tc.Conn.(*net.TCPConn)
+		return tc, isTCP
+	}
+	tc, ok := conn.(*net.TCPConn)
+	return tc, ok
+}
+
+// sendBodyFile writes the header with the file size as Content-Length, then copies the file to the connection.
+func (protocol *_Http11Protocol) sendBodyFile(ctx *RequestCtx) error {
+	res := &ctx.Response
+	size := res.bodyFileSize
+	res.Header.SetContentLength(size)
+	if err := protocol.writeHeader(ctx); err != nil {
+		return err
+	}
+	if ctx.Request._method == _MHead || size < 1 {
+		return res.sendBuf.Flush()
+	}
+
+	var dst io.Writer = res.sendBuf
+	if tc, ok := tcpConn(ctx.conn); ok {
+		if err := res.sendBuf.Flush(); err != nil {
+			return err
+		}
+		dst = tc
+	}
+	if _, err := io.CopyN(dst, res.bodyFile, size); err != nil {
+		return err
+	}
+	return res.sendBuf.Flush()
+}
+
+// fileSize returns the size of the rest of f, ok is false if f is not a regular file.
+func fileSize(f io.Reader) (int64, bool) {
+	file, ok := f.(*os.File)
+	if !ok {
+		return 0, false
+	}
+	stat, err := file.Stat()
+	if err != nil || !stat.Mode().IsRegular() {
+		return 0, false
+	}
+	offset, err := file.Seek(0, io.SeekCurrent)
+	if err != nil || offset > stat.Size() {
+		return 0, false
+	}
+	return stat.Size() - offset, true
+}
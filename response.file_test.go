@@ -0,0 +1,138 @@
+package sha
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestResponse_BodyFile(t *testing.T) {
+	content := make([]byte, 300*1024)
+	rand.Read(content)
+	fp := filepath.Join(t.TempDir(), "artifact.bin")
+	if err := os.WriteFile(fp, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := NewMux(nil)
+	mux.FileContent(nil, MethodGet, "/file", fp)
+	mux.FileContent(nil, MethodHead, "/file", fp)
+	mux.FileContent(
+		&HandlerOptions{
+			Middlewares: []Middleware{
+				MiddlewareFunc(func(ctx *RequestCtx, next func()) {
+					ctx.CompressGzip()
+					next()
+				}),
+			},
+		},
+		MethodGet, "/gzip", fp,
+	)
+	mux.HTTP(MethodGet, "/write", RequestHandlerFunc(func(ctx *RequestCtx) {
+		f, err := os.Open(fp)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer f.Close()
+		_, _ = f.Seek(1024, io.SeekStart)
+		ctx.WriteFile(f, ".bin")
+	}))
+	var replaced *os.File
+	mux.HTTP(MethodGet, "/send", RequestHandlerFunc(func(ctx *RequestCtx) {
+		var err error
+		if replaced, err = os.Open(fp); err != nil {
+			t.Error(err)
+			return
+		}
+		ctx.SendFile(replaced, ".bin")
+
+		f, err := os.Open(fp)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_, _ = f.Seek(2048, io.SeekStart)
+		ctx.SendFile(f, ".bin")
+	}))
+	_, addr := startTestServer(t, mux)
+
+	get := func(method, path string, header map[string]string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(method, "http://"+addr+path, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, body
+	}
+
+	res, body := get(MethodGet, "/file", nil)
+	if res.StatusCode != http.StatusOK || !bytes.Equal(body, content) {
+		t.Fatalf("bad file response: %d %d", res.StatusCode, len(body))
+	}
+
+	res, body = get(MethodGet, "/file", map[string]string{"Range": "bytes=100-199"})
+	if res.StatusCode != http.StatusPartialContent || !bytes.Equal(body, content[100:200]) {
+		t.Fatalf("bad range response: %d %d", res.StatusCode, len(body))
+	}
+
+	res, _ = get(MethodHead, "/file", nil)
+	if res.Header.Get("Content-Length") != strconv.Itoa(len(content)) {
+		t.Fatalf("bad head response: %s", res.Header.Get("Content-Length"))
+	}
+
+	res, body = get(MethodGet, "/gzip", nil)
+	if !res.Uncompressed || !bytes.Equal(body, content) {
+		t.Fatalf("bad compressed response: %v %d", res.Uncompressed, len(body))
+	}
+
+	res, body = get(MethodGet, "/write", nil)
+	if !bytes.Equal(body, content[1024:]) {
+		t.Fatalf("bad WriteFile response: %d", len(body))
+	}
+
+	res, body = get(MethodGet, "/send", nil)
+	if !bytes.Equal(body, content[2048:]) {
+		t.Fatalf("bad SendFile response: %d", len(body))
+	}
+	if _, err := replaced.Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("the replaced file is not closed: %v", err)
+	}
+}
+
+type _ReaderFromConn struct {
+	net.Conn
+	n int64
+}
+
+func (c *_ReaderFromConn) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(io.Discard, r)
+	c.n += n
+	return n, err
+}
+
+func TestPeekedConn_ReadFrom(t *testing.T) {
+	underlying := &_ReaderFromConn{}
+	// e.g. the connection after the h2c preface peek or a PROXY protocol header
+	var conn net.Conn = &_PeekedConn{Conn: underlying}
+	n, err := io.CopyN(conn, strings.NewReader("hello"), 5)
+	if err != nil || n != 5 || underlying.n != 5 {
+		t.Fatalf("the underlying ReadFrom is not used: %d %d %v", n, underlying.n, err)
+	}
+}
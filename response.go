@@ -3,6 +3,7 @@ package sha
 import (
 	"bufio"
 	"github.com/zzztttkkk/sha/utils"
+	"io"
 	"strconv"
 	"sync"
 	"time"
@@ -17,6 +18,19 @@ type Response struct {
 	bodyBuf            *utils.Buf
 	compressWriter     _CompressionWriter
 	compressWriterPool *sync.Pool
+	autoCompress       bool
+
+	// streaming
+	headerSent bool
+	chunked    bool
+
+	// keepContentLength keeps the Content-Length in the header for an empty body, e.g. the proxied HEAD and 304 responses
+	keepContentLength bool
+
+	// file body, see `setBodyFile`
+	bodyFile       io.Reader
+	bodyFileSize   int64
+	bodyFileCloser io.Closer
 }
 
 func (res *Response) Write(p []byte) (int, error) {
@@ -32,6 +46,7 @@ func (res *Response) SetStatusCode(v int) {
 }
 
 func (res *Response) ResetBodyBuffer() {
+	res.freeBodyFile()
 	res.bodyBuf.Data = res.bodyBuf.Data[:0]
 	if res.compressWriter != nil {
 		res.compressWriter.Reset(res.bodyBuf)
@@ -131,5 +146,13 @@ func (res *Response) reset() {
 	res.statusCode = 0
 	res.headerBuf = res.headerBuf[:0]
 	res.Header.Reset()
-	res.ResetBodyBuffer()
+	res.freeCompressWriter()
+	res.autoCompress = false
+	res.freeBodyFile()
+	if res.bodyBuf != nil {
+		res.bodyBuf.Data = res.bodyBuf.Data[:0]
+	}
+	res.headerSent = false
+	res.chunked = false
+	res.keepContentLength = false
 }
@@ -0,0 +1,157 @@
+package sha
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/zzztttkkk/sha/utils"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+type FileSystemOption struct {
+	AutoIndex bool
+	// Precompressed serves the `.zst`, `.br` and `.gz` siblings of the files by the `Accept-Encoding`,
+	// the files without an accepted sibling are compressed on the fly by `RequestCtx.AutoCompress`.
+	Precompressed bool
+	// Manifest marks the fingerprinted files as immutable, they are cached by the clients for a year.
+	Manifest *AssetManifest
+}
+
+var precompressedFiles = []struct {
+	encoding, ext string
+}{
+	{"zstd", ".zst"},
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// openPrecompressed opens the sibling of the file with the highest q-value, the order of precompressedFiles breaks the ties.
+func openPrecompressed(ctx *RequestCtx, fs http.FileSystem, name string) (http.File, os.FileInfo, string) {
+	accepted := parseAcceptEncoding(ctx.Request.Header.GetAll(HeaderAcceptEncoding))
+	var file http.File
+	var info os.FileInfo
+	encoding, bestQ := "", 0.0
+	for _, v := range precompressedFiles {
+		q := acceptedQ(accepted, v.encoding)
+		if q <= bestQ {
+			continue
+		}
+		f, err := fs.Open(name + v.ext)
+		if err != nil {
+			continue
+		}
+		d, err := f.Stat()
+		if err != nil || d.IsDir() {
+			_ = f.Close()
+			continue
+		}
+		if file != nil {
+			_ = file.Close()
+		}
+		file, info, encoding, bestQ = f, d, v.encoding, q
+	}
+	return file, info, encoding
+}
+
+// servePrecompressed serves the accepted sibling of the file, it reports whether the sibling is served.
+// the content type and the modification time are the ones of the file, the ranges are the ones of the sibling.
+func servePrecompressed(ctx *RequestCtx, fs http.FileSystem, name string, d os.FileInfo) bool {
+	w := &ctx.Response
+	if !varyContains(&w.Header, acceptEncodingStr) {
+		w.Header.Append(HeaderVary, acceptEncodingStr)
+	}
+	if disableCompress {
+		return false
+	}
+	f, info, encoding := openPrecompressed(ctx, fs, name)
+	if f == nil {
+		return false
+	}
+	defer w.closeFile(f)
+	w.Header.Set(HeaderContentEncoding, utils.B(encoding))
+	serveFileContent(ctx, name, d.ModTime(), info.Size(), f)
+	return true
+}
+
+var ErrBadAssetManifest = errors.New("sha: bad asset manifest")
+
+// AssetManifest maps the logical asset names to the fingerprinted files, which is emitted by the frontend build tools.
+// the values are the file names, e.g. `{"main.js": "main.4889e940.js"}`,
+// or the chunks of vite, e.g. `{"src/main.js": {"file": "assets/main.4889e940.js", "css": ["assets/main.b82dbe22.css"]}}`.
+// the file names are relative to the root of the file system.
+type AssetManifest struct {
+	prefix    string
+	files     map[string]string
+	immutable map[string]bool
+}
+
+func trimAssetName(name string) string { return strings.TrimPrefix(name, "/") }
+
+// NewAssetManifest parses the manifest, prefix is the url path of the file system route, e.g. `/static/`.
+func NewAssetManifest(data []byte, prefix string) (*AssetManifest, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, ErrBadAssetManifest
+	}
+
+	m := &AssetManifest{prefix: prefix, files: map[string]string{}, immutable: map[string]bool{}}
+	for name, value := range raw {
+		var file string
+		if err := json.Unmarshal(value, &file); err != nil {
+			var chunk struct {
+				File   string   `json:"file"`
+				CSS    []string `json:"css"`
+				Assets []string `json:"assets"`
+			}
+			if err = json.Unmarshal(value, &chunk); err != nil || len(chunk.File) < 1 {
+				return nil, ErrBadAssetManifest
+			}
+			file = chunk.File
+			for _, v := range chunk.CSS {
+				m.immutable[trimAssetName(v)] = true
+			}
+			for _, v := range chunk.Assets {
+				m.immutable[trimAssetName(v)] = true
+			}
+		}
+		file = trimAssetName(file)
+		m.files[trimAssetName(name)] = file
+		m.immutable[file] = true
+	}
+	return m, nil
+}
+
+// LoadAssetManifest reads the manifest from the file system, e.g. the `manifest.json` in the output directory.
+func LoadAssetManifest(fs http.FileSystem, name, prefix string) (*AssetManifest, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return NewAssetManifest(data, prefix)
+}
+
+// URL returns the url of the fingerprinted file, the logical name is used if it is not in the manifest.
+func (m *AssetManifest) URL(name string) string {
+	name = trimAssetName(name)
+	if file, ok := m.files[name]; ok {
+		return m.prefix + file
+	}
+	return m.prefix + name
+}
+
+// Immutable reports whether the file is a fingerprinted one.
+func (m *AssetManifest) Immutable(name string) bool { return m.immutable[trimAssetName(name)] }
+
+// FuncMap returns the template functions, `{{ asset "main.js" }}` is the url of the fingerprinted file.
+func (m *AssetManifest) FuncMap() map[string]interface{} {
+	return map[string]interface{}{"asset": m.URL}
+}
+
+var immutableCacheControl = []byte("public, max-age=31536000, immutable")
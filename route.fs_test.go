@@ -0,0 +1,129 @@
+package sha
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestMux_FileSystemPrecompressed(t *testing.T) {
+	dir := t.TempDir()
+	script := []byte(strings.Repeat("console.log(1);\n", 128))
+	style := []byte(strings.Repeat("body { margin: 0; }\n", 128))
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, _ = gw.Write(script)
+	_ = gw.Close()
+	zw, _ := zstd.NewWriter(nil)
+	zs := zw.EncodeAll(script, nil)
+
+	for name, data := range map[string][]byte{
+		"app.js":                   script,
+		"app.js.gz":                gz.Bytes(),
+		"app.js.zst":               zs,
+		"style.css":                style,
+		"main.4889e940.js":         script,
+		"assets/main.b82dbe22.css": style,
+		"manifest.json": []byte(`{
+			"main.js": "main.4889e940.js",
+			"src/main.ts": {"file": "main.4889e940.js", "css": ["assets/main.b82dbe22.css"]}
+		}`),
+	} {
+		fp := filepath.Join(dir, name)
+		_ = os.MkdirAll(filepath.Dir(fp), 0755)
+		if err := os.WriteFile(fp, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manifest, err := LoadAssetManifest(http.Dir(dir), "manifest.json", "/static/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := manifest.URL("main.js"); v != "/static/main.4889e940.js" {
+		t.Fatalf("unexpected url: %s", v)
+	}
+	if v := manifest.URL("/logo.png"); v != "/static/logo.png" {
+		t.Fatalf("unexpected url: %s", v)
+	}
+	var buf bytes.Buffer
+	tpl := template.Must(template.New("").Funcs(manifest.FuncMap()).Parse(`<script src="{{ asset "src/main.ts" }}"></script>`))
+	if err = tpl.Execute(&buf, nil); err != nil || buf.String() != `<script src="/static/main.4889e940.js"></script>` {
+		t.Fatalf("%q %v", buf.String(), err)
+	}
+
+	mux := NewMux(nil)
+	mux.FileSystemWithOptions(
+		nil, MethodGet, "/static/{filepath:*}", http.Dir(dir),
+		&FileSystemOption{Precompressed: true, Manifest: manifest},
+	)
+	_, addr := startTestServer(t, mux)
+
+	get := func(path, acceptEncoding string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(MethodGet, "http://"+addr+path, nil)
+		req.Header.Set(HeaderAcceptEncoding, acceptEncoding)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, body
+	}
+
+	for _, c := range []struct {
+		acceptEncoding, encoding string
+		body                     []byte
+	}{
+		{"gzip", "gzip", gz.Bytes()},
+		{"gzip;q=0.5, zstd", "zstd", zs},
+		{"br", "br", nil}, // compressed on the fly
+		{"identity", "", script},
+	} {
+		res, body := get("/static/app.js", c.acceptEncoding)
+		if v := res.Header.Get(HeaderContentEncoding); v != c.encoding {
+			t.Fatalf("%q: expected encoding %q, got %q", c.acceptEncoding, c.encoding, v)
+		}
+		if c.body != nil && !bytes.Equal(body, c.body) {
+			t.Fatalf("%q: unexpected body", c.acceptEncoding)
+		}
+		if res.Header.Get(HeaderVary) != HeaderAcceptEncoding || res.Header.Get(HeaderContentType) != "application/javascript" {
+			t.Fatalf("%q: unexpected header: %v", c.acceptEncoding, res.Header)
+		}
+		if res.Header.Get(HeaderCacheControl) != "" {
+			t.Fatalf("%q: the file is not fingerprinted", c.acceptEncoding)
+		}
+	}
+
+	// compressed on the fly
+	res, body := get("/static/style.css", "gzip")
+	if res.Header.Get(HeaderContentEncoding) != "gzip" {
+		t.Fatalf("the file is not compressed: %v", res.Header)
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(gr); err != nil || !bytes.Equal(data, style) {
+		t.Fatalf("unexpected body: %v", err)
+	}
+
+	for _, path := range []string{"/static/main.4889e940.js", "/static/assets/main.b82dbe22.css"} {
+		res, _ = get(path, "")
+		if v := res.Header.Get(HeaderCacheControl); v != "public, max-age=31536000, immutable" {
+			t.Fatalf("%s: unexpected cache control: %q", path, v)
+		}
+	}
+}
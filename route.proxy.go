@@ -0,0 +1,496 @@
+package sha
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/imdario/mergo"
+	"github.com/zzztttkkk/sha/utils"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ProxyBalance string
+
+const (
+	ProxyRoundRobin     = ProxyBalance("round-robin")
+	ProxyLeastConn      = ProxyBalance("least-conn")
+	ProxyConsistentHash = ProxyBalance("consistent-hash")
+)
+
+type ReverseProxyOption struct {
+	Upstreams []string     `json:"upstreams" toml:"upstreams"` // e.g. `http://127.0.0.1:8080`, the path of the url is prepended to the request path
+	Balance   ProxyBalance `json:"balance" toml:"balance"`
+	// HashHeader is the key of the consistent-hash balance, the client ip is used if it is empty or the header is missing.
+	HashHeader   string `json:"hash_header" toml:"hash-header"`
+	PreserveHost bool   `json:"preserve_host" toml:"preserve-host"`
+	// an upstream is skipped for FailTimeout after MaxFails consecutive failures.
+	MaxFails    int                `json:"max_fails" toml:"max-fails"`
+	FailTimeout utils.TomlDuration `json:"fail_timeout" toml:"fail-timeout"`
+	// MaxRequestBodySize limits the streamed request body, the `MaxRequestBodySize` of the server protocol
+	// is used if it is zero, and a negative value means no limit.
+	MaxRequestBodySize int64        `json:"max_request_body_size" toml:"max-request-body-size"`
+	Client             ClientOption `json:"client" toml:"client"`
+}
+
+var defaultReverseProxyOption = ReverseProxyOption{
+	Balance:     ProxyRoundRobin,
+	MaxFails:    3,
+	FailTimeout: utils.TomlDuration{Duration: time.Second * 10},
+}
+
+type _Upstream struct {
+	url      *url.URL
+	basePath string
+
+	active    int64
+	fails     int32
+	downUntil int64
+}
+
+type _ProxyHashNode struct {
+	hash     uint32
+	upstream *_Upstream
+}
+
+const proxyHashReplicas = 160
+
+type _ReverseProxy struct {
+	option    ReverseProxyOption
+	client    *Client
+	upstreams []*_Upstream
+	ring      []_ProxyHashNode
+	next      uint32
+
+	requestPool sync.Pool
+}
+
+var (
+	ErrProxyNoUpstream          = errors.New("sha.proxy: no upstream")
+	ErrProxyUnsupportedBalance  = errors.New("sha.proxy: unsupported balance")
+	ErrProxyUnsupportedUpstream = errors.New("sha.proxy: unsupported upstream url")
+)
+
+// NewReverseProxy returns a handler that forwards the requests to the http/1.1 upstreams, the bodies are streamed both ways.
+// The request body is not buffered by the protocols, it is limited by `ReverseProxyOption.MaxRequestBodySize`.
+// The body is streamed if the proxy is the handler of the server or a route of the Mux,
+// and the middlewares of the route can not read it.
+func NewReverseProxy(option *ReverseProxyOption) RequestHandler {
+	p := &_ReverseProxy{}
+	if option != nil {
+		p.option = *option
+	}
+	if err := mergo.Merge(&p.option, &defaultReverseProxyOption); err != nil {
+		panic(err)
+	}
+	if len(p.option.Upstreams) < 1 {
+		panic(ErrProxyNoUpstream)
+	}
+	switch p.option.Balance {
+	case ProxyRoundRobin, ProxyLeastConn, ProxyConsistentHash:
+	default:
+		panic(ErrProxyUnsupportedBalance)
+	}
+
+	// the response is relayed as is
+	clientOption := p.option.Client
+	clientOption.DisableCompression = true
+	clientOption.DisableRedirects = true
+	p.client = NewClient(&clientOption)
+	p.requestPool.New = func() interface{} { return &Request{} }
+
+	for _, raw := range p.option.Upstreams {
+		u, err := url.Parse(raw)
+		if err != nil {
+			panic(err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) < 1 {
+			panic(ErrProxyUnsupportedUpstream)
+		}
+		p.upstreams = append(p.upstreams, &_Upstream{url: u, basePath: strings.TrimSuffix(u.EscapedPath(), "/")})
+	}
+
+	if p.option.Balance == ProxyConsistentHash {
+		for _, up := range p.upstreams {
+			for i := 0; i < proxyHashReplicas; i++ {
+				p.ring = append(
+					p.ring,
+					_ProxyHashNode{hash: crc32.ChecksumIEEE([]byte(up.url.Host + "#" + strconv.Itoa(i))), upstream: up},
+				)
+			}
+		}
+		sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+	}
+	return p
+}
+
+func (up *_Upstream) available(now int64) bool { return atomic.LoadInt64(&up.downUntil) <= now }
+
+func (p *_ReverseProxy) markFailed(up *_Upstream) {
+	if atomic.AddInt32(&up.fails, 1) >= int32(p.option.MaxFails) {
+		atomic.StoreInt32(&up.fails, 0)
+		atomic.StoreInt64(&up.downUntil, time.Now().Add(p.option.FailTimeout.Duration).UnixNano())
+	}
+}
+
+func (p *_ReverseProxy) markSucceeded(up *_Upstream) { atomic.StoreInt32(&up.fails, 0) }
+
+// pick selects an available upstream, the health is ignored if all the upstreams are down.
+func (p *_ReverseProxy) pick(ctx *RequestCtx) *_Upstream {
+	now := time.Now().UnixNano()
+	// the rotating position is advanced once per request, even if the health is ignored
+	begin := int(atomic.AddUint32(&p.next, 1) - 1)
+	for _, ignoreHealth := range []bool{false, true} {
+		var up *_Upstream
+		switch p.option.Balance {
+		case ProxyRoundRobin:
+			up = p.pickRoundRobin(begin, now, ignoreHealth)
+		case ProxyLeastConn:
+			up = p.pickLeastConn(begin, now, ignoreHealth)
+		case ProxyConsistentHash:
+			up = p.pickConsistentHash(ctx, now, ignoreHealth)
+		}
+		if up != nil {
+			return up
+		}
+	}
+	return p.upstreams[0]
+}
+
+func (p *_ReverseProxy) pickRoundRobin(begin int, now int64, ignoreHealth bool) *_Upstream {
+	for i := 0; i < len(p.upstreams); i++ {
+		up := p.upstreams[(begin+i)%len(p.upstreams)]
+		if ignoreHealth || up.available(now) {
+			return up
+		}
+	}
+	return nil
+}
+
+// pickLeastConn starts at the rotating position, so the ties are balanced.
+func (p *_ReverseProxy) pickLeastConn(begin int, now int64, ignoreHealth bool) *_Upstream {
+	var rv *_Upstream
+	var min int64
+	for i := 0; i < len(p.upstreams); i++ {
+		up := p.upstreams[(begin+i)%len(p.upstreams)]
+		if !ignoreHealth && !up.available(now) {
+			continue
+		}
+		if active := atomic.LoadInt64(&up.active); rv == nil || active < min {
+			rv = up
+			min = active
+		}
+	}
+	return rv
+}
+
+func (p *_ReverseProxy) pickConsistentHash(ctx *RequestCtx, now int64, ignoreHealth bool) *_Upstream {
+	var key []byte
+	if len(p.option.HashHeader) > 0 {
+		key, _ = ctx.Request.Header.Get(p.option.HashHeader)
+	}
+	if len(key) < 1 {
+		key = utils.B(ctx.ClientIP())
+	}
+
+	hash := crc32.ChecksumIEEE(key)
+	begin := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= hash })
+	for i := 0; i < len(p.ring); i++ {
+		up := p.ring[(begin+i)%len(p.ring)].upstream
+		if ignoreHealth || up.available(now) {
+			return up
+		}
+	}
+	return nil
+}
+
+func remoteIP(ctx *RequestCtx) string {
+	addr := ctx.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+var hopByHopHeaders = []string{
+	HeaderConnection,
+	HeaderKeepAlive,
+	"Proxy-Connection",
+	HeaderProxyAuthenticate,
+	HeaderProxyAuthorization,
+	HeaderTE,
+	HeaderTrailer,
+	HeaderTransferEncoding,
+	HeaderUpgrade,
+}
+
+// isHopByHopHeader reports whether the header is only meaningful for a single connection, RFC 7230 6.1.
+// connection is the values of the `Connection` header, the headers listed in it are hop-by-hop too.
+func isHopByHopHeader(key string, connection [][]byte) bool {
+	for _, name := range hopByHopHeaders {
+		if headerKeyIs(key, name) {
+			return true
+		}
+	}
+	for _, v := range connection {
+		if hasToken(v, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *_ReverseProxy) prepareRequest(ctx *RequestCtx, up *_Upstream, req *Request, upgrade string) {
+	req.Method = append(req.Method, ctx.Request.Method...)
+	// reuse the path buffer for the request uri
+	req.RawPath = append(req.RawPath, up.basePath...)
+	req.RawPath = append(req.RawPath, ctx.Request.RawPath...)
+
+	src := &ctx.Request.Header
+	connection := getAllHeaderFold(src, HeaderConnection)
+	var forwardedFor []byte
+	src.EachItem(
+		func(item *utils.KvItem) bool {
+			key := utils.S(item.Key)
+			switch {
+			case isHopByHopHeader(key, connection):
+			case headerKeyIs(key, HeaderExpect), headerKeyIs(key, HeaderXForwardedHost), headerKeyIs(key, HeaderXForwardedProto):
+			case headerKeyIs(key, HeaderHost):
+				if p.option.PreserveHost {
+					req.Header.AppendBytes(item.Key, item.Val)
+				}
+			case headerKeyIs(key, HeaderXForwardedFor):
+				forwardedFor = append(forwardedFor, item.Val...)
+				forwardedFor = append(forwardedFor, ", "...)
+			default:
+				req.Header.AppendBytes(item.Key, item.Val)
+			}
+			return true
+		},
+	)
+
+	forwardedFor = append(forwardedFor, remoteIP(ctx)...)
+	req.Header.Set(HeaderXForwardedFor, forwardedFor)
+	if host := ctx.Host(); len(host) > 0 {
+		req.Header.Set(HeaderXForwardedHost, utils.B(host))
+	}
+	req.Header.Set(HeaderXForwardedProto, utils.B(ctx.Scheme()))
+
+	if len(upgrade) > 0 {
+		req.Header.Set(HeaderConnection, utils.B("Upgrade"))
+		req.Header.Set(HeaderUpgrade, utils.B(upgrade))
+	}
+}
+
+func (p *_ReverseProxy) streamsRequestBody(_ *RequestCtx) bool { return true }
+
+// _ProxyRequestBody records the error of reading the request body, which is not a failure of the upstream.
+type _ProxyRequestBody struct {
+	r     io.Reader
+	limit int64
+	read  int64
+	err   error
+}
+
+func (body *_ProxyRequestBody) Read(p []byte) (int, error) {
+	n, err := body.r.Read(p)
+	body.read += int64(n)
+	if body.limit > 0 && body.read > body.limit {
+		n, err = 0, ErrRequestEntityTooLarge
+	}
+	if err != nil && err != io.EOF {
+		body.err = err
+	}
+	return n, err
+}
+
+func (p *_ReverseProxy) Handle(ctx *RequestCtx) {
+	var body *_ProxyRequestBody
+	if ctx.bodyStream != nil {
+		limit := p.option.MaxRequestBodySize
+		if limit == 0 {
+			limit = int64(ctx.maxBodySize)
+		}
+		if limit > 0 && int64(ctx.bodySize) > limit {
+			ctx.Response.statusCode = StatusRequestEntityTooLarge
+			return
+		}
+		body = &_ProxyRequestBody{r: ctx.bodyStream, limit: limit}
+	}
+
+	up := p.pick(ctx)
+	atomic.AddInt64(&up.active, 1)
+	defer atomic.AddInt64(&up.active, -1)
+
+	req := p.requestPool.Get().(*Request)
+	defer func() {
+		req.Reset()
+		p.requestPool.Put(req)
+	}()
+	upgrade := ctx.UpgradeProtocol()
+	p.prepareRequest(ctx, up, req, upgrade)
+
+	res := p.client.AcquireResponse()
+	defer p.client.ReleaseResponse(res)
+
+	ex := _ClientExchange{
+		req:        req,
+		url:        up.url,
+		requestURI: req.RawPath,
+		method:     utils.S(req.Method),
+	}
+	if body != nil {
+		ex.bodyStream, ex.bodyStreamSize = body, int64(ctx.bodySize)
+	} else {
+		ex.body = ctx.Request.BodyRaw()
+	}
+	headerReceived := false
+	ex.stream = func(cc *_ClientConn, res *Response, body io.Reader) error {
+		headerReceived = true
+		if res.statusCode == StatusSwitchingProtocols && len(upgrade) > 0 {
+			return p.tunnel(ctx, cc, res)
+		}
+		p.copyResponseHeader(ctx, res)
+		if body == nil {
+			return nil
+		}
+		return p.copyResponseBody(ctx, cc, body)
+	}
+
+	err := p.client.exchange(ctx, &ex, res)
+	if err == nil {
+		p.markSucceeded(up)
+		return
+	}
+
+	clientErr := body != nil && body.err != nil
+	if !headerReceived && !clientErr && ctx.Err() == nil {
+		p.markFailed(up)
+	}
+	if ctx.hijacked {
+		return
+	}
+	if !ctx.Response.headerSent {
+		ctx.Response.Header.Reset()
+		ctx.Response.ResetBodyBuffer()
+		ctx.Response.keepContentLength = false
+		switch {
+		case clientErr:
+			if he, ok := body.err.(HttpError); ok {
+				ctx.Response.statusCode = he.StatusCode()
+			} else {
+				ctx.Response.statusCode = StatusBadRequest
+			}
+		case errors.Is(err, context.DeadlineExceeded):
+			ctx.Response.statusCode = StatusGatewayTimeout
+		default:
+			ctx.Response.statusCode = StatusBadGateway
+		}
+		return
+	}
+	// the response is partially sent, close the connection so the client knows it is incomplete
+	if _, ok := ctx.streamer.(*_Http2Stream); !ok && ctx.conn != nil {
+		_ = ctx.hijackConn().Close()
+	}
+}
+
+func (p *_ReverseProxy) copyResponseHeader(ctx *RequestCtx, res *Response) {
+	dst := &ctx.Response
+	if dst.compressWriter != nil {
+		dst.freeCompressWriter()
+		dst.Header.Del(HeaderContentEncoding)
+	}
+	dst.autoCompress = false
+	dst.statusCode = res.statusCode
+
+	// the framing is decided by the protocol of the server, except the bodyless responses that have the length of the entity
+	dst.keepContentLength = ctx.Request._method == _MHead || res.statusCode == StatusNotModified
+	connection := res.Header.GetAll(HeaderConnection)
+	res.Header.EachItem(
+		func(item *utils.KvItem) bool {
+			key := utils.S(item.Key)
+			if isHopByHopHeader(key, connection) || (!dst.keepContentLength && headerKeyIs(key, HeaderContentLength)) {
+				return true
+			}
+			dst.Header.AppendBytes(item.Key, item.Val)
+			return true
+		},
+	)
+}
+
+// copyResponseBody sends the body to the client every time the buffer is full or the upstream has no data ready.
+func (p *_ReverseProxy) copyResponseBody(ctx *RequestCtx, cc *_ClientConn, body io.Reader) error {
+	size := 4096
+	if ctx.streamer != nil {
+		size = ctx.streamer.streamBufferSize()
+	}
+
+	buf := ctx.Response.bodyBuf
+	for {
+		if cap(buf.Data)-len(buf.Data) < size/2 {
+			buf.Data = append(buf.Data, make([]byte, size)...)[:len(buf.Data)]
+		}
+		n, err := body.Read(buf.Data[len(buf.Data):cap(buf.Data)])
+		buf.Data = buf.Data[:len(buf.Data)+n]
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if ctx.streamer != nil && (len(buf.Data) >= size || (cc.r.Buffered() == 0 && !bodyDone(body))) {
+			if err = ctx.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// tunnel relays the data between the client and the upstream after a protocol upgrade, e.g. websocket.
+func (p *_ReverseProxy) tunnel(ctx *RequestCtx, cc *_ClientConn, res *Response) error {
+	cc.keepAlive = false
+	conn := ctx.Hijack()
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Time{})
+
+	head := bytes.NewBufferString("HTTP/1.1 101 Switching Protocols\r\n")
+	res.Header.EachItem(
+		func(item *utils.KvItem) bool {
+			head.Write(item.Key)
+			head.WriteString(headerKVSep)
+			head.Write(item.Val)
+			head.WriteString(EndLine)
+			return true
+		},
+	)
+	head.WriteString(EndLine)
+	if _, err := conn.Write(head.Bytes()); err != nil {
+		return err
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(cc.Conn, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(conn, cc.r)
+		done <- struct{}{}
+	}()
+
+	// either side is closed
+	<-done
+	_ = conn.Close()
+	_ = cc.Conn.Close()
+	<-done
+	return nil
+}
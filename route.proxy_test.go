@@ -0,0 +1,474 @@
+package sha
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"github.com/zzztttkkk/sha/utils"
+	"golang.org/x/net/http2"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func startTestUpstream(t *testing.T, name string) (*Server, string) {
+	return startTestServer(t, RequestHandlerFunc(func(ctx *RequestCtx) {
+		switch string(ctx.Request.Path) {
+		case "/stream":
+			_, _ = ctx.WriteString("hello ")
+			_ = ctx.Flush()
+			time.Sleep(time.Millisecond * 50)
+			_, _ = ctx.WriteString("world")
+		case "/upgrade":
+			conn := ctx.Hijack()
+			_, _ = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+			_, _ = io.Copy(conn, conn)
+			_ = conn.Close()
+		default:
+			forwardedFor, _ := ctx.Request.Header.Get(HeaderXForwardedFor)
+			forwardedHost, _ := ctx.Request.Header.Get(HeaderXForwardedHost)
+			_, _ = ctx.WriteString(name + " " + string(ctx.Request.RawPath) + " " + string(forwardedFor) + " " + string(forwardedHost))
+		}
+	}))
+}
+
+func startTestProxy(t *testing.T, option *ReverseProxyOption) (*Server, string) {
+	return startTestServer(t, NewReverseProxy(option))
+}
+
+func proxyGet(t *testing.T, c *Client, url string) string {
+	res, err := c.Get(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.ReleaseResponse(res)
+	if res.StatusCode() != StatusOK {
+		return http.StatusText(res.StatusCode())
+	}
+	return string(res.Body())
+}
+
+func TestReverseProxy_RoundRobin(t *testing.T) {
+	a, addrA := startTestUpstream(t, "a")
+	defer a.Shutdown(context.Background())
+	b, addrB := startTestUpstream(t, "b")
+	defer b.Shutdown(context.Background())
+
+	p, addr := startTestProxy(t, &ReverseProxyOption{Upstreams: []string{"http://" + addrA, "http://" + addrB + "/base/"}})
+	defer p.Shutdown(context.Background())
+
+	c := NewClient(nil)
+	first := proxyGet(t, c, "http://"+addr+"/x?q=1")
+	second := proxyGet(t, c, "http://"+addr+"/x?q=1")
+	if first > second {
+		first, second = second, first
+	}
+	if first != "a /x?q=1 127.0.0.1 "+addr || second != "b /base/x?q=1 127.0.0.1 "+addr {
+		t.Fatalf("unexpected responses: %q %q", first, second)
+	}
+
+	if body := proxyGet(t, c, "http://"+addr+"/stream"); body != "hello world" {
+		t.Fatalf("bad streamed body: %q", body)
+	}
+}
+
+func TestReverseProxy_HealthCheck(t *testing.T) {
+	a, addrA := startTestUpstream(t, "a")
+	defer a.Shutdown(context.Background())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := l.Addr().String()
+	_ = l.Close()
+
+	p, addr := startTestProxy(
+		t,
+		&ReverseProxyOption{Upstreams: []string{"http://" + down, "http://" + addrA}, MaxFails: 1, FailTimeout: utils.TomlDuration{Duration: time.Minute}},
+	)
+	defer p.Shutdown(context.Background())
+
+	c := NewClient(nil)
+	results := map[string]int{}
+	for i := 0; i < 6; i++ {
+		results[strings.SplitN(proxyGet(t, c, "http://"+addr+"/"), " ", 2)[0]]++
+	}
+	if results["Bad"] != 1 || results["a"] != 5 {
+		t.Fatalf("unexpected results: %v", results)
+	}
+}
+
+func TestReverseProxy_ConsistentHash(t *testing.T) {
+	var addrs []string
+	for _, name := range []string{"a", "b", "c"} {
+		s, addr := startTestUpstream(t, name)
+		defer s.Shutdown(context.Background())
+		addrs = append(addrs, "http://"+addr)
+	}
+
+	p, addr := startTestProxy(t, &ReverseProxyOption{Upstreams: addrs, Balance: ProxyConsistentHash, HashHeader: "X-User"})
+	defer p.Shutdown(context.Background())
+
+	c := NewClient(nil)
+	for _, user := range []string{"u1", "u2", "u3", "u4"} {
+		var seen string
+		for i := 0; i < 3; i++ {
+			req := &Request{}
+			req.Header.Set("X-User", []byte(user))
+			res := c.AcquireResponse()
+			if err := c.Do(context.Background(), "http://"+addr+"/", req, res); err != nil {
+				t.Fatal(err)
+			}
+			name := string(res.Body()[:1])
+			c.ReleaseResponse(res)
+			if len(seen) > 0 && seen != name {
+				t.Fatalf("%s is sent to %s and %s", user, seen, name)
+			}
+			seen = name
+		}
+	}
+}
+
+func TestReverseProxy_Upgrade(t *testing.T) {
+	a, addrA := startTestUpstream(t, "a")
+	defer a.Shutdown(context.Background())
+	p, addr := startTestProxy(t, &ReverseProxyOption{Upstreams: []string{"http://" + addrA}})
+	defer p.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("GET /upgrade HTTP/1.1\r\nHost: a\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != StatusSwitchingProtocols || res.Header.Get(HeaderUpgrade) != "echo" {
+		t.Fatalf("unexpected response: %d %v", res.StatusCode, res.Header)
+	}
+
+	_, _ = conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = io.ReadFull(r, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("unexpected echo: %q %v", buf, err)
+	}
+}
+
+func TestReverseProxy_LeastConn(t *testing.T) {
+	release := make(chan struct{})
+	var upstreams []string
+	for _, name := range []string{"a", "b"} {
+		name := name
+		s, addr := startTestServer(t, RequestHandlerFunc(func(ctx *RequestCtx) {
+			if string(ctx.Request.Path) == "/slow" {
+				<-release
+			}
+			_, _ = ctx.WriteString(name)
+		}))
+		defer s.Shutdown(context.Background())
+		upstreams = append(upstreams, "http://"+addr)
+	}
+
+	p := NewReverseProxy(&ReverseProxyOption{Upstreams: upstreams, Balance: ProxyLeastConn}).(*_ReverseProxy)
+	s, addr := startTestServer(t, p)
+	defer s.Shutdown(context.Background())
+
+	c := NewClient(nil)
+	done := make(chan error)
+	go func() {
+		res, err := c.Get(context.Background(), "http://"+addr+"/slow")
+		if err == nil {
+			c.ReleaseResponse(res)
+		}
+		done <- err
+	}()
+
+	var busy string
+	for len(busy) < 1 {
+		for i, up := range p.upstreams {
+			if atomic.LoadInt64(&up.active) > 0 {
+				busy = []string{"a", "b"}[i]
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 4; i++ {
+		if body := proxyGet(t, c, "http://"+addr+"/"); body == busy {
+			t.Fatalf("the busy upstream %s is picked", busy)
+		}
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// the ties are balanced
+	results := map[string]int{}
+	for i := 0; i < 4; i++ {
+		results[proxyGet(t, c, "http://"+addr+"/")]++
+	}
+	if results["a"] != 2 || results["b"] != 2 {
+		t.Fatalf("unexpected results: %v", results)
+	}
+}
+
+func TestReverseProxy_ConsistentHashFailover(t *testing.T) {
+	p := NewReverseProxy(
+		&ReverseProxyOption{
+			Upstreams: []string{"http://a", "http://b", "http://c"}, Balance: ProxyConsistentHash, HashHeader: "X-User",
+			MaxFails: 1, FailTimeout: utils.TomlDuration{Duration: time.Minute},
+		},
+	).(*_ReverseProxy)
+
+	ctx := acquireTestRequestCtx()
+	pick := func(user string) *_Upstream {
+		ctx.Request.Header.Set("X-User", []byte(user))
+		return p.pick(ctx)
+	}
+
+	users := []string{"u1", "u2", "u3", "u4", "u5", "u6", "u7", "u8"}
+	before := map[string]*_Upstream{}
+	for _, user := range users {
+		before[user] = pick(user)
+	}
+
+	down := before["u1"]
+	p.markFailed(down)
+	for _, user := range users {
+		up := pick(user)
+		if up == down {
+			t.Fatalf("%s is sent to the down upstream", user)
+		}
+		// only the keys of the down upstream are moved
+		if before[user] != down && up != before[user] {
+			t.Fatalf("%s is moved from %s to %s", user, before[user].url.Host, up.url.Host)
+		}
+	}
+}
+
+func TestReverseProxy_PassiveHealth(t *testing.T) {
+	p := NewReverseProxy(
+		&ReverseProxyOption{
+			Upstreams: []string{"http://a", "http://b"}, Balance: ProxyLeastConn,
+			MaxFails: 2, FailTimeout: utils.TomlDuration{Duration: time.Minute},
+		},
+	).(*_ReverseProxy)
+	a, b := p.upstreams[0], p.upstreams[1]
+	now := time.Now().UnixNano()
+
+	// the failures must be consecutive
+	p.markFailed(a)
+	p.markSucceeded(a)
+	p.markFailed(a)
+	if !a.available(now) {
+		t.Fatal("a is marked down before MaxFails consecutive failures")
+	}
+	p.markFailed(a)
+	if a.available(now) || !a.available(time.Now().Add(time.Minute*2).UnixNano()) {
+		t.Fatal("a is not marked down for FailTimeout")
+	}
+
+	for i := 0; i < 4; i++ {
+		if up := p.pick(nil); up != b {
+			t.Fatalf("the down upstream is picked: %s", up.url.Host)
+		}
+	}
+
+	// the health is ignored if all the upstreams are down
+	p.markFailed(b)
+	p.markFailed(b)
+	picked := map[*_Upstream]bool{}
+	for i := 0; i < 4; i++ {
+		picked[p.pick(nil)] = true
+	}
+	if !picked[a] || !picked[b] {
+		t.Fatalf("unexpected picks: %v", picked)
+	}
+}
+
+func TestReverseProxy_StreamRequestBody(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := sha256.New()
+		n, err := io.Copy(h, r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = fmt.Fprintf(w, "%v %d %d %x", r.TransferEncoding, r.ContentLength, n, h.Sum(nil))
+	}))
+	defer upstream.Close()
+
+	mux := NewMux(nil)
+	mux.HTTPWithOptions(
+		&HandlerOptions{Middlewares: []Middleware{MiddlewareFunc(func(ctx *RequestCtx, next func()) { next() })}},
+		MethodPost, "/upload", NewReverseProxy(&ReverseProxyOption{Upstreams: []string{upstream.URL}, MaxRequestBodySize: -1}),
+	)
+	mux.HTTP(MethodPost, "/default", NewReverseProxy(&ReverseProxyOption{Upstreams: []string{upstream.URL}}))
+	mux.HTTP(MethodPost, "/limited", NewReverseProxy(&ReverseProxyOption{Upstreams: []string{upstream.URL}, MaxRequestBodySize: 1024}))
+	mux.HTTP(MethodPost, "/buffered", RequestHandlerFunc(func(ctx *RequestCtx) { _, _ = ctx.Write(ctx.Request.BodyRaw()) }))
+	s := New(nil, &ServerOption{Addr: "127.0.0.1:0"}, nil, nil)
+	s.Handler = mux
+	s.EnableHTTP2(&HTTP2Option{H2C: true})
+	addr := serveTestServer(t, s)
+	defer s.Shutdown(context.Background())
+
+	// larger than the default MaxRequestBodySize and the initial window of http2
+	content := make([]byte, 1<<20)
+	rand.Read(content)
+	sum := sha256.Sum256(content)
+
+	h2Client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	post := func(c *http.Client, path string, body io.Reader) (int, string) {
+		res, err := c.Post("http://"+addr+path, MIMEText, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		data, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(data)
+	}
+	// the size of the body is unknown
+	type reader struct{ io.Reader }
+
+	for _, c := range []struct {
+		name     string
+		client   *http.Client
+		body     io.Reader
+		expected string
+	}{
+		{"http1.1 content-length", http.DefaultClient, bytes.NewReader(content), fmt.Sprintf("[] %d %d %x", len(content), len(content), sum)},
+		{"http1.1 chunked", http.DefaultClient, reader{bytes.NewReader(content)}, fmt.Sprintf("[chunked] -1 %d %x", len(content), sum)},
+		{"http2 content-length", h2Client, bytes.NewReader(content), fmt.Sprintf("[] %d %d %x", len(content), len(content), sum)},
+		{"http2 unknown length", h2Client, reader{bytes.NewReader(content)}, fmt.Sprintf("[chunked] -1 %d %x", len(content), sum)},
+	} {
+		if status, body := post(c.client, "/upload", c.body); status != StatusOK || body != c.expected {
+			t.Fatalf("%s: %d %q", c.name, status, body)
+		}
+	}
+
+	for _, c := range []struct {
+		name   string
+		client *http.Client
+		path   string
+		body   io.Reader
+	}{
+		{"limited content-length", http.DefaultClient, "/limited", bytes.NewReader(content[:2048])},
+		{"limited chunked", http.DefaultClient, "/limited", reader{bytes.NewReader(content[:2048])}},
+		{"limited http2", h2Client, "/limited", reader{bytes.NewReader(content[:2048])}},
+		// the MaxRequestBodySize of the server protocol
+		{"default content-length", http.DefaultClient, "/default", bytes.NewReader(content[:8192])},
+		{"default chunked", http.DefaultClient, "/default", reader{bytes.NewReader(content[:8192])}},
+		{"default http2", h2Client, "/default", reader{bytes.NewReader(content[:8192])}},
+		{"buffered", http.DefaultClient, "/buffered", bytes.NewReader(content[:8192])},
+	} {
+		if status, _ := post(c.client, c.path, c.body); status != StatusRequestEntityTooLarge {
+			t.Fatalf("%s: expected 413, got %d", c.name, status)
+		}
+	}
+
+	// the connection serves the pipelined request after the streamed body
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+	body := strings.Repeat("a", 10000)
+	_, _ = conn.Write([]byte(
+		"POST /upload HTTP/1.1\r\nHost: a\r\nContent-Length: 10000\r\n\r\n" + body +
+			"POST /buffered HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello",
+	))
+	r := bufio.NewReader(conn)
+	for _, expected := range []string{fmt.Sprintf("[] 10000 10000 %x", sha256.Sum256([]byte(body))), "hello"} {
+		res, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(res.Body)
+		if string(data) != expected {
+			t.Fatalf("unexpected pipelined response: %d %q", res.StatusCode, data)
+		}
+	}
+}
+
+func TestReverseProxy_Bodyless(t *testing.T) {
+	// net/http drops the Content-Length of 304 responses
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					req, err := http.ReadRequest(r)
+					if err != nil {
+						return
+					}
+					switch {
+					case req.Method == MethodHead:
+						_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n"))
+					case req.Header.Get("If-None-Match") != "":
+						_, _ = conn.Write([]byte("HTTP/1.1 304 Not Modified\r\nContent-Length: 5\r\n\r\n"))
+					default:
+						_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"))
+					}
+				}
+			}()
+		}
+	}()
+	s, addr := startTestProxy(t, &ReverseProxyOption{Upstreams: []string{"http://" + ln.Addr().String()}})
+	defer s.Shutdown(context.Background())
+
+	for _, c := range []struct {
+		method string
+		etag   string
+		status int
+		body   string
+	}{
+		{MethodHead, "", http.StatusOK, ""},
+		{MethodGet, "x", http.StatusNotModified, ""},
+		{MethodGet, "", http.StatusOK, "hello"},
+	} {
+		req, _ := http.NewRequest(c.method, "http://"+addr+"/", nil)
+		if len(c.etag) > 0 {
+			req.Header.Set("If-None-Match", c.etag)
+		}
+		res, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		if res.StatusCode != c.status || res.Header.Get(HeaderContentLength) != "5" || string(body) != c.body {
+			t.Fatalf("%s %d: unexpected response: %d %q %q", c.method, c.status, res.StatusCode, res.Header.Get(HeaderContentLength), body)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package sha
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SSEHeartbeatInterval is the interval of the heartbeat comments, zero disables heartbeat.
+var SSEHeartbeatInterval = time.Second * 15
+
+type SSEEvent struct {
+	ID    string
+	Event string
+	Retry time.Duration
+	Data  []byte
+}
+
+// ErrBadSSEField is returned if the `id`, the `event` or a comment contains a line break.
+var ErrBadSSEField = errors.New("sha.sse: the field can not contain line breaks")
+
+type SSEWriter struct {
+	ctx    *RequestCtx
+	mutex  sync.Mutex
+	cancel func()
+	err    error
+}
+
+// LastEventID returns the value of the `Last-Event-ID` header sent by a reconnecting client.
+func (w *SSEWriter) LastEventID() string {
+	v, _ := w.ctx.Request.Header.Get(HeaderLastEventID)
+	return string(v)
+}
+
+func (w *SSEWriter) flush() error {
+	if w.err = w.ctx.Flush(); w.err != nil {
+		w.cancel()
+	}
+	return w.err
+}
+
+func (w *SSEWriter) writeField(name string, value []byte) {
+	_, _ = w.ctx.WriteString(name)
+	_, _ = w.ctx.WriteString(": ")
+	_, _ = w.ctx.Write(value)
+	_, _ = w.ctx.WriteString("\n")
+}
+
+// Send writes an event to the client. Multi-line data is sent as multiple `data` fields.
+func (w *SSEWriter) Send(event *SSEEvent) error {
+	if strings.ContainsAny(event.ID, "\r\n") || strings.ContainsAny(event.Event, "\r\n") {
+		return ErrBadSSEField
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+
+	if len(event.ID) > 0 {
+		w.writeField("id", []byte(event.ID))
+	}
+	if len(event.Event) > 0 {
+		w.writeField("event", []byte(event.Event))
+	}
+	if event.Retry > 0 {
+		w.writeField("retry", []byte(strconv.FormatInt(event.Retry.Milliseconds(), 10)))
+	}
+	// a lone CR is a line break for the client too
+	data := bytes.ReplaceAll(event.Data, []byte("\r\n"), []byte("\n"))
+	data = bytes.ReplaceAll(data, []byte("\r"), []byte("\n"))
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		w.writeField("data", line)
+	}
+	_, _ = w.ctx.WriteString("\n")
+	return w.flush()
+}
+
+func (w *SSEWriter) SendData(data []byte) error { return w.Send(&SSEEvent{Data: data}) }
+
+// Comment writes a comment line, which is ignored by the client and can be used to keep the connection alive.
+func (w *SSEWriter) Comment(v string) error {
+	if strings.ContainsAny(v, "\r\n") {
+		return ErrBadSSEField
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+
+	_, _ = w.ctx.WriteString(":")
+	_, _ = w.ctx.WriteString(v)
+	_, _ = w.ctx.WriteString("\n\n")
+	return w.flush()
+}
+
+func (w *SSEWriter) heartbeat(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if w.Comment("") != nil {
+				return
+			}
+		}
+	}
+}
+
+type SSEHandlerFunc func(ctx context.Context, req *Request, w *SSEWriter)
+
+var sseCacheControl = []byte("no-cache")
+
+func sseToHandler(h SSEHandlerFunc) RequestHandler {
+	return RequestHandlerFunc(func(ctx *RequestCtx) {
+		res := &ctx.Response
+		res.freeCompressWriter() // intermediaries may buffer compressed streams
+		res.Header.Del(HeaderContentEncoding)
+		res.Header.SetContentType(MIMEEventStream)
+		res.Header.Set(HeaderCacheControl, sseCacheControl)
+		ctx.Close() // the connection can not be reused reliably after a long-lived stream
+		if err := ctx.Flush(); err != nil {
+			return
+		}
+
+		var cctx context.Context
+		w := &SSEWriter{ctx: ctx}
+		cctx, w.cancel = context.WithCancel(ctx.ctx)
+		defer func() {
+			w.mutex.Lock()
+			w.err = context.Canceled // stop the heartbeat writing after the handler returned
+			w.mutex.Unlock()
+			w.cancel()
+		}()
+
+		if SSEHeartbeatInterval > 0 {
+			go w.heartbeat(cctx, SSEHeartbeatInterval)
+		}
+		h(cctx, &ctx.Request, w)
+	})
+}
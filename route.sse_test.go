@@ -0,0 +1,61 @@
+package sha
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMux_SSE(t *testing.T) {
+	done := make(chan struct{})
+	mux := NewMux(nil)
+	mux.SSE("/events", func(ctx context.Context, req *Request, w *SSEWriter) {
+		_ = w.Send(&SSEEvent{ID: "2", Event: "greeting", Data: []byte("hello\nworld")})
+		// a lone CR can not start a new field
+		_ = w.SendData([]byte("x\rid: 1\r\ny\r\revent: evil"))
+		_ = w.Comment("ping")
+		if w.LastEventID() != "1" {
+			t.Errorf("bad last event id: %s", w.LastEventID())
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second * 5):
+			t.Error("context is not canceled after the client closed the connection")
+		}
+		close(done)
+	}, nil)
+
+	s, addr := startTestServer(t, mux)
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("GET /events HTTP/1.1\r\nHost: a\r\nLast-Event-ID: 1\r\n\r\n"))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Header.Get(HeaderContentType) != MIMEEventStream {
+		t.Fatalf("bad content type: %s", res.Header.Get(HeaderContentType))
+	}
+
+	expected := "id: 2\nevent: greeting\ndata: hello\ndata: world\n\n" +
+		"data: x\ndata: id: 1\ndata: y\ndata: \ndata: event: evil\n\n" +
+		":ping\n\n"
+	buf := make([]byte, len(expected))
+	if _, err = io.ReadFull(res.Body, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != expected {
+		t.Fatalf("bad events: %q", buf)
+	}
+
+	_ = conn.Close()
+	<-done
+}
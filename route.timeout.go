@@ -0,0 +1,42 @@
+package sha
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// timeoutHandler cancels the request context after the duration, and responds 503 if the handler is timed out.
+// The handler is not interrupted and the 503 is sent after it returns, because the request and the response
+// are owned by the handler until then. So the handler is expected to return soon after the context is done,
+// e.g. the database queries using the context, a handler ignoring the context keeps the client waiting.
+func timeoutHandler(h RequestHandler, timeout time.Duration) RequestHandler {
+	return RequestHandlerFunc(func(ctx *RequestCtx) {
+		parent := ctx.ctx
+		var cancel func()
+		ctx.ctx, cancel = context.WithTimeout(parent, timeout)
+
+		defer func() {
+			timedOut := ctx.ctx.Err() == context.DeadlineExceeded
+			cancel()
+			ctx.ctx = parent
+			if !timedOut || ctx.hijacked || ctx.Response.headerSent {
+				return
+			}
+
+			// the panic caused by the done context is recovered, the others are not related to the timeout
+			if v := recover(); v != nil {
+				if err, ok := v.(error); !ok || !(errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)) {
+					panic(v)
+				}
+			}
+			ctx.err = nil
+			ctx.Response.freeCompressWriter()
+			ctx.Response.Header.Reset()
+			ctx.Response.ResetBodyBuffer()
+			ctx.SetStatus(StatusServiceUnavailable)
+		}()
+
+		h.Handle(ctx)
+	})
+}
@@ -0,0 +1,83 @@
+package sha
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMux_HandlerTimeout(t *testing.T) {
+	mux := NewMux(nil)
+	mux.HTTPWithOptions(&HandlerOptions{Timeout: time.Millisecond * 50}, MethodGet, "/slow", RequestHandlerFunc(func(ctx *RequestCtx) {
+		<-ctx.Done()
+		_, _ = ctx.WriteString("late")
+	}))
+	mux.HTTPWithOptions(&HandlerOptions{Timeout: time.Second}, MethodGet, "/fast", RequestHandlerFunc(func(ctx *RequestCtx) {
+		_, _ = ctx.WriteString("ok")
+	}))
+	_, addr := startTestServer(t, mux)
+
+	for path, expected := range map[string]int{"/slow": http.StatusServiceUnavailable, "/fast": http.StatusOK} {
+		res, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		if res.StatusCode != expected || (expected == http.StatusServiceUnavailable && len(body) != 0) {
+			t.Fatalf("%s: bad response %d %q", path, res.StatusCode, body)
+		}
+	}
+}
+
+func TestMux_HandlerTimeoutPanic(t *testing.T) {
+	mux := NewMux(nil)
+	mux.HTTPWithOptions(&HandlerOptions{Timeout: time.Millisecond * 50}, MethodGet, "/canceled", RequestHandlerFunc(func(ctx *RequestCtx) {
+		<-ctx.Done()
+		panic(fmt.Errorf("query: %w", ctx.Err()))
+	}))
+	mux.HTTPWithOptions(&HandlerOptions{Timeout: time.Millisecond * 50}, MethodGet, "/bug", RequestHandlerFunc(func(ctx *RequestCtx) {
+		<-ctx.Done()
+		var m map[string]int
+		m["a"]++
+	}))
+	_, addr := startTestServer(t, mux)
+
+	for path, expected := range map[string]int{"/canceled": http.StatusServiceUnavailable, "/bug": http.StatusInternalServerError} {
+		res, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+		if res.StatusCode != expected {
+			t.Fatalf("%s: expected %d, got %d", path, expected, res.StatusCode)
+		}
+	}
+}
+
+func TestMux_HandlerTimeoutIgnored(t *testing.T) {
+	mux := NewMux(nil)
+	mux.HTTPWithOptions(&HandlerOptions{Timeout: time.Millisecond * 50}, MethodGet, "/busy", RequestHandlerFunc(func(ctx *RequestCtx) {
+		// the context is ignored, e.g. cpu bound work
+		time.Sleep(time.Millisecond * 300)
+		_, _ = ctx.WriteString("late")
+	}))
+	_, addr := startTestServer(t, mux)
+
+	begin := time.Now()
+	res, err := http.Get("http://" + addr + "/busy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	// the 503 is sent after the handler returns, and the late write is discarded
+	if res.StatusCode != http.StatusServiceUnavailable || len(body) != 0 {
+		t.Fatalf("bad response %d %q", res.StatusCode, body)
+	}
+	if elapsed := time.Since(begin); elapsed < time.Millisecond*300 {
+		t.Fatalf("the response is sent before the handler returns: %s", elapsed)
+	}
+}
@@ -18,8 +18,16 @@ func (m *_MuxGroup) Websocket(path string, handlerFunc WebsocketHandlerFunc, opt
 	m.HTTPWithOptions(opt, "get", path, wshToHandler(handlerFunc))
 }
 
+func (m *_MuxGroup) SSE(path string, handlerFunc SSEHandlerFunc, opt *HandlerOptions) {
+	m.HTTPWithOptions(opt, "get", path, sseToHandler(handlerFunc))
+}
+
 func (m *_MuxGroup) FileSystem(opt *HandlerOptions, method, path string, fs http.FileSystem, autoIndex bool) {
-	m.HTTPWithOptions(opt, method, path, makeFileSystemHandler(path, fs, autoIndex))
+	m.FileSystemWithOptions(opt, method, path, fs, &FileSystemOption{AutoIndex: autoIndex})
+}
+
+func (m *_MuxGroup) FileSystemWithOptions(opt *HandlerOptions, method, path string, fs http.FileSystem, fsOpt *FileSystemOption) {
+	m.HTTPWithOptions(opt, method, path, makeFileSystemHandler(path, fs, fsOpt))
 }
 
 func (m *_MuxGroup) FileContent(opt *HandlerOptions, method, path, filepath string) {
@@ -54,6 +62,7 @@ func (m *_MuxGroup) add(childMiddlewares []Middleware, method, path string, hand
 		} else {
 			nopt := &HandlerOptions{}
 			nopt.Document = opt.Document
+			nopt.Timeout = opt.Timeout
 			nopt.Middlewares = append(nopt.Middlewares, ms...)
 			nopt.Middlewares = append(nopt.Middlewares, opt.Middlewares...)
 			opt = nopt
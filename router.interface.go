@@ -3,6 +3,7 @@ package sha
 import (
 	"github.com/zzztttkkk/sha/validator"
 	"net/http"
+	"time"
 )
 
 type Middleware interface {
@@ -18,13 +19,18 @@ func (f MiddlewareFunc) Process(ctx *RequestCtx, next func()) {
 type HandlerOptions struct {
 	Middlewares []Middleware
 	Document    validator.Document
+	// Timeout cancels the request context and responds 503 if the handler does not return in time, zero means no timeout.
+	// The 503 is sent after the handler returns, so the handler should stop its work when the context is done.
+	Timeout time.Duration
 }
 
 type Router interface {
 	HTTPWithOptions(opt *HandlerOptions, method, path string, handler RequestHandler)
 	HTTP(method, path string, handler RequestHandler)
 	Websocket(path string, handlerFunc WebsocketHandlerFunc, opt *HandlerOptions)
+	SSE(path string, handlerFunc SSEHandlerFunc, opt *HandlerOptions)
 	FileSystem(opt *HandlerOptions, method, path string, fs http.FileSystem, autoIndex bool)
+	FileSystemWithOptions(opt *HandlerOptions, method, path string, fs http.FileSystem, fsOpt *FileSystemOption)
 	FileContent(opt *HandlerOptions, method, path, filepath string)
 
 	Use(middlewares ...Middleware)
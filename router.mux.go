@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 )
 
 type MuxOptions struct {
@@ -77,9 +78,11 @@ func isFileContentHandler(h RequestHandler) bool {
 func (m *Mux) HTTPWithOptions(opt *HandlerOptions, method, path string, handler RequestHandler) {
 	var middlewares []Middleware
 	var document validator.Document
+	var timeout time.Duration
 	if opt != nil {
 		middlewares = opt.Middlewares
 		document = opt.Document
+		timeout = opt.Timeout
 	}
 
 	method = strings.ToUpper(method)
@@ -131,6 +134,12 @@ func (m *Mux) HTTPWithOptions(opt *HandlerOptions, method, path string, handler
 		if len(ms) > 0 {
 			handler = middlewaresWrap(ms, handler)
 		}
+		if timeout > 0 {
+			handler = timeoutHandler(handler, timeout)
+		}
+		if streamer, ok := rawHandler.(_RequestBodyStreamer); ok {
+			handler = &_StreamedBodyHandler{RequestHandler: handler, streamer: streamer}
+		}
 	}
 
 	path = m.prefix + path
@@ -162,7 +171,11 @@ func (m *Mux) HTTPWithOptions(opt *HandlerOptions, method, path string, handler
 
 	handlerDesc := ""
 	if isFileSystemHandler(rawHandler) {
-		handlerDesc = fmt.Sprintf("FileSystem %s, auto_index=%v", rawHandler.(*_FileSystemHandler).fs, rawHandler.(*_FileSystemHandler).autoIndex)
+		fh := rawHandler.(*_FileSystemHandler)
+		handlerDesc = fmt.Sprintf(
+			"FileSystem %s, auto_index=%v, precompressed=%v, manifest=%v",
+			fh.fs, fh.option.AutoIndex, fh.option.Precompressed, fh.option.Manifest != nil,
+		)
 	} else if isFileContentHandler(rawHandler) {
 		handlerDesc = fmt.Sprintf("FileContent %s", rawHandler.(*_FileContentHandler).fp)
 	}
@@ -180,28 +193,40 @@ func (m *Mux) Websocket(path string, handlerFunc WebsocketHandlerFunc, opt *Hand
 	m.HTTPWithOptions(opt, "get", path, wshToHandler(handlerFunc))
 }
 
+func (m *Mux) SSE(path string, handlerFunc SSEHandlerFunc, opt *HandlerOptions) {
+	m.HTTPWithOptions(opt, "get", path, sseToHandler(handlerFunc))
+}
+
 type _FileSystemHandler struct {
-	fs        http.FileSystem
-	autoIndex bool
+	fs     http.FileSystem
+	option FileSystemOption
 }
 
 func (fh *_FileSystemHandler) Handle(ctx *RequestCtx) {
 	fp, _ := ctx.URLParam("filepath")
-	serveFileSystem(ctx, fh.fs, filepath.Clean(utils.S(fp)), fh.autoIndex)
+	serveFileSystem(ctx, fh.fs, filepath.Clean(utils.S(fp)), &fh.option)
 }
 
-func makeFileSystemHandler(path string, fs http.FileSystem, autoIndex bool) RequestHandler {
+func makeFileSystemHandler(path string, fs http.FileSystem, option *FileSystemOption) RequestHandler {
 	if !strings.HasSuffix(path, "/{filepath:*}") {
 		panic(fmt.Errorf("sha.mux: path must endswith `/{filepath:*}`"))
 	}
-	return &_FileSystemHandler{autoIndex: autoIndex, fs: fs}
+	fh := &_FileSystemHandler{fs: fs}
+	if option != nil {
+		fh.option = *option
+	}
+	return fh
 }
 
 func (m *Mux) FileSystem(opt *HandlerOptions, method, path string, fs http.FileSystem, autoIndex bool) {
+	m.FileSystemWithOptions(opt, method, path, fs, &FileSystemOption{AutoIndex: autoIndex})
+}
+
+func (m *Mux) FileSystemWithOptions(opt *HandlerOptions, method, path string, fs http.FileSystem, fsOpt *FileSystemOption) {
 	m.HTTPWithOptions(
 		opt,
 		method, path,
-		makeFileSystemHandler(path, fs, autoIndex),
+		makeFileSystemHandler(path, fs, fsOpt),
 	)
 }
 
@@ -215,7 +240,7 @@ func (fh *_FileContentHandler) Handle(ctx *RequestCtx) {
 		ctx.SetStatus(toHTTPError(e))
 		return
 	}
-	defer f.Close()
+	defer ctx.Response.closeFile(f)
 	d, err := f.Stat()
 	if err != nil {
 		ctx.SetStatus(toHTTPError(err))
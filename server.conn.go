@@ -0,0 +1,228 @@
+package sha
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+type ConnState int
+
+const (
+	// ConnStateNew is the state of an accepted connection that has not sent any data.
+	ConnStateNew = ConnState(iota)
+	// ConnStateActive is the state of a connection that is reading or serving a request,
+	// a http2 connection is active while any stream is open.
+	ConnStateActive
+	// ConnStateIdle is the state of a keep-alive connection between requests.
+	ConnStateIdle
+	// ConnStateHijacked is the state of a connection that is hijacked by a handler, e.g. websocket.
+	// A hijacked connection turns to ConnStateClosed after the handler returns.
+	ConnStateHijacked
+	// ConnStateClosed is the final state.
+	ConnStateClosed
+)
+
+var connStateNames = []string{"new", "active", "idle", "hijacked", "closed"}
+
+func (state ConnState) String() string {
+	if state < 0 || int(state) >= len(connStateNames) {
+		return "unknown"
+	}
+	return connStateNames[state]
+}
+
+type _ConnInfo struct {
+	// atomic, keep them 64-bit aligned
+	requests     int64
+	bytesRead    int64
+	bytesWritten int64
+
+	state      ConnState
+	acceptTime time.Time
+	onShutdown func()
+	proxy      *ProxyHeader
+}
+
+// ConnInfo is a snapshot of a connection.
+type ConnInfo struct {
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+	State      ConnState
+	AcceptedAt time.Time
+	// Requests is the number of the requests read from the connection, including the one being served.
+	Requests int64
+	// BytesRead and BytesWritten are the raw bytes, including the tls handshakes and records.
+	BytesRead    int64
+	BytesWritten int64
+	// Proxy is the PROXY protocol header, nil if the connection does not send it.
+	Proxy *ProxyHeader
+}
+
+func (info *ConnInfo) Age() time.Duration { return time.Since(info.AcceptedAt) }
+
+// _TrackedConn counts the bytes of an accepted connection.
+type _TrackedConn struct {
+	net.Conn
+	info *_ConnInfo
+
+	// the addresses sent by the PROXY protocol
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *_TrackedConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *_TrackedConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *_TrackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.info.bytesRead, int64(n))
+	return n, err
+}
+
+func (c *_TrackedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.info.bytesWritten, int64(n))
+	return n, err
+}
+
+type _WriterOnly struct{ io.Writer }
+
+// ReadFrom keeps the sendfile of *net.TCPConn.
+func (c *_TrackedConn) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+		atomic.AddInt64(&c.info.bytesWritten, n)
+	} else {
+		n, err = io.Copy(_WriterOnly{c}, r)
+	}
+	return n, err
+}
+
+func (s *Server) lookupConn(conn net.Conn) *_ConnInfo {
+	s.connsMutex.Lock()
+	info := s.conns[conn]
+	s.connsMutex.Unlock()
+	return info
+}
+
+func (s *Server) connAcceptTime(conn net.Conn) time.Time {
+	if info := s.lookupConn(conn); info != nil {
+		return info.acceptTime
+	}
+	return time.Now()
+}
+
+func (s *Server) countConnRequest(conn net.Conn) {
+	if info := s.lookupConn(conn); info != nil {
+		atomic.AddInt64(&info.requests, 1)
+	}
+}
+
+func (info *_ConnInfo) snapshot(conn net.Conn, state ConnState) ConnInfo {
+	return ConnInfo{
+		RemoteAddr:   conn.RemoteAddr(),
+		LocalAddr:    conn.LocalAddr(),
+		State:        state,
+		AcceptedAt:   info.acceptTime,
+		Requests:     atomic.LoadInt64(&info.requests),
+		BytesRead:    atomic.LoadInt64(&info.bytesRead),
+		BytesWritten: atomic.LoadInt64(&info.bytesWritten),
+		Proxy:        info.proxy,
+	}
+}
+
+// trackConn registers the connection, and returns the wrapper of it that should be served.
+func (s *Server) trackConn(conn net.Conn) net.Conn {
+	tc := &_TrackedConn{Conn: conn, info: &_ConnInfo{state: ConnStateNew, acceptTime: time.Now()}}
+	s.connsMutex.Lock()
+	if s.conns == nil {
+		s.conns = map[net.Conn]*_ConnInfo{}
+	}
+	s.conns[tc] = tc.info
+	s.connsMutex.Unlock()
+	s.onConnState(tc, ConnStateNew)
+	return tc
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.connsMutex.Lock()
+	_, ok := s.conns[conn]
+	delete(s.conns, conn)
+	s.connsMutex.Unlock()
+	if ok { // the connections closed by Shutdown are reported there
+		s.onConnState(conn, ConnStateClosed)
+	}
+}
+
+// retrackConn replaces the tracked connection with a wrapper of it.
+func (s *Server) retrackConn(conn, wrapper net.Conn) {
+	s.connsMutex.Lock()
+	if info := s.conns[conn]; info != nil {
+		delete(s.conns, conn)
+		s.conns[wrapper] = info
+	}
+	s.connsMutex.Unlock()
+}
+
+func (s *Server) setConnState(conn net.Conn, state ConnState) {
+	changed := false
+	s.connsMutex.Lock()
+	if info := s.conns[conn]; info != nil && info.state != state {
+		info.state = state
+		changed = true
+	}
+	s.connsMutex.Unlock()
+	if changed {
+		s.onConnState(conn, state)
+	}
+}
+
+func (s *Server) onConnState(conn net.Conn, state ConnState) {
+	if s.OnConnState != nil {
+		s.OnConnState(conn, state)
+	}
+}
+
+// Connections returns the snapshots of the live connections.
+func (s *Server) Connections() []ConnInfo {
+	s.connsMutex.Lock()
+	defer s.connsMutex.Unlock()
+	rv := make([]ConnInfo, 0, len(s.conns))
+	for conn, info := range s.conns {
+		rv = append(rv, info.snapshot(conn, info.state))
+	}
+	return rv
+}
+
+// ConnInfo returns the snapshot of the connection of the request.
+// The state is ConnStateActive, or ConnStateHijacked after Hijack.
+func (ctx *RequestCtx) ConnInfo() ConnInfo {
+	state := ConnStateActive
+	if ctx.hijacked {
+		state = ConnStateHijacked
+	}
+	if serv, ok := ctx.Value(CtxKeyServer).(*Server); ok {
+		if info := serv.lookupConn(ctx.conn); info != nil {
+			return info.snapshot(ctx.conn, state)
+		}
+	}
+	return ConnInfo{RemoteAddr: ctx.conn.RemoteAddr(), LocalAddr: ctx.conn.LocalAddr(), State: state, AcceptedAt: ctx.connTime}
+}
+
+// ConnAge returns the duration since the connection of the request is accepted.
+func (ctx *RequestCtx) ConnAge() time.Duration { return time.Since(ctx.connTime) }
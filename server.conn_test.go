@@ -0,0 +1,91 @@
+package sha
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServer_ConnState(t *testing.T) {
+	var mutex sync.Mutex
+	var states []string
+	closed := make(chan struct{}, 2)
+
+	s := New(nil, &ServerOption{Addr: "127.0.0.1:0"}, nil, nil)
+	s.OnConnState = func(conn net.Conn, state ConnState) {
+		mutex.Lock()
+		states = append(states, state.String())
+		mutex.Unlock()
+		if state == ConnStateClosed {
+			closed <- struct{}{}
+		}
+	}
+	s.Handler = RequestHandlerFunc(func(ctx *RequestCtx) {
+		if string(ctx.Request.Path) == "/hijack" {
+			conn := ctx.Hijack()
+			_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+			return
+		}
+		info := ctx.ConnInfo()
+		_, _ = ctx.WriteString(fmt.Sprintf("%d %s %v", info.Requests, info.State, info.BytesRead > 0))
+	})
+	addr := serveTestServer(t, s)
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	for i := 1; i <= 2; i++ {
+		_, _ = conn.Write([]byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n"))
+		res, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		if string(body) != fmt.Sprintf("%d active true", i) {
+			t.Fatalf("unexpected body: %q", body)
+		}
+	}
+
+	conns := s.Connections()
+	if len(conns) != 1 || conns[0].State != ConnStateIdle || conns[0].Requests != 2 || conns[0].BytesWritten < 1 ||
+		conns[0].RemoteAddr.String() != conn.LocalAddr().String() {
+		t.Fatalf("unexpected connections: %+v", conns)
+	}
+	_ = conn.Close()
+	<-closed
+
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("GET /hijack HTTP/1.1\r\nHost: a\r\n\r\n"))
+	if _, err = http.ReadResponse(bufio.NewReader(conn), nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("the hijacked connection is not closed")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	expected := "new active idle active idle closed new active hijacked closed"
+	if strings.Join(states, " ") != expected {
+		t.Fatalf("unexpected states: %v", states)
+	}
+	if len(s.Connections()) != 0 {
+		t.Fatalf("unexpected connections: %+v", s.Connections())
+	}
+}
@@ -1,8 +1,10 @@
 package sha
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
+	"errors"
 	"github.com/imdario/mergo"
 	"github.com/zzztttkkk/sha/internal"
 	"github.com/zzztttkkk/sha/utils"
@@ -11,6 +13,9 @@ import (
 	"io"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
@@ -20,11 +25,43 @@ type ServerOption struct {
 		AutoCertDomains []string `json:"auto_cert_domains" toml:"auto-cert-domains"`
 		Key             string   `json:"key" toml:"key"`
 		Cert            string   `json:"cert" toml:"cert"`
+		// Certificates are selected by SNI with Cert, the first one is the default.
+		Certificates []TLSCertificateOption `json:"certificates" toml:"certificates"`
+		// ReloadInterval polls the certificate files, and reloads them if any of them is changed, zero means disabled.
+		ReloadInterval utils.TomlDuration `json:"reload_interval" toml:"reload-interval"`
+		// ClientAuth is `request` or `require`, the client certificates are verified against ClientCA, a PEM bundle.
+		ClientAuth string `json:"client_auth" toml:"client-auth"`
+		ClientCA   string `json:"client_ca" toml:"client-ca"`
 	} `json:"tls" toml:"tls"`
+	// MaxConnectionKeepAlive is the max lifetime of a connection to be reused by the keep-alive requests,
+	// the hijacked connections and the requests being served are not affected.
 	MaxConnectionKeepAlive utils.TomlDuration `json:"max_connection_keep_alive" toml:"max-connection-keep-alive"`
 	ReadTimeout            utils.TomlDuration `json:"read_timeout" toml:"read-timeout"`
 	IdleTimeout            utils.TomlDuration `json:"idle_timeout" toml:"idle-timeout"`
 	WriteTimeout           utils.TomlDuration `json:"write_timeout" toml:"write-timeout"`
+
+	// Addrs are the listen addresses, e.g. `tcp://[::]:443`, `unix:///run/app.sock`, Addr is used if it is empty.
+	// The listeners passed by systemd socket activation or a parent process(`LISTEN_FDS`) are used instead if any.
+	Addrs []string `json:"addrs" toml:"addrs"`
+	// ReusePort is the number of the SO_REUSEPORT listeners of each tcp address, 0 means disabled.
+	ReusePort int `json:"reuse_port" toml:"reuse-port"`
+
+	// MaxConnections and MaxConnectionsPerIP cap the concurrent connections, 0 means no limit.
+	// The connections over the caps are closed after accepted, see `Server.ConnRejections`.
+	MaxConnections      int `json:"max_connections" toml:"max-connections"`
+	MaxConnectionsPerIP int `json:"max_connections_per_ip" toml:"max-connections-per-ip"`
+
+	// TrustedProxies are the CIDRs of the proxies, whose `Forwarded`, `X-Forwarded-*` and `X-Real-IP` headers are used
+	// by `RequestCtx.ClientIP`, `RequestCtx.Scheme` and `RequestCtx.Host`.
+	TrustedProxies []string `json:"trusted_proxies" toml:"trusted-proxies"`
+
+	// ProxyProtocol reads the PROXY protocol v1/v2 header before tls,
+	// the connections from TrustedCIDRs(empty means all) must send it, the others are served as usual.
+	ProxyProtocol struct {
+		Enabled       bool               `json:"enabled" toml:"enabled"`
+		TrustedCIDRs  []string           `json:"trusted_cidrs" toml:"trusted-cidrs"`
+		HeaderTimeout utils.TomlDuration `json:"header_timeout" toml:"header-timeout"`
+	} `json:"proxy_protocol" toml:"proxy-protocol"`
 }
 
 var defaultServerOption = ServerOption{
@@ -32,22 +69,50 @@ var defaultServerOption = ServerOption{
 	MaxConnectionKeepAlive: utils.TomlDuration{Duration: time.Minute * 5},
 }
 
+const defaultProxyProtocolHeaderTimeout = time.Second * 5
+
 type Server struct {
 	option      ServerOption
 	readTimeout time.Duration
 
 	OnConnectionAccepted func(conn net.Conn) bool
+	// OnConnState is called when a connection changes its state, on the goroutine that serves the connection.
+	// conn is the wrapper of the accepted one, use `Server.Connections` or `RequestCtx.ConnInfo` to get the details.
+	OnConnState func(conn net.Conn, state ConnState)
+	// OnExpectContinue is called when the header of a request with `Expect: 100-continue` is parsed, before the body is read.
+	// Return false to reject the upload, the response status is 417 if it is not set.
+	OnExpectContinue func(ctx *RequestCtx) bool
 
 	baseCtx           context.Context
 	Handler           RequestHandler
 	httpProtocol      HTTPProtocol
+	http2Protocol     HTTPProtocol
 	websocketProtocol WebSocketProtocol
 
-	tls          *tls.Config
-	isTls        bool
-	beforeAccept []func(s *Server)
+	tls           *tls.Config
+	isTls         bool
+	certs         *_CertStore
+	certsOnce     sync.Once
+	proxyProtocol *_ProxyProtocol
+
+	trustedProxies []*net.IPNet
+	beforeAccept   []func(s *Server)
+	prepareOnce    sync.Once
+
+	// shutdown
+	shutdown   int32
+	listeners  []net.Listener
+	conns      map[net.Conn]*_ConnInfo
+	connsMutex sync.Mutex
+
+	// guarded by connsMutex
+	admitted     int
+	admittedByIP map[string]int
+	rejections   ConnRejections
 }
 
+var ErrServerClosed = errors.New("sha: server closed")
+
 func (s *Server) IsTLS() bool { return s.isTls }
 
 type HTTPProtocol interface {
@@ -105,6 +170,13 @@ func New(ctx context.Context, opt *ServerOption, httpProtocol HTTPProtocol, webS
 	}
 
 	server.readTimeout = server.option.ReadTimeout.Duration
+	server.trustedProxies = parseCIDRs(server.option.TrustedProxies)
+	if pp := &server.option.ProxyProtocol; pp.Enabled {
+		if pp.HeaderTimeout.Duration <= 0 {
+			pp.HeaderTimeout.Duration = defaultProxyProtocolHeaderTimeout
+		}
+		server.proxyProtocol = newProxyProtocol(pp.TrustedCIDRs, pp.HeaderTimeout.Duration)
+	}
 	return server
 }
 
@@ -114,52 +186,57 @@ func Default(handler RequestHandler) *Server {
 	return rv
 }
 
-func (s *Server) BeforeAccept(fn func(s *Server)) {
-	s.beforeAccept = append(s.beforeAccept, fn)
+// EnableHTTP2 serves http2 connections negotiated by tls ALPN `h2`,
+// and the cleartext ones if option.H2C is true.
+func (s *Server) EnableHTTP2(option *HTTP2Option) {
+	s.http2Protocol = NewHTTP2Protocol(option)
 }
 
-func (s *Server) doListen() net.Listener {
-	log.Printf("sha: listening at `%s`\n", s.option.Addr)
-
-	listener, err := net.Listen("tcp4", s.option.Addr)
-	if err != nil {
-		panic(err)
-	}
-	return listener
+func (s *Server) BeforeAccept(fn func(s *Server)) {
+	s.beforeAccept = append(s.beforeAccept, fn)
 }
 
-func (s *Server) enableTls(l net.Listener, certFile, keyFile string) net.Listener {
-	if certFile == "" || keyFile == "" {
-		panic("sha: empty tls file")
-	}
-
+func (s *Server) enableTls() {
 	if s.tls == nil {
 		s.tls = &tls.Config{}
 	}
 
+	if s.http2Protocol != nil && !internal.StrSliceContains(s.tls.NextProtos, "h2") {
+		s.tls.NextProtos = append([]string{"h2"}, s.tls.NextProtos...)
+	}
 	if !internal.StrSliceContains(s.tls.NextProtos, "http/1.1") {
 		s.tls.NextProtos = append(s.tls.NextProtos, "http/1.1")
 	}
 	configHasCert := len(s.tls.Certificates) > 0 || s.tls.GetCertificate != nil
 	if !configHasCert {
-		var err error
-		s.tls.Certificates = make([]tls.Certificate, 1)
-		s.tls.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
-		if err != nil {
-			panic(err)
-		}
+		s.useCertStore()
+	}
+	if s.tls.ClientAuth == tls.NoClientCert {
+		s.enableClientAuth()
 	}
-	return tls.NewListener(l, s.tls)
+}
+
+func (s *Server) prepare() {
+	s.prepareOnce.Do(func() {
+		for _, fn := range serverPrepareFunc {
+			fn(s)
+		}
+		for _, fn := range s.beforeAccept {
+			fn(s)
+		}
+		s.baseCtx = context.WithValue(s.baseCtx, CtxKeyServer, s)
+	})
+}
+
+// ServeConn serves a connection that is not accepted by the server, e.g. one end of `net.Pipe`.
+// It returns after the connection is closed.
+func (s *Server) ServeConn(conn net.Conn) {
+	s.prepare()
+	s.serveConn(s.trackConn(conn))
 }
 
 func (s *Server) serve(l net.Listener) {
-	for _, fn := range serverPrepareFunc {
-		fn(s)
-	}
-	for _, fn := range s.beforeAccept {
-		fn(s)
-	}
-	s.baseCtx = context.WithValue(s.baseCtx, CtxKeyServer, s)
+	s.prepare()
 
 	var tempDelay time.Duration
 	var serveFunc func(conn net.Conn)
@@ -168,22 +245,22 @@ func (s *Server) serve(l net.Listener) {
 		serveFunc = s.serveTLS
 	}
 
-	f := true
+	done := make(chan struct{})
+	defer close(done)
 	go func() {
-		for {
-			select {
-			case <-s.baseCtx.Done():
-				f = false
-				_ = l.Close()
-			}
+		select {
+		case <-s.baseCtx.Done():
+			_ = l.Close()
+		case <-done:
 		}
 	}()
 
-	maxKeepAlive := s.option.MaxConnectionKeepAlive.Duration
-
-	for f {
+	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if s.inShutdown() || s.baseCtx.Err() != nil {
+				return
+			}
 			log.Printf("sha.server: bad connection: %s\n", err.Error())
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				if tempDelay == 0 {
@@ -198,32 +275,99 @@ func (s *Server) serve(l net.Listener) {
 			}
 			continue
 		}
+		tempDelay = 0
 		if s.OnConnectionAccepted != nil && !s.OnConnectionAccepted(conn) {
 			_ = conn.Close()
+			s.rejectConn(&s.rejections.Hook)
 			continue
 		}
+		ip, ok := s.admitConn(conn)
+		if !ok {
+			_ = conn.Close()
+			continue
+		}
+		go s.serveAccepted(s.trackConn(conn), ip, serveFunc)
+	}
+}
 
-		if maxKeepAlive > 0 {
-			_ = conn.SetDeadline(time.Now().Add(maxKeepAlive))
+func (s *Server) serveAccepted(conn net.Conn, ip string, serveFunc func(conn net.Conn)) {
+	defer s.releaseConn(ip)
+	if s.proxyProtocol != nil {
+		var err error
+		if conn, err = s.proxyProtocol.accept(s, conn); err != nil {
+			_ = conn.Close()
+			s.untrackConn(conn)
+			s.rejectConn(&s.rejections.ProxyProtocol)
+			return
 		}
-		go serveFunc(conn)
 	}
+	serveFunc(conn)
 }
 
-func (s *Server) ListenAndServe() {
-	if len(s.option.Tls.AutoCertDomains) > 0 {
-		s.isTls = true
-		s.serve(autocert.NewListener(s.option.Tls.AutoCertDomains...))
+// serveListeners serves the listeners until all of them are closed.
+func (s *Server) serveListeners(listeners []net.Listener) {
+	s.connsMutex.Lock()
+	s.listeners = append(s.listeners, listeners...)
+	s.connsMutex.Unlock()
+	if s.inShutdown() {
+		closeListeners(listeners)
 		return
 	}
 
-	if len(s.option.Tls.Cert) > 0 {
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			s.serve(l)
+		}(l)
+	}
+	wg.Wait()
+}
+
+// Serve serves the listeners, e.g. the ones created by `net.FileListener`,
+// tls is enabled by the certificates of `ServerOption.Tls` or `Server.SetCertificates`.
+func (s *Server) Serve(listeners ...net.Listener) {
+	s.prepare()
+	if s.tlsEnabled() {
 		s.isTls = true
-		s.serve(s.enableTls(s.doListen(), s.option.Tls.Cert, s.option.Tls.Key))
+		s.enableTls()
+	}
+	s.serveListeners(listeners)
+}
+
+// enableAutoCert is the same as `autocert.NewListener`, but the tls handshake is done in serveTLS.
+func (s *Server) enableAutoCert() net.Listener {
+	m := &autocert.Manager{Prompt: autocert.AcceptTOS, HostPolicy: autocert.HostWhitelist(s.option.Tls.AutoCertDomains...)}
+	if dir, err := os.UserCacheDir(); err == nil {
+		dir = filepath.Join(dir, "golang-autocert")
+		if err = os.MkdirAll(dir, 0700); err == nil {
+			m.Cache = autocert.DirCache(dir)
+		} else {
+			log.Printf("sha: autocert cache dir: %s\n", err.Error())
+		}
+	}
+	s.isTls = true
+	s.tls = m.TLSConfig()
+
+	l, err := net.Listen("tcp", ":443")
+	if err != nil {
+		panic(err)
+	}
+	return l
+}
+
+func (s *Server) ListenAndServe() {
+	if len(s.option.Tls.AutoCertDomains) > 0 {
+		s.serveListeners([]net.Listener{s.enableAutoCert()})
 		return
 	}
 
-	s.serve(s.doListen())
+	listeners, err := s.listen()
+	if err != nil {
+		panic(err)
+	}
+	s.Serve(listeners...)
 }
 
 var NonTLSRequestResponseMessage = `HTTP/1.0 400 Bad Request
@@ -240,12 +384,14 @@ UnSupportedTLSSubProtocol`
 
 func (s *Server) serveTLS(conn net.Conn) {
 	defer conn.Close()
+	tlsConn := tls.Server(conn, s.tls)
+	s.retrackConn(conn, tlsConn)
+	defer s.untrackConn(tlsConn)
 
-	var tlsConn = conn.(*tls.Conn)
 	var err error
 
-	if s.readTimeout > 0 {
-		_ = conn.SetReadDeadline(time.Now().Add(s.readTimeout))
+	if timeout := s.handshakeTimeout(); timeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
 	}
 	err = tlsConn.Handshake()
 	if err != nil { // tls handshake error
@@ -255,21 +401,57 @@ func (s *Server) serveTLS(conn net.Conn) {
 		return
 	}
 
+	protocol := s.httpProtocol
 	switch tlsConn.ConnectionState().NegotiatedProtocol {
 	case "", "http/1.0", "http/1.1":
+	case "h2":
+		if s.http2Protocol == nil {
+			_, _ = io.WriteString(tlsConn, UnSupportedTLSSubProtocolRequestResponseMessage)
+			return
+		}
+		protocol = s.http2Protocol
 	default:
 		_, _ = io.WriteString(tlsConn, UnSupportedTLSSubProtocolRequestResponseMessage)
 		return
 	}
 
+	_ = conn.SetReadDeadline(zeroTime)
+	protocol.ServeHTTPConn(context.WithValue(s.baseCtx, CtxKeyConnection, tlsConn), tlsConn)
+}
+
+// handshakeTimeout limits the time of the tls handshake and the http2 preface,
+// it is ReadTimeout, or the ReadHeaderTimeout of the http/1.1 protocol if ReadTimeout is zero.
+func (s *Server) handshakeTimeout() time.Duration {
 	if s.readTimeout > 0 {
-		_ = conn.SetReadDeadline(zeroTime)
+		return s.readTimeout
+	}
+	if protocol, ok := s.httpProtocol.(*_Http11Protocol); ok {
+		return protocol.ReadHeaderTimeout.Duration
 	}
-	s.httpProtocol.ServeHTTPConn(context.WithValue(s.baseCtx, CtxKeyConnection, tlsConn), tlsConn)
+	return 0
 }
 
 func (s *Server) serveConn(conn net.Conn) {
 	defer conn.Close()
+
+	if h2, ok := s.http2Protocol.(*_Http2Protocol); ok && h2.H2C {
+		// http2 with prior knowledge starts with the client preface
+		peeked := &_PeekedConn{Conn: conn, r: bufio.NewReader(conn)}
+		s.retrackConn(conn, peeked)
+		conn = peeked
+
+		if timeout := s.handshakeTimeout(); timeout > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+		if peekHttp2Preface(peeked.r) {
+			defer s.untrackConn(conn)
+			_ = conn.SetReadDeadline(zeroTime)
+			h2.ServeHTTPConn(context.WithValue(s.baseCtx, CtxKeyConnection, conn), conn)
+			return
+		}
+	}
+
+	defer s.untrackConn(conn)
 	s.httpProtocol.ServeHTTPConn(context.WithValue(s.baseCtx, CtxKeyConnection, conn), conn)
 }
 
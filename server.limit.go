@@ -0,0 +1,76 @@
+package sha
+
+import "net"
+
+// ConnRejections counts the accepted connections that are closed before serving.
+type ConnRejections struct {
+	Hook          int64 // by `Server.OnConnectionAccepted`
+	MaxConns      int64 // by `ServerOption.MaxConnections`
+	MaxConnsPerIP int64 // by `ServerOption.MaxConnectionsPerIP`
+	ProxyProtocol int64 // the bad or missing PROXY protocol headers
+}
+
+// ConnRejections returns the counters of the rejected connections.
+func (s *Server) ConnRejections() ConnRejections {
+	s.connsMutex.Lock()
+	defer s.connsMutex.Unlock()
+	return s.rejections
+}
+
+func (s *Server) rejectConn(counter *int64) {
+	s.connsMutex.Lock()
+	*counter++
+	s.connsMutex.Unlock()
+}
+
+func (s *Server) connLimited() bool {
+	return s.option.MaxConnections > 0 || s.option.MaxConnectionsPerIP > 0
+}
+
+// admitConn reserves a slot for the accepted connection until releaseConn,
+// ip is empty if the per-ip cap is disabled or the peer is not an ip one, e.g. unix sockets.
+// The peer is the one that connects to the server, the client behind a PROXY protocol balancer is not known yet.
+func (s *Server) admitConn(conn net.Conn) (ip string, ok bool) {
+	if !s.connLimited() {
+		return "", true
+	}
+	maxConns, maxPerIP := s.option.MaxConnections, s.option.MaxConnectionsPerIP
+	if addr, isTCP := conn.RemoteAddr().(*net.TCPAddr); isTCP && maxPerIP > 0 {
+		ip = addr.IP.String()
+	}
+
+	s.connsMutex.Lock()
+	defer s.connsMutex.Unlock()
+	if maxConns > 0 && s.admitted >= maxConns {
+		s.rejections.MaxConns++
+		return "", false
+	}
+	if len(ip) > 0 {
+		if s.admittedByIP[ip] >= maxPerIP {
+			s.rejections.MaxConnsPerIP++
+			return "", false
+		}
+		if s.admittedByIP == nil {
+			s.admittedByIP = map[string]int{}
+		}
+		s.admittedByIP[ip]++
+	}
+	s.admitted++
+	return ip, true
+}
+
+func (s *Server) releaseConn(ip string) {
+	if !s.connLimited() {
+		return
+	}
+	s.connsMutex.Lock()
+	defer s.connsMutex.Unlock()
+	s.admitted--
+	if len(ip) > 0 {
+		if s.admittedByIP[ip] > 1 {
+			s.admittedByIP[ip]--
+		} else {
+			delete(s.admittedByIP, ip)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package sha
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zzztttkkk/sha/utils"
+)
+
+func startTestLimitServer(t *testing.T, opt ServerOption, httpOpt HTTPOption) (*Server, string) {
+	opt.Addr = "127.0.0.1:0"
+	s := New(nil, &opt, NewHTTP11Protocol(&httpOpt), nil)
+	s.Handler = RequestHandlerFunc(func(ctx *RequestCtx) {
+		if string(ctx.Request.Path) == "/slow" {
+			time.Sleep(time.Millisecond * 300)
+		}
+		_, _ = ctx.WriteString("ok " + string(ctx.Request.BodyRaw()))
+	})
+	return s, serveTestServer(t, s)
+}
+
+// limitTestGet sends a request on the connection, and returns the response or the error.
+func limitTestGet(conn net.Conn, r *bufio.Reader) (*http.Response, string, error) {
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 2))
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n")); err != nil {
+		return nil, "", err
+	}
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	body, err := io.ReadAll(res.Body)
+	return res, string(body), err
+}
+
+func TestServer_MaxConnections(t *testing.T) {
+	s, addr := startTestLimitServer(t, ServerOption{MaxConnections: 3, MaxConnectionsPerIP: 2}, HTTPOption{})
+	defer s.Shutdown(context.Background())
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, body, err := limitTestGet(conn, bufio.NewReader(conn)); err != nil || body != "ok " {
+			t.Fatalf("%q %v", body, err)
+		}
+		conns = append(conns, conn)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = limitTestGet(conn, bufio.NewReader(conn)); err == nil {
+		t.Fatal("the connection over the per-ip cap is served")
+	}
+	_ = conn.Close()
+	if rejections := s.ConnRejections(); rejections.MaxConnsPerIP != 1 || rejections.MaxConns != 0 {
+		t.Fatalf("unexpected rejections: %+v", rejections)
+	}
+
+	_ = conns[0].Close()
+	for i := 0; ; i++ {
+		conn, err = net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = limitTestGet(conn, bufio.NewReader(conn))
+		_ = conn.Close()
+		if err == nil {
+			break
+		}
+		if i > 50 {
+			t.Fatal("the slot of the closed connection is not released")
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+}
+
+func TestServer_MaxConnectionsTotal(t *testing.T) {
+	s, addr := startTestLimitServer(t, ServerOption{MaxConnections: 1}, HTTPOption{})
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, _, err = limitTestGet(conn, bufio.NewReader(conn)); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, _, err = limitTestGet(other, bufio.NewReader(other)); err == nil {
+		t.Fatal("the connection over the cap is served")
+	}
+	if rejections := s.ConnRejections(); rejections.MaxConns != 1 {
+		t.Fatalf("unexpected rejections: %+v", rejections)
+	}
+}
+
+func TestHttp11_MaxKeepAliveRequests(t *testing.T) {
+	s, addr := startTestLimitServer(t, ServerOption{}, HTTPOption{MaxKeepAliveRequests: 2})
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for i, expected := range []bool{false, true} {
+		res, _, err := limitTestGet(conn, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Close != expected {
+			t.Fatalf("%d: expected close %v, got %v", i, expected, res.Close)
+		}
+	}
+	if _, _, err = limitTestGet(conn, r); err == nil {
+		t.Fatal("the connection is not closed")
+	}
+}
+
+func readSlowResponse(conn net.Conn) (string, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", err
+	}
+	body, err := io.ReadAll(res.Body)
+	return string(body), err
+}
+
+// slowGet sends the header lines one by one.
+func slowGet(addr string, lines int, interval time.Duration) (string, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("GET / HTTP/1.1\r\n")); err != nil {
+		return "", err
+	}
+	for i := 0; i < lines; i++ {
+		time.Sleep(interval)
+		if _, err = conn.Write([]byte("X: y\r\n")); err != nil {
+			return "", err
+		}
+	}
+	if _, err = conn.Write([]byte("\r\n")); err != nil {
+		return "", err
+	}
+	return readSlowResponse(conn)
+}
+
+// slowPost sends the request with the body in chunks, and returns the response body or the error.
+func slowPost(addr string, chunks int, chunk string, interval time.Duration) (string, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	size := chunks * len(chunk)
+	if _, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: " + strconv.Itoa(size) + "\r\n\r\n")); err != nil {
+		return "", err
+	}
+	for i := 0; i < chunks; i++ {
+		time.Sleep(interval)
+		if _, err = conn.Write([]byte(chunk)); err != nil {
+			return "", err
+		}
+	}
+	return readSlowResponse(conn)
+}
+
+func TestHttp11_ReadTimeouts(t *testing.T) {
+	s, addr := startTestLimitServer(t, ServerOption{}, HTTPOption{
+		ReadHeaderTimeout: utils.TomlDuration{Duration: time.Millisecond * 200},
+		ReadBodyTimeout:   utils.TomlDuration{Duration: time.Millisecond * 200},
+		MinReadRate:       100,
+	})
+	defer s.Shutdown(context.Background())
+
+	// 6 bytes per 20ms, 300 bytes per second
+	if body, err := slowGet(addr, 20, time.Millisecond*20); err != nil || body != "ok " {
+		t.Fatalf("%q %v", body, err)
+	}
+	// 6 bytes per 100ms, 60 bytes per second
+	if body, err := slowGet(addr, 20, time.Millisecond*100); err == nil {
+		t.Fatalf("the slow header is served: %q", body)
+	}
+
+	// 20 bytes per 50ms, 400 bytes per second
+	body, err := slowPost(addr, 20, strings.Repeat("a", 20), time.Millisecond*50)
+	if err != nil || body != "ok "+strings.Repeat("a", 400) {
+		t.Fatalf("%q %v", body, err)
+	}
+	// 1 byte per 50ms, 20 bytes per second
+	if body, err = slowPost(addr, 40, "a", time.Millisecond*50); err == nil {
+		t.Fatalf("the slow body is served: %q", body)
+	}
+}
+
+func TestHttp11_MaxConnectionKeepAlive(t *testing.T) {
+	s, addr := startTestLimitServer(t, ServerOption{MaxConnectionKeepAlive: utils.TomlDuration{Duration: time.Millisecond * 200}}, HTTPOption{})
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if res, _, err := limitTestGet(conn, r); err != nil || res.Close {
+		t.Fatalf("the connection is not kept alive: %v", err)
+	}
+	time.Sleep(time.Millisecond * 300)
+	if _, _, err = limitTestGet(conn, r); err == nil {
+		t.Fatal("the connection is reused after its lifetime")
+	}
+
+	// the request being served is not affected
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: a\r\n\r\n"))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || !res.Close {
+		t.Fatalf("unexpected response: %v", err)
+	}
+}
+
+func TestServer_TLSHandshakeTimeout(t *testing.T) {
+	cert, _, _ := newTestCertificate(t, "a")
+	opt := ServerOption{Addr: "127.0.0.1:0"}
+	s := New(nil, &opt, NewHTTP11Protocol(&HTTPOption{ReadHeaderTimeout: utils.TomlDuration{Duration: time.Millisecond * 100}}), nil)
+	s.Handler = RequestHandlerFunc(func(ctx *RequestCtx) { _, _ = ctx.WriteString("ok") })
+	if err := s.SetCertificates(cert); err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTestServer(t, s)
+	defer s.Shutdown(context.Background())
+
+	// the client never starts the handshake
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	begin := time.Now()
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF || time.Since(begin) > time.Second {
+		t.Fatalf("the connection is not closed by the handshake timeout: %v %v", err, time.Since(begin))
+	}
+}
@@ -0,0 +1,179 @@
+package sha
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var ErrServerBadListenAddr = errors.New("sha: bad listen address")
+var ErrServerListenerNotFile = errors.New("sha: the listener can not be converted to a file")
+
+// parseListenAddr parses `tcp://[::]:443`, `tcp4://0.0.0.0:80`, `unix:///run/app.sock` or a tcp address without a scheme.
+func parseListenAddr(addr string) (network, address string, err error) {
+	ind := strings.Index(addr, "://")
+	if ind < 0 {
+		return "tcp", addr, nil
+	}
+	network, address = addr[:ind], addr[ind+3:]
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	case "unix":
+		if len(address) < 1 {
+			return "", "", fmt.Errorf("%w: `%s`", ErrServerBadListenAddr, addr)
+		}
+	default:
+		return "", "", fmt.Errorf("%w: `%s`", ErrServerBadListenAddr, addr)
+	}
+	return network, address, nil
+}
+
+// removeStaleSocket removes the socket file left by a crashed process, the other files are kept.
+func removeStaleSocket(path string) {
+	if stat, err := os.Stat(path); err == nil && stat.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil { // in use
+			_ = conn.Close()
+			return
+		}
+		_ = os.Remove(path)
+	}
+}
+
+// listenFdsStart is the first file descriptor passed by systemd socket activation.
+const listenFdsStart = 3
+
+// inheritedListeners returns the listeners passed by systemd socket activation, or a parent process.
+// `LISTEN_PID` is optional, a parent process can not know the pid of the child before starting it.
+func inheritedListeners() ([]net.Listener, error) {
+	fds := os.Getenv("LISTEN_FDS")
+	if len(fds) < 1 {
+		return nil, nil
+	}
+	if pid := os.Getenv("LISTEN_PID"); len(pid) > 0 && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("sha: bad LISTEN_FDS `%s`", fds)
+	}
+	// the children of this process should not take over them again
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+	for i := 0; i < count; i++ {
+		f := os.NewFile(uintptr(listenFdsStart+i), "LISTEN_FD_"+strconv.Itoa(listenFdsStart+i))
+		l, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		_ = l.Close()
+	}
+}
+
+// listen returns the inherited listeners if any, otherwise listens on `ServerOption.Addrs`, or `ServerOption.Addr` if it is empty.
+func (s *Server) listen() ([]net.Listener, error) {
+	listeners, err := inheritedListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) > 0 {
+		for _, l := range listeners {
+			log.Printf("sha: listening at inherited `%s`\n", l.Addr())
+		}
+		return listeners, nil
+	}
+
+	addrs := s.option.Addrs
+	if len(addrs) < 1 {
+		addrs = []string{s.option.Addr}
+	}
+	for _, addr := range addrs {
+		ls, err := s.listenAddr(addr)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, ls...)
+	}
+	return listeners, nil
+}
+
+func (s *Server) listenAddr(addr string) ([]net.Listener, error) {
+	network, address, err := parseListenAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var lc net.ListenConfig
+	count := 1
+	if network == "unix" {
+		removeStaleSocket(address)
+	} else if s.option.ReusePort > 0 {
+		lc.Control = reusePortControl
+		count = s.option.ReusePort
+	}
+
+	var listeners []net.Listener
+	for i := 0; i < count; i++ {
+		l, err := lc.Listen(context.Background(), network, address)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		if i == 0 {
+			log.Printf("sha: listening at `%s://%s`\n", network, l.Addr())
+			address = l.Addr().String() // the random port of `:0` is shared by the others
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// ListenerFiles returns the duplicated files of the listeners.
+// Pass them to a new process by `exec.Cmd.ExtraFiles` with the environment `LISTEN_FDS=<count>`,
+// the new process takes over them in ListenAndServe, then shutdown this server for a zero-downtime upgrade.
+func (s *Server) ListenerFiles() ([]*os.File, error) {
+	s.connsMutex.Lock()
+	defer s.connsMutex.Unlock()
+
+	var files []*os.File
+	for _, l := range s.listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			closeFiles(files)
+			return nil, ErrServerListenerNotFile
+		}
+		if ul, ok := l.(*net.UnixListener); ok { // the socket file is used by the new process
+			ul.SetUnlinkOnClose(false)
+		}
+		f, err := fl.File()
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		_ = f.Close()
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package sha
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errReusePortUnsupported = errors.New("sha: SO_REUSEPORT is not supported on this platform")
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errReusePortUnsupported
+}
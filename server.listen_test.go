@@ -0,0 +1,119 @@
+package sha
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestParseListenAddr(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"127.0.0.1:80":         "tcp 127.0.0.1:80",
+		"tcp://[::]:443":       "tcp [::]:443",
+		"tcp6://[::1]:443":     "tcp6 [::1]:443",
+		"unix:///run/app.sock": "unix /run/app.sock",
+		"unix://":              "",
+		"udp://:53":            "",
+	} {
+		network, address, err := parseListenAddr(addr)
+		if (err != nil) != (len(expected) < 1) || (err == nil && network+" "+address != expected) {
+			t.Fatalf("%s: %s %s %v", addr, network, address, err)
+		}
+	}
+}
+
+func listenTestGet(t *testing.T, c *http.Client, url string) string {
+	res, err := c.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	return string(body)
+}
+
+func TestServer_MultipleListeners(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "app.sock")
+	addrs := []string{"tcp://127.0.0.1:0", "unix://" + sock}
+	if l, err := net.Listen("tcp6", "[::1]:0"); err == nil {
+		_ = l.Close()
+		addrs = append(addrs, "tcp6://[::1]:0")
+	}
+
+	s := New(nil, &ServerOption{Addrs: addrs, ReusePort: 2}, nil, nil)
+	s.Handler = RequestHandlerFunc(func(ctx *RequestCtx) { _, _ = ctx.WriteString("ok") })
+	serveTestServer(t, s)
+	defer s.Shutdown(context.Background())
+
+	s.connsMutex.Lock()
+	listeners := append([]net.Listener(nil), s.listeners...)
+	s.connsMutex.Unlock()
+	if len(listeners) != (len(addrs)-1)*2+1 {
+		t.Fatalf("unexpected listeners: %d", len(listeners))
+	}
+	if listeners[0].Addr().String() != listeners[1].Addr().String() {
+		t.Fatalf("the reuse port listeners are on %s and %s", listeners[0].Addr(), listeners[1].Addr())
+	}
+
+	if body := listenTestGet(t, http.DefaultClient, "http://"+listeners[0].Addr().String()+"/"); body != "ok" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+	if len(listeners) > 3 {
+		if body := listenTestGet(t, http.DefaultClient, "http://"+listeners[3].Addr().String()+"/"); body != "ok" {
+			t.Fatalf("unexpected body: %q", body)
+		}
+	}
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+	if body := listenTestGet(t, unixClient, "http://unix/"); body != "ok" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+}
+
+func TestServer_ListenerFiles(t *testing.T) {
+	if os.Getenv("SHA_TEST_INHERIT") == "1" {
+		s := New(nil, &ServerOption{Addr: "127.0.0.1:1"}, nil, nil)
+		done := make(chan struct{})
+		s.Handler = RequestHandlerFunc(func(ctx *RequestCtx) {
+			_, _ = ctx.WriteString("child " + strconv.Itoa(os.Getpid()))
+			go func() {
+				// the response is sent before the shutdown returns
+				_, _ = s.Shutdown(context.Background())
+				close(done)
+			}()
+		})
+		s.ListenAndServe()
+		<-done
+		return
+	}
+
+	s, addr := startTestServer(t, RequestHandlerFunc(func(ctx *RequestCtx) { _, _ = ctx.WriteString("parent") }))
+	files, err := s.ListenerFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = s.Shutdown(context.Background())
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestServer_ListenerFiles$")
+	cmd.Env = append(os.Environ(), "SHA_TEST_INHERIT=1", "LISTEN_FDS="+strconv.Itoa(len(files)))
+	cmd.ExtraFiles = files
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	closeFiles(files)
+	defer cmd.Wait()
+
+	c := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	if body := listenTestGet(t, c, "http://"+addr+"/"); body != "child "+strconv.Itoa(cmd.Process.Pid) {
+		t.Fatalf("unexpected body: %q", body)
+	}
+}
@@ -0,0 +1,295 @@
+package sha
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// the PROXY protocol of HAProxy, https://www.haproxy.org/download/2.3/doc/proxy-protocol.txt
+
+var ErrBadProxyProtocolHeader = errors.New("sha: bad PROXY protocol header")
+
+const (
+	ProxyTLVTypeALPN      = 0x01
+	ProxyTLVTypeAuthority = 0x02
+	ProxyTLVTypeCRC32C    = 0x03
+	ProxyTLVTypeNoop      = 0x04
+	ProxyTLVTypeUniqueID  = 0x05
+	ProxyTLVTypeSSL       = 0x20
+	ProxyTLVTypeNetNS     = 0x30
+
+	// the sub types of ProxyTLVTypeSSL
+	ProxyTLVSubTypeSSLVersion = 0x21
+	ProxyTLVSubTypeSSLCN      = 0x22
+	ProxyTLVSubTypeSSLCipher  = 0x23
+	ProxyTLVSubTypeSSLSigAlg  = 0x24
+	ProxyTLVSubTypeSSLKeyAlg  = 0x25
+)
+
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+type ProxyHeader struct {
+	Version int
+	// Local is true for the v2 `LOCAL` command and the v1 `UNKNOWN` protocol, e.g. the health checks of the balancer,
+	// the addresses of the connection are not changed.
+	Local           bool
+	SourceAddr      net.Addr
+	DestinationAddr net.Addr
+	TLVs            []ProxyTLV // v2 only
+}
+
+func (h *ProxyHeader) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// ProxySSLInfo is the value of ProxyTLVTypeSSL, the tls is terminated by the balancer.
+type ProxySSLInfo struct {
+	Client byte   // bit field, 0x01: the client connected over tls, 0x02: sent a certificate on the connection, 0x04: on the session
+	Verify uint32 // zero if the client certificate is verified
+	TLVs   []ProxyTLV
+}
+
+func (info *ProxySSLInfo) TLV(typ byte) ([]byte, bool) {
+	h := ProxyHeader{TLVs: info.TLVs}
+	return h.TLV(typ)
+}
+
+func (h *ProxyHeader) SSL() (*ProxySSLInfo, bool) {
+	v, ok := h.TLV(ProxyTLVTypeSSL)
+	if !ok || len(v) < 5 {
+		return nil, false
+	}
+	tlvs, err := parseProxyTLVs(v[5:])
+	if err != nil {
+		return nil, false
+	}
+	return &ProxySSLInfo{Client: v[0], Verify: binary.BigEndian.Uint32(v[1:5]), TLVs: tlvs}, true
+}
+
+func parseProxyTLVs(data []byte) ([]ProxyTLV, error) {
+	var tlvs []ProxyTLV
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, ErrBadProxyProtocolHeader
+		}
+		size := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+size {
+			return nil, ErrBadProxyProtocolHeader
+		}
+		tlvs = append(tlvs, ProxyTLV{Type: data[0], Value: data[3 : 3+size]})
+		data = data[3+size:]
+	}
+	return tlvs, nil
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+var proxyV1Prefix = []byte("PROXY ")
+
+// the max size of the v1 line, including the CRLF
+const proxyV1MaxLineSize = 107
+
+func readProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	prefix, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(prefix, proxyV1Prefix) {
+		return readProxyV1Header(r)
+	}
+	if prefix, err = r.Peek(len(proxyV2Signature)); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(prefix, proxyV2Signature) {
+		return readProxyV2Header(r)
+	}
+	return nil, ErrBadProxyProtocolHeader
+}
+
+func readProxyV1Header(r *bufio.Reader) (*ProxyHeader, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLineSize {
+			return nil, ErrBadProxyProtocolHeader
+		}
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, ErrBadProxyProtocolHeader
+	}
+
+	fields := bytes.Split(line[len(proxyV1Prefix):len(line)-2], []byte(" "))
+	header := &ProxyHeader{Version: 1}
+	switch string(fields[0]) {
+	case "UNKNOWN":
+		header.Local = true
+		return header, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, ErrBadProxyProtocolHeader
+	}
+	if len(fields) != 5 {
+		return nil, ErrBadProxyProtocolHeader
+	}
+
+	srcIP, dstIP := net.ParseIP(string(fields[1])), net.ParseIP(string(fields[2]))
+	srcPort, e1 := strconv.ParseUint(string(fields[3]), 10, 16)
+	dstPort, e2 := strconv.ParseUint(string(fields[4]), 10, 16)
+	if srcIP == nil || dstIP == nil || e1 != nil || e2 != nil || (srcIP.To4() != nil) != (string(fields[0]) == "TCP4") {
+		return nil, ErrBadProxyProtocolHeader
+	}
+	header.SourceAddr = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	header.DestinationAddr = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return header, nil
+}
+
+func readProxyV2Header(r *bufio.Reader) (*ProxyHeader, error) {
+	var head [16]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	if head[12]>>4 != 2 {
+		return nil, ErrBadProxyProtocolHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	header := &ProxyHeader{Version: 2}
+	switch head[12] & 0x0f {
+	case 0x00:
+		header.Local = true
+	case 0x01:
+	default:
+		return nil, ErrBadProxyProtocolHeader
+	}
+
+	var addrSize int
+	family, transport := head[13]>>4, head[13]&0x0f
+	switch family {
+	case 0x00: // AF_UNSPEC
+		header.Local = true
+	case 0x01: // AF_INET
+		addrSize = 12
+	case 0x02: // AF_INET6
+		addrSize = 36
+	case 0x03: // AF_UNIX
+		addrSize = 216
+	default:
+		return nil, ErrBadProxyProtocolHeader
+	}
+	if len(body) < addrSize {
+		return nil, ErrBadProxyProtocolHeader
+	}
+
+	if !header.Local {
+		switch family {
+		case 0x01, 0x02:
+			ipSize := (addrSize - 4) / 2
+			src, dst := net.IP(body[:ipSize]), net.IP(body[ipSize:ipSize*2])
+			srcPort := int(binary.BigEndian.Uint16(body[ipSize*2:]))
+			dstPort := int(binary.BigEndian.Uint16(body[ipSize*2+2:]))
+			if transport == 0x02 { // DGRAM
+				header.SourceAddr, header.DestinationAddr = &net.UDPAddr{IP: src, Port: srcPort}, &net.UDPAddr{IP: dst, Port: dstPort}
+			} else {
+				header.SourceAddr, header.DestinationAddr = &net.TCPAddr{IP: src, Port: srcPort}, &net.TCPAddr{IP: dst, Port: dstPort}
+			}
+		case 0x03:
+			header.SourceAddr = &net.UnixAddr{Name: unixPath(body[:108]), Net: "unix"}
+			header.DestinationAddr = &net.UnixAddr{Name: unixPath(body[108:216]), Net: "unix"}
+		}
+	}
+
+	var err error
+	if header.TLVs, err = parseProxyTLVs(body[addrSize:]); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+func unixPath(p []byte) string {
+	if ind := bytes.IndexByte(p, 0); ind > -1 {
+		p = p[:ind]
+	}
+	return string(p)
+}
+
+type _ProxyProtocol struct {
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+func newProxyProtocol(cidrs []string, timeout time.Duration) *_ProxyProtocol {
+	return &_ProxyProtocol{trusted: parseCIDRs(cidrs), timeout: timeout}
+}
+
+// isTrusted reports whether the source must send the header, the non-ip sources(unix sockets) are trusted only if the list is empty.
+func (pp *_ProxyProtocol) isTrusted(addr net.Addr) bool {
+	if len(pp.trusted) < 1 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range pp.trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// accept reads the header sent by a trusted source, and returns the connection that should be served.
+func (pp *_ProxyProtocol) accept(s *Server, conn net.Conn) (net.Conn, error) {
+	tc, ok := conn.(*_TrackedConn)
+	if !ok || !pp.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	if pp.timeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(pp.timeout))
+	}
+	// the header is small, the data after it is rarely sent before the response of the balancer
+	r := bufio.NewReaderSize(conn, 256)
+	header, err := readProxyHeader(r)
+	if err != nil {
+		return conn, err
+	}
+	_ = conn.SetReadDeadline(zeroTime)
+
+	s.connsMutex.Lock()
+	tc.info.proxy = header
+	if !header.Local && header.SourceAddr != nil {
+		tc.remote, tc.local = header.SourceAddr, header.DestinationAddr
+	}
+	s.connsMutex.Unlock()
+
+	if r.Buffered() > 0 {
+		peeked := &_PeekedConn{Conn: conn, r: r}
+		s.retrackConn(conn, peeked)
+		return peeked, nil
+	}
+	return conn, nil
+}
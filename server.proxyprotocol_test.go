@@ -0,0 +1,93 @@
+package sha
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func startTestProxyProtocolServer(t *testing.T, cidrs ...string) (*Server, string) {
+	opt := ServerOption{Addr: "127.0.0.1:0"}
+	opt.ProxyProtocol.Enabled = true
+	opt.ProxyProtocol.TrustedCIDRs = cidrs
+	s := New(nil, &opt, nil, nil)
+	s.Handler = RequestHandlerFunc(func(ctx *RequestCtx) {
+		info := ctx.ConnInfo()
+		_, _ = ctx.WriteString(ctx.RemoteAddr().String() + " " + info.LocalAddr.String())
+		if info.Proxy != nil {
+			if ssl, ok := info.Proxy.SSL(); ok {
+				cn, _ := ssl.TLV(ProxyTLVSubTypeSSLCN)
+				_, _ = ctx.WriteString(" " + string(cn))
+			}
+		}
+	})
+	return s, serveTestServer(t, s)
+}
+
+func proxyProtocolExchange(t *testing.T, addr string, header []byte) (string, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write(append(header, "GET / HTTP/1.1\r\nHost: a\r\n\r\n"...))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", err
+	}
+	body, _ := io.ReadAll(res.Body)
+	return string(body), nil
+}
+
+func TestServer_ProxyProtocol(t *testing.T) {
+	s, addr := startTestProxyProtocolServer(t)
+	defer s.Shutdown(context.Background())
+
+	body, err := proxyProtocolExchange(t, addr, []byte("PROXY TCP4 192.168.1.2 10.0.0.1 56324 443\r\n"))
+	if err != nil || body != "192.168.1.2:56324 10.0.0.1:443" {
+		t.Fatalf("v1: %q %v", body, err)
+	}
+
+	body, err = proxyProtocolExchange(t, addr, []byte("PROXY UNKNOWN\r\n"))
+	if err != nil || !strings.HasPrefix(body, "127.0.0.1:") || !strings.HasSuffix(body, " "+addr) {
+		t.Fatalf("v1 unknown: %q %v", body, err)
+	}
+
+	ssl := []byte{0x01, 0, 0, 0, 0, ProxyTLVSubTypeSSLCN, 0, 6}
+	ssl = append(ssl, "client"...)
+	v2 := append([]byte(nil), proxyV2Signature...)
+	v2 = append(v2, 0x21, 0x21, 0, 0) // PROXY, TCP over IPv6
+	v2 = append(v2, net.ParseIP("2001:db8::1")...)
+	v2 = append(v2, net.ParseIP("2001:db8::2")...)
+	v2 = append(v2, 0x1f, 0x90, 0x01, 0xbb)
+	v2 = append(v2, ProxyTLVTypeSSL, 0, byte(len(ssl)))
+	v2 = append(v2, ssl...)
+	binary.BigEndian.PutUint16(v2[14:16], uint16(len(v2)-16))
+	body, err = proxyProtocolExchange(t, addr, v2)
+	if err != nil || body != "[2001:db8::1]:8080 [2001:db8::2]:443 client" {
+		t.Fatalf("v2: %q %v", body, err)
+	}
+
+	if _, err = proxyProtocolExchange(t, addr, nil); err == nil {
+		t.Fatal("the connection without the header is served")
+	}
+}
+
+func TestServer_ProxyProtocolUntrusted(t *testing.T) {
+	s, addr := startTestProxyProtocolServer(t, "10.0.0.0/8")
+	defer s.Shutdown(context.Background())
+
+	body, err := proxyProtocolExchange(t, addr, nil)
+	if err != nil || !strings.HasPrefix(body, "127.0.0.1:") {
+		t.Fatalf("%q %v", body, err)
+	}
+	body, _ = proxyProtocolExchange(t, addr, []byte("PROXY TCP4 192.168.1.2 10.0.0.1 56324 443\r\n"))
+	if strings.Contains(body, "192.168.1.2") {
+		t.Fatalf("the header from an untrusted source is accepted: %q", body)
+	}
+}
@@ -0,0 +1,108 @@
+package sha
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// setConnShutdownHook sets a function called when the server starts shutting down,
+// protocols use it to notify the client, e.g. http2 GOAWAY.
+func (s *Server) setConnShutdownHook(conn net.Conn, fn func()) {
+	s.connsMutex.Lock()
+	if info := s.conns[conn]; info != nil {
+		info.onShutdown = fn
+	}
+	s.connsMutex.Unlock()
+}
+
+func (s *Server) inShutdown() bool { return atomic.LoadInt32(&s.shutdown) != 0 }
+
+// a new connection that has not sent any data after this duration is treated as idle when shutting down.
+const shutdownNewConnIdleDuration = time.Second * 5
+
+// closeIdleConns closes all idle connections and reports whether all connections are gone.
+func (s *Server) closeIdleConns() bool {
+	var closed []net.Conn
+	defer func() {
+		for _, conn := range closed {
+			s.onConnState(conn, ConnStateClosed)
+		}
+	}()
+
+	s.connsMutex.Lock()
+	defer s.connsMutex.Unlock()
+
+	now := time.Now()
+	for conn, info := range s.conns {
+		switch info.state {
+		case ConnStateIdle:
+		case ConnStateNew:
+			if now.Sub(info.acceptTime) < shutdownNewConnIdleDuration {
+				continue
+			}
+		default:
+			continue
+		}
+		_ = conn.Close()
+		delete(s.conns, conn)
+		closed = append(closed, conn)
+	}
+	return len(s.conns) == 0
+}
+
+func (s *Server) closeAllConns() []net.Conn {
+	s.connsMutex.Lock()
+	var closed []net.Conn
+	for conn := range s.conns {
+		_ = conn.Close()
+		closed = append(closed, conn)
+		delete(s.conns, conn)
+	}
+	s.connsMutex.Unlock()
+
+	for _, conn := range closed {
+		s.onConnState(conn, ConnStateClosed)
+	}
+	return closed
+}
+
+const shutdownPollInterval = time.Millisecond * 500
+
+// Shutdown stops accepting new connections, closes the idle keep-alive connections,
+// and waits for the active and hijacked connections to be released.
+// If ctx is done before that, the remaining connections are closed forcibly and returned with ctx.Err().
+func (s *Server) Shutdown(ctx context.Context) ([]net.Conn, error) {
+	if !atomic.CompareAndSwapInt32(&s.shutdown, 0, 1) {
+		return nil, ErrServerClosed
+	}
+
+	var hooks []func()
+	s.connsMutex.Lock()
+	closeListeners(s.listeners)
+	for _, info := range s.conns {
+		if info.onShutdown != nil {
+			hooks = append(hooks, info.onShutdown)
+		}
+	}
+	s.connsMutex.Unlock()
+
+	for _, fn := range hooks {
+		fn()
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if s.closeIdleConns() {
+			return nil, nil
+		}
+		select {
+		case <-ctx.Done():
+			return s.closeAllConns(), ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
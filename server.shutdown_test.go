@@ -0,0 +1,122 @@
+package sha
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func startTestServer(t *testing.T, handler RequestHandler) (*Server, string) {
+	opt := ServerOption{Addr: "127.0.0.1:0"}
+	s := New(nil, &opt, nil, nil)
+	s.Handler = handler
+	return s, serveTestServer(t, s)
+}
+
+func serveTestServer(t *testing.T, s *Server) string {
+	go s.ListenAndServe()
+
+	for i := 0; i < 100; i++ {
+		s.connsMutex.Lock()
+		ls := s.listeners
+		s.connsMutex.Unlock()
+		if len(ls) > 0 {
+			return ls[0].Addr().String()
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("server did not start")
+	return ""
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	s, addr := startTestServer(t, RequestHandlerFunc(func(ctx *RequestCtx) {
+		time.Sleep(time.Millisecond * 300)
+		_, _ = ctx.WriteString("done")
+	}))
+
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	_, _ = idle.Write([]byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n"))
+	idleRes, err := http.ReadResponse(bufio.NewReader(idle), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.ReadAll(idleRes.Body)
+
+	active, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer active.Close()
+	_, _ = active.Write([]byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n"))
+	time.Sleep(time.Millisecond * 50)
+
+	forceClosed, err := s.Shutdown(context.Background())
+	if err != nil || len(forceClosed) != 0 {
+		t.Fatalf("unexpected shutdown result: %v %v", forceClosed, err)
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(active), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != "done" || !res.Close {
+		t.Fatalf("bad response: %q close=%v", body, res.Close)
+	}
+
+	if _, err = idle.Read(make([]byte, 1)); err == nil {
+		t.Fatal("idle connection should be closed")
+	}
+	if _, err = net.Dial("tcp", addr); err == nil {
+		t.Fatal("listener should be closed")
+	}
+}
+
+func TestServer_ShutdownTimeout(t *testing.T) {
+	s, addr := startTestServer(t, RequestHandlerFunc(func(ctx *RequestCtx) {
+		time.Sleep(time.Second * 2)
+	}))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n"))
+	time.Sleep(time.Millisecond * 50)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	forceClosed, err := s.Shutdown(ctx)
+	if err != context.DeadlineExceeded || len(forceClosed) != 1 {
+		t.Fatalf("unexpected shutdown result: %v %v", forceClosed, err)
+	}
+}
+
+func TestServer_ShutdownListenerGoroutine(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		s, _ := startTestServer(t, RequestHandlerFunc(func(ctx *RequestCtx) {}))
+		if _, err := s.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// ListenAndServe returns, and the goroutine waiting for the base context to close the listener exits with it
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i > 100 {
+			t.Fatalf("goroutines leaked: %d > %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
@@ -0,0 +1,250 @@
+package sha
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TLSCertificateOption struct {
+	Cert string `json:"cert" toml:"cert"`
+	Key  string `json:"key" toml:"key"`
+}
+
+var ErrNoCertificate = errors.New("sha: no tls certificate")
+
+// _CertStore selects the certificate by the SNI of the client hello, the first certificate is the default one.
+type _CertStore struct {
+	mutex  sync.RWMutex
+	def    *tls.Certificate
+	byName map[string]*tls.Certificate // lower case, the wildcard names are kept as `*.example.com`
+
+	loadMutex sync.Mutex
+	files     []TLSCertificateOption
+	modTimes  []time.Time
+}
+
+func certificateNames(cert *tls.Certificate) ([]string, error) {
+	if cert.Leaf == nil {
+		if len(cert.Certificate) < 1 {
+			return nil, ErrNoCertificate
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+		cert.Leaf = leaf
+	}
+	if len(cert.Leaf.DNSNames) > 0 {
+		return cert.Leaf.DNSNames, nil
+	}
+	if len(cert.Leaf.Subject.CommonName) > 0 {
+		return []string{cert.Leaf.Subject.CommonName}, nil
+	}
+	return nil, nil
+}
+
+// set replaces all certificates, the names of the former ones take precedence.
+func (cs *_CertStore) set(certs []tls.Certificate) error {
+	if len(certs) < 1 {
+		return ErrNoCertificate
+	}
+	byName := map[string]*tls.Certificate{}
+	for i := range certs {
+		cert := &certs[i]
+		names, err := certificateNames(cert)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, ok := byName[name]; !ok {
+				byName[name] = cert
+			}
+		}
+	}
+
+	cs.mutex.Lock()
+	cs.def = &certs[0]
+	cs.byName = byName
+	cs.mutex.Unlock()
+	return nil
+}
+
+func (cs *_CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+	if cert, ok := cs.byName[name]; ok {
+		return cert, nil
+	}
+	// the wildcard only matches one label, `*.example.com` matches `a.example.com` but not `a.b.example.com`
+	if ind := strings.IndexByte(name, '.'); ind > 0 {
+		if cert, ok := cs.byName["*"+name[ind:]]; ok {
+			return cert, nil
+		}
+	}
+	if cs.def == nil {
+		return nil, ErrNoCertificate
+	}
+	return cs.def, nil
+}
+
+func (cs *_CertStore) stat() ([]time.Time, bool) {
+	modTimes := make([]time.Time, 0, len(cs.files)*2)
+	changed := len(cs.modTimes) != len(cs.files)*2
+	for _, f := range cs.files {
+		for _, name := range []string{f.Cert, f.Key} {
+			var t time.Time
+			if stat, err := os.Stat(name); err == nil {
+				t = stat.ModTime()
+			}
+			if !changed && !t.Equal(cs.modTimes[len(modTimes)]) {
+				changed = true
+			}
+			modTimes = append(modTimes, t)
+		}
+	}
+	return modTimes, changed
+}
+
+func (cs *_CertStore) empty() bool {
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+	return cs.def == nil
+}
+
+// load loads the files if any of them is changed.
+func (cs *_CertStore) load() error {
+	cs.loadMutex.Lock()
+	defer cs.loadMutex.Unlock()
+	if len(cs.files) < 1 {
+		return ErrNoCertificate
+	}
+
+	modTimes, changed := cs.stat()
+	if !changed {
+		return nil
+	}
+	certs := make([]tls.Certificate, len(cs.files))
+	for i, f := range cs.files {
+		var err error
+		if certs[i], err = tls.LoadX509KeyPair(f.Cert, f.Key); err != nil {
+			return err
+		}
+	}
+	if err := cs.set(certs); err != nil {
+		return err
+	}
+	cs.modTimes = modTimes
+	return nil
+}
+
+// watch polls the files, a bad certificate, e.g. the key is not written yet, is logged and retried in the next round.
+func (cs *_CertStore) watch(s *Server, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.baseCtx.Done():
+			return
+		case <-ticker.C:
+			if s.inShutdown() {
+				return
+			}
+			if err := cs.load(); err != nil {
+				log.Printf("sha: reload tls certificates: %s\n", err.Error())
+			}
+		}
+	}
+}
+
+func (s *Server) certStore() *_CertStore {
+	s.certsOnce.Do(func() { s.certs = &_CertStore{} })
+	return s.certs
+}
+
+// SetCertificates replaces the tls certificates at runtime, the established connections are not affected.
+// The certificates are selected by SNI, the first one is the default.
+// It enables tls if it is called before serving, and the files of `ServerOption.Tls` are not used.
+func (s *Server) SetCertificates(certs ...tls.Certificate) error {
+	return s.certStore().set(certs)
+}
+
+// ReloadCertificates reloads the files of `ServerOption.Tls` if any of them is changed.
+func (s *Server) ReloadCertificates() error { return s.certStore().load() }
+
+func (s *Server) tlsCertificateFiles() []TLSCertificateOption {
+	var files []TLSCertificateOption
+	if len(s.option.Tls.Cert) > 0 || len(s.option.Tls.Key) > 0 {
+		files = append(files, TLSCertificateOption{Cert: s.option.Tls.Cert, Key: s.option.Tls.Key})
+	}
+	return append(files, s.option.Tls.Certificates...)
+}
+
+func (s *Server) tlsEnabled() bool {
+	return len(s.tlsCertificateFiles()) > 0 || !s.certStore().empty()
+}
+
+// useCertStore selects the certificates by SNI, the files are loaded if SetCertificates is not called.
+func (s *Server) useCertStore() {
+	cs := s.certStore()
+	if cs.empty() {
+		files := s.tlsCertificateFiles()
+		for _, f := range files {
+			if f.Cert == "" || f.Key == "" {
+				panic("sha: empty tls file")
+			}
+		}
+		cs.loadMutex.Lock()
+		cs.files = files
+		cs.loadMutex.Unlock()
+		if err := cs.load(); err != nil {
+			panic(err)
+		}
+		if interval := s.option.Tls.ReloadInterval.Duration; interval > 0 {
+			go cs.watch(s, interval)
+		}
+	}
+	s.tls.GetCertificate = cs.GetCertificate
+}
+
+var ErrBadClientCA = errors.New("sha: no certificate in the tls client ca file")
+
+// enableClientAuth enables the mutual tls by `ServerOption.Tls.ClientAuth`, the `tls.Config.ClientCAs` is used if it is set.
+func (s *Server) enableClientAuth() {
+	var clientAuth tls.ClientAuthType
+	switch strings.ToLower(s.option.Tls.ClientAuth) {
+	case "", "none":
+		return
+	case "request":
+		clientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		panic(fmt.Errorf("sha: unknown tls client auth `%s`", s.option.Tls.ClientAuth))
+	}
+
+	if s.tls.ClientCAs == nil {
+		if s.option.Tls.ClientCA == "" {
+			panic("sha: empty tls client ca file")
+		}
+		data, err := os.ReadFile(s.option.Tls.ClientCA)
+		if err != nil {
+			panic(err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			panic(ErrBadClientCA)
+		}
+		s.tls.ClientCAs = pool
+	}
+	s.tls.ClientAuth = clientAuth
+}
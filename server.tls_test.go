@@ -0,0 +1,302 @@
+package sha
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zzztttkkk/sha/auth"
+	"github.com/zzztttkkk/sha/utils"
+)
+
+func newTestCertificate(t *testing.T, names ...string) (tls.Certificate, []byte, []byte) {
+	return signTestCertificate(t, nil, func(*x509.Certificate) {}, names...)
+}
+
+// signTestCertificate signs the certificate by the parent, it is a self-signed one if the parent is nil.
+func signTestCertificate(
+	t *testing.T, parent *tls.Certificate, fn func(tmpl *x509.Certificate), names ...string,
+) (tls.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names[1:],
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	fn(tmpl)
+	signer, signerKey := tmpl, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert.Leaf, _ = x509.ParseCertificate(der)
+	return cert, certPEM, keyPEM
+}
+
+// peerCommonName returns the common name of the certificate sent by the server for the server name.
+func peerCommonName(t *testing.T, addr, serverName string) string {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestServer_SNICertificates(t *testing.T) {
+	def, _, _ := newTestCertificate(t, "default")
+	a, _, _ := newTestCertificate(t, "a", "a.example.com")
+	wildcard, _, _ := newTestCertificate(t, "wildcard", "*.example.com")
+
+	s := New(nil, &ServerOption{Addr: "127.0.0.1:0"}, nil, nil)
+	s.Handler = RequestHandlerFunc(func(ctx *RequestCtx) { _, _ = ctx.WriteString("ok") })
+	if err := s.SetCertificates(def, a, wildcard); err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTestServer(t, s)
+	defer s.Shutdown(context.Background())
+
+	for name, expected := range map[string]string{
+		"a.example.com":   "a",
+		"A.Example.com":   "a",
+		"b.example.com":   "wildcard",
+		"a.b.example.com": "default",
+		"example.com":     "default",
+		"":                "default",
+	} {
+		if cn := peerCommonName(t, addr, name); cn != expected {
+			t.Fatalf("%q: expected %q, got %q", name, expected, cn)
+		}
+	}
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "a.example.com", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	b, _, _ := newTestCertificate(t, "b", "a.example.com")
+	if err = s.SetCertificates(b); err != nil {
+		t.Fatal(err)
+	}
+	if cn := peerCommonName(t, addr, "a.example.com"); cn != "b" {
+		t.Fatalf("the certificate is not replaced: %q", cn)
+	}
+	_, _ = conn.Write([]byte("GET / HTTP/1.1\r\nHost: a.example.com\r\n\r\n"))
+	buf := make([]byte, 512)
+	if n, err := conn.Read(buf); err != nil || n < 1 {
+		t.Fatalf("the established connection is broken: %v", err)
+	}
+}
+
+func TestServer_ReloadCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	write := func(cn string, modTime time.Time) {
+		_, certPEM, keyPEM := newTestCertificate(t, cn)
+		for name, data := range map[string][]byte{certFile: certPEM, keyFile: keyPEM} {
+			if err := os.WriteFile(name, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(name, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	write("first", time.Now().Add(-time.Minute))
+
+	opt := ServerOption{Addr: "127.0.0.1:0"}
+	opt.Tls.Certificates = []TLSCertificateOption{{Cert: certFile, Key: keyFile}}
+	opt.Tls.ReloadInterval = utils.TomlDuration{Duration: time.Millisecond * 20}
+	s := New(nil, &opt, nil, nil)
+	s.Handler = RequestHandlerFunc(func(ctx *RequestCtx) {})
+	addr := serveTestServer(t, s)
+	defer s.Shutdown(context.Background())
+
+	if cn := peerCommonName(t, addr, "localhost"); cn != "first" {
+		t.Fatalf("unexpected certificate: %q", cn)
+	}
+
+	write("second", time.Now())
+	for i := 0; ; i++ {
+		if cn := peerCommonName(t, addr, "localhost"); cn == "second" {
+			break
+		}
+		if i > 100 {
+			t.Fatal("the certificate is not reloaded")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if err := s.ReloadCertificates(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type _CertSubject int64
+
+func (s _CertSubject) GetID() int64 { return int64(s) }
+
+func (s _CertSubject) Info(ctx context.Context) interface{} { return nil }
+
+func TestServer_ClientAuth(t *testing.T) {
+	ca, caPEM, _ := signTestCertificate(t, nil, func(tmpl *x509.Certificate) {
+		tmpl.IsCA = true
+		tmpl.ExtKeyUsage = nil
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	}, "ca")
+	clientAuth := func(tmpl *x509.Certificate) { tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth} }
+	orders, _, _ := signTestCertificate(t, &ca, func(tmpl *x509.Certificate) {
+		clientAuth(tmpl)
+		tmpl.DNSNames = []string{"Orders.internal"}
+	}, "orders")
+	unknown, _, _ := signTestCertificate(t, &ca, clientAuth, "unknown")
+	selfSigned, _, _ := signTestCertificate(t, nil, clientAuth, "orders")
+	serverCert, _, _ := newTestCertificate(t, "localhost")
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	manager := &auth.CertificateManager{
+		PeerCertificates: PeerCertificates,
+		Subjects:         map[string]auth.Subject{"orders.internal": _CertSubject(12)},
+	}
+	start := func(mode string) (*Server, string) {
+		opt := ServerOption{Addr: "127.0.0.1:0"}
+		opt.Tls.ClientAuth = mode
+		opt.Tls.ClientCA = caFile
+		s := New(nil, &opt, nil, nil)
+		s.Handler = RequestHandlerFunc(func(ctx *RequestCtx) {
+			subject, err := manager.Auth(Wrap(ctx))
+			if err != nil {
+				_, _ = ctx.WriteString(fmt.Sprintf("%d %s", len(ctx.PeerCertificates()), err.Error()))
+				return
+			}
+			_, _ = ctx.WriteString(fmt.Sprintf("%d %d", len(ctx.PeerCertificates()), subject.GetID()))
+		})
+		if err := s.SetCertificates(serverCert); err != nil {
+			t.Fatal(err)
+		}
+		return s, serveTestServer(t, s)
+	}
+	// the certificate is sent even if it is not signed by the acceptable cas
+	get := func(addr string, certs ...tls.Certificate) (string, error) {
+		conf := &tls.Config{InsecureSkipVerify: true}
+		conf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if len(certs) < 1 {
+				return &tls.Certificate{}, nil
+			}
+			return &certs[0], nil
+		}
+		conn, err := tls.Dial("tcp", addr, conf)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("GET / HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n"))
+		data, err := io.ReadAll(conn)
+		if err != nil {
+			return "", err
+		}
+		return strings.SplitN(string(data), "\r\n\r\n", 2)[1], nil
+	}
+
+	s, addr := start("request")
+	defer s.Shutdown(context.Background())
+	for _, c := range []struct {
+		certs    []tls.Certificate
+		expected string
+	}{
+		{[]tls.Certificate{orders}, "2 12"},
+		{[]tls.Certificate{unknown}, "2 " + auth.ErrUnauthenticatedOperation.Error()},
+		{nil, "0 " + auth.ErrUnauthenticatedOperation.Error()},
+	} {
+		if body, err := get(addr, c.certs...); err != nil || body != c.expected {
+			t.Fatalf("expected %q, got %q %v", c.expected, body, err)
+		}
+	}
+	if body, err := get(addr, selfSigned); err == nil {
+		t.Fatalf("the unverified certificate is accepted: %q", body)
+	}
+
+	s, addr = start("require")
+	defer s.Shutdown(context.Background())
+	if body, err := get(addr); err == nil {
+		t.Fatalf("the client without certificate is accepted: %q", body)
+	}
+	if body, err := get(addr, orders); err != nil || body != "2 12" {
+		t.Fatalf("%q %v", body, err)
+	}
+}
+
+func TestCertificateManager_Names(t *testing.T) {
+	manager := &auth.CertificateManager{
+		Subjects: map[string]auth.Subject{
+			"spiffe://example.com/orders": _CertSubject(1),
+			"spiffe://example.com/Orders": _CertSubject(4),
+			"billing.internal":            _CertSubject(2),
+			"ops@example.com":             _CertSubject(3),
+		},
+	}
+	for _, c := range []struct {
+		cert     *x509.Certificate
+		expected int64 // 0 for unauthenticated
+	}{
+		{&x509.Certificate{URIs: []*url.URL{{Scheme: "spiffe", Host: "example.com", Path: "/orders"}}}, 1},
+		{&x509.Certificate{URIs: []*url.URL{{Scheme: "spiffe", Host: "example.com", Path: "/Orders"}}}, 4},
+		{&x509.Certificate{DNSNames: []string{"Billing.Internal"}}, 2},
+		{&x509.Certificate{EmailAddresses: []string{"ops@example.com"}}, 3},
+		{&x509.Certificate{EmailAddresses: []string{"OPS@example.com"}}, 0},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "Billing.internal"}}, 0},
+	} {
+		cert := c.cert
+		manager.PeerCertificates = func(context.Context) []*x509.Certificate { return []*x509.Certificate{cert} }
+		subject, err := manager.Auth(context.Background())
+		if c.expected == 0 {
+			if err != auth.ErrUnauthenticatedOperation {
+				t.Fatalf("%v: expected unauthenticated, got %v %v", auth.CertificateNames(cert), subject, err)
+			}
+			continue
+		}
+		if err != nil || subject.GetID() != c.expected {
+			t.Fatalf("%v: expected %d, got %v %v", auth.CertificateNames(cert), c.expected, subject, err)
+		}
+	}
+}
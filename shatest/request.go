@@ -0,0 +1,179 @@
+package shatest
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/zzztttkkk/sha"
+	"github.com/zzztttkkk/sha/utils"
+	"mime/multipart"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+type _File struct {
+	field    string
+	filename string
+	data     []byte
+}
+
+// RequestBuilder builds a raw http/1.1 request, the `Host` header is `example.com` if not set.
+type RequestBuilder struct {
+	method  string
+	path    string
+	header  sha.Header
+	query   sha.Form
+	form    sha.Form
+	files   []_File
+	cookies []string
+
+	body        []byte
+	contentType string
+	err         error
+}
+
+func NewRequest(method, path string) *RequestBuilder {
+	return &RequestBuilder{method: strings.ToUpper(method), path: path}
+}
+
+func Get(path string) *RequestBuilder  { return NewRequest(sha.MethodGet, path) }
+func Post(path string) *RequestBuilder { return NewRequest(sha.MethodPost, path) }
+
+func (b *RequestBuilder) Header(k, v string) *RequestBuilder {
+	b.header.Append(k, []byte(v))
+	return b
+}
+
+func (b *RequestBuilder) Query(k, v string) *RequestBuilder {
+	b.query.Append(k, []byte(v))
+	return b
+}
+
+// Form adds a form field, the body is url-encoded, or multipart if any file is added.
+func (b *RequestBuilder) Form(k, v string) *RequestBuilder {
+	b.form.Append(k, []byte(v))
+	return b
+}
+
+func (b *RequestBuilder) File(field, filename string, data []byte) *RequestBuilder {
+	b.files = append(b.files, _File{field: field, filename: filename, data: data})
+	return b
+}
+
+func (b *RequestBuilder) Cookie(k, v string) *RequestBuilder {
+	b.cookies = append(b.cookies, k+"="+v)
+	return b
+}
+
+// Body sets the raw body, the form fields and files are ignored.
+func (b *RequestBuilder) Body(contentType string, data []byte) *RequestBuilder {
+	b.contentType = contentType
+	b.body = data
+	return b
+}
+
+func (b *RequestBuilder) JSON(v interface{}) *RequestBuilder {
+	data, err := json.Marshal(v)
+	if err != nil {
+		b.err = err
+	}
+	return b.Body(sha.MIMEJson, data)
+}
+
+func (b *RequestBuilder) buildBody() ([]byte, string, error) {
+	if b.body != nil {
+		return b.body, b.contentType, nil
+	}
+
+	if len(b.files) > 0 {
+		var buf bytes.Buffer
+		w := multipart.NewWriter(&buf)
+		var err error
+		b.form.EachItem(func(item *utils.KvItem) bool {
+			err = w.WriteField(string(item.Key), string(item.Val))
+			return err == nil
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		for _, file := range b.files {
+			header := textproto.MIMEHeader{}
+			header.Set(
+				sha.HeaderContentDisposition,
+				`form-data; name="`+file.field+`"; filename="`+file.filename+`"`,
+			)
+			header.Set(sha.HeaderContentType, "application/octet-stream")
+			part, err := w.CreatePart(header)
+			if err != nil {
+				return nil, "", err
+			}
+			if _, err = part.Write(file.data); err != nil {
+				return nil, "", err
+			}
+		}
+		if err = w.Close(); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), w.FormDataContentType(), nil
+	}
+
+	if b.form.Size() > 0 {
+		var body []byte
+		b.form.EncodeToBuf(&body)
+		return body, sha.MIMEForm, nil
+	}
+	return nil, "", nil
+}
+
+// Bytes returns the raw request.
+func (b *RequestBuilder) Bytes() ([]byte, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	body, contentType, err := b.buildBody()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf []byte
+	buf = append(buf, b.method...)
+	buf = append(buf, ' ')
+	buf = append(buf, b.path...)
+	if b.query.Size() > 0 {
+		if strings.IndexByte(b.path, '?') > -1 {
+			buf = append(buf, '&')
+		} else {
+			buf = append(buf, '?')
+		}
+		b.query.EncodeToBuf(&buf)
+	}
+	buf = append(buf, " HTTP/1.1\r\n"...)
+
+	if _, ok := b.header.Get(sha.HeaderHost); !ok {
+		buf = appendHeader(buf, sha.HeaderHost, []byte("example.com"))
+	}
+	b.header.EachItem(func(item *utils.KvItem) bool {
+		buf = appendHeader(buf, string(item.Key), item.Val)
+		return true
+	})
+	if len(b.cookies) > 0 {
+		buf = appendHeader(buf, sha.HeaderCookie, []byte(strings.Join(b.cookies, "; ")))
+	}
+	if len(contentType) > 0 {
+		if _, ok := b.header.Get(sha.HeaderContentType); !ok {
+			buf = appendHeader(buf, sha.HeaderContentType, []byte(contentType))
+		}
+	}
+	if len(body) > 0 || b.method == sha.MethodPost || b.method == sha.MethodPut || b.method == sha.MethodPatch {
+		buf = appendHeader(buf, sha.HeaderContentLength, []byte(strconv.Itoa(len(body))))
+	}
+	buf = append(buf, "\r\n"...)
+	return append(buf, body...), nil
+}
+
+func appendHeader(buf []byte, k string, v []byte) []byte {
+	buf = append(buf, k...)
+	buf = append(buf, ": "...)
+	buf = append(buf, v...)
+	return append(buf, "\r\n"...)
+}
@@ -0,0 +1,87 @@
+package shatest
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/zzztttkkk/sha"
+	"testing"
+)
+
+type Response struct {
+	StatusCode int
+	Header     sha.Header // the keys are in the canonical form of `net/http`, e.g. `Content-Type`
+	Body       []byte
+}
+
+func (res *Response) JSON(v interface{}) error { return json.Unmarshal(res.Body, v) }
+
+// the assertions report the failures by `t.Errorf` and return the response for chaining.
+
+func (res *Response) ExpectStatus(t testing.TB, code int) *Response {
+	t.Helper()
+	if res.StatusCode != code {
+		t.Errorf("shatest: expected status %d, got %d", code, res.StatusCode)
+	}
+	return res
+}
+
+func (res *Response) ExpectHeader(t testing.TB, key, val string) *Response {
+	t.Helper()
+	v, ok := res.Header.Get(key)
+	if !ok {
+		t.Errorf("shatest: expected header `%s`, but it is missing", key)
+	} else if string(v) != val {
+		t.Errorf("shatest: expected header `%s: %s`, got `%s`", key, val, v)
+	}
+	return res
+}
+
+func (res *Response) ExpectNoHeader(t testing.TB, key string) *Response {
+	t.Helper()
+	if v, ok := res.Header.Get(key); ok {
+		t.Errorf("shatest: unexpected header `%s: %s`", key, v)
+	}
+	return res
+}
+
+func (res *Response) ExpectBody(t testing.TB, body string) *Response {
+	t.Helper()
+	if string(res.Body) != body {
+		t.Errorf("shatest: expected body %q, got %q", body, res.Body)
+	}
+	return res
+}
+
+func (res *Response) ExpectBodyContains(t testing.TB, sub string) *Response {
+	t.Helper()
+	if !bytes.Contains(res.Body, []byte(sub)) {
+		t.Errorf("shatest: expected body containing %q, got %q", sub, res.Body)
+	}
+	return res
+}
+
+// ExpectJSON compares the body with the json encoding of v.
+func (res *Response) ExpectJSON(t testing.TB, v interface{}) *Response {
+	t.Helper()
+	expected, err := json.Marshal(v)
+	if err != nil {
+		t.Errorf("shatest: %s", err)
+		return res
+	}
+	var a, b interface{}
+	if err = json.Unmarshal(res.Body, &a); err != nil {
+		t.Errorf("shatest: bad json body %q: %s", res.Body, err)
+		return res
+	}
+	_ = json.Unmarshal(expected, &b)
+	if !jsonEqual(a, b) {
+		t.Errorf("shatest: expected json %s, got %s", expected, res.Body)
+	}
+	return res
+}
+
+func jsonEqual(a, b interface{}) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return bytes.Equal(x, y)
+}
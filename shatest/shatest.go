@@ -0,0 +1,92 @@
+// Package shatest runs sha handlers in memory, the requests are served by the real http/1.1 protocol over `net.Pipe`.
+package shatest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"github.com/zzztttkkk/sha"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+type Tester struct {
+	server *sha.Server
+
+	// Timeout is the deadline of a whole exchange, zero means no timeout.
+	Timeout time.Duration
+}
+
+const DefaultTimeout = time.Second * 10
+
+// New returns a tester of the handler, e.g. a `*sha.Mux`. option is the option of the http/1.1 protocol, nil means default.
+func New(handler sha.RequestHandler, option *sha.HTTPOption) *Tester {
+	server := sha.New(context.Background(), &sha.ServerOption{}, sha.NewHTTP11Protocol(option), sha.NewWebSocketProtocol(nil))
+	server.Handler = handler
+	return &Tester{server: server, Timeout: DefaultTimeout}
+}
+
+// Server returns the server of the tester, e.g. to set `OnExpectContinue`.
+func (t *Tester) Server() *sha.Server { return t.server }
+
+var ErrNoResponse = errors.New("shatest: no response")
+
+// DoRaw sends the raw http/1.1 request bytes and reads the response.
+func (t *Tester) DoRaw(raw []byte) (*Response, error) {
+	method := ""
+	if ind := bytes.IndexByte(raw, ' '); ind > 0 {
+		method = string(raw[:ind])
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	if t.Timeout > 0 {
+		_ = client.SetDeadline(time.Now().Add(t.Timeout))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t.server.ServeConn(server)
+	}()
+	defer func() {
+		_ = client.Close()
+		<-done
+	}()
+
+	// net.Pipe is synchronous, the request is written while the response is read.
+	// the server may respond before the request is fully read, e.g. a bad request, the write fails after the pipe is closed.
+	go func() { _, _ = client.Write(raw) }()
+
+	res, err := http.ReadResponse(bufio.NewReader(client), &http.Request{Method: method})
+	if err != nil {
+		if err == io.EOF {
+			err = ErrNoResponse
+		}
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	rv := &Response{StatusCode: res.StatusCode}
+	for k, vs := range res.Header {
+		for _, v := range vs {
+			rv.Header.Append(k, []byte(v))
+		}
+	}
+	if rv.Body, err = io.ReadAll(res.Body); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// Do sends the request built by the builder and reads the response.
+func (t *Tester) Do(builder *RequestBuilder) (*Response, error) {
+	raw, err := builder.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return t.DoRaw(raw)
+}
@@ -0,0 +1,82 @@
+package shatest
+
+import (
+	"github.com/zzztttkkk/sha"
+	"testing"
+)
+
+func newTestMux() *sha.Mux {
+	mux := sha.NewMux(nil)
+	mux.HTTP("get", "/book/{name}", sha.RequestHandlerFunc(func(ctx *sha.RequestCtx) {
+		name, _ := ctx.Request.URLParams.Get("name")
+		page, _ := ctx.Request.QueryValue("page")
+		_, _ = ctx.WriteString(string(name) + ":" + string(page))
+	}))
+	mux.HTTP("post", "/form", sha.RequestHandlerFunc(func(ctx *sha.RequestCtx) {
+		v, _ := ctx.Request.BodyFormValue("title")
+		_, _ = ctx.Write(v)
+		if file := ctx.Request.Files().Get([]byte("doc")); file != nil {
+			_, _ = ctx.WriteString(" " + file.FileName + " " + string(file.Data()))
+		}
+	}))
+	mux.HTTP("get", "/cookie", sha.RequestHandlerFunc(func(ctx *sha.RequestCtx) {
+		v, _ := ctx.Request.CookieValue("session")
+		ctx.Response.Header.Set("X-Session", v)
+	}))
+	mux.HTTP("post", "/json", sha.RequestHandlerFunc(func(ctx *sha.RequestCtx) {
+		var v struct {
+			Name string `json:"name"`
+		}
+		if err := ctx.ValidateJSON(&v); err != nil {
+			panic(err)
+		}
+		ctx.WriteJSON(map[string]string{"hello": v.Name})
+	}))
+	return mux
+}
+
+func TestTester(t *testing.T) {
+	tester := New(newTestMux(), nil)
+
+	res, err := tester.Do(Get("/book/sand").Query("page", "1 2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.ExpectStatus(t, sha.StatusOK).ExpectBody(t, "sand:1 2")
+
+	res, err = tester.Do(Post("/form").Form("title", "a&b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.ExpectBody(t, "a&b")
+
+	res, err = tester.Do(Post("/form").Form("title", "x").File("doc", "a.txt", []byte("content")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.ExpectBody(t, "x a.txt content")
+
+	res, err = tester.Do(Get("/cookie").Cookie("session", "s1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.ExpectHeader(t, "X-Session", "s1")
+
+	res, err = tester.Do(Post("/json").JSON(map[string]string{"name": "sha"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.ExpectStatus(t, sha.StatusOK).ExpectJSON(t, map[string]string{"hello": "sha"})
+
+	res, err = tester.DoRaw([]byte("GET /missing HTTP/1.1\r\nHost: a\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.ExpectStatus(t, sha.StatusNotFound)
+
+	res, err = tester.DoRaw([]byte("GET / HTTP/1.1\r\nHost: a\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.ExpectStatus(t, sha.StatusBadRequest)
+}